@@ -1,16 +1,147 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/accrual"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/db"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/logging"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/server"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/varprs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+const shutdownTimeout = 10 * time.Second
+const startupCheckTimeout = 10 * time.Second
+
 func main() {
+	os.Exit(run())
+}
+
+func run() int {
 	varprs.Init()
-	db.RunMigrations(varprs.DBURI)
-	storageForHandler := storage.GetStorage(varprs.DBURI)
-	serverToRun := server.CreateServer(storageForHandler)
-	serverToRun.ListenAndServe()
+	logger, err := logging.New(os.Stderr, varprs.LogLevel, varprs.LogFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create logger: %s\n", err.Error())
+		return 1
+	}
+	slog.SetDefault(logger)
+	logger.Info("Starting GopherMart",
+		"address", varprs.ServerAddr,
+		"storage", varprs.StorageType,
+		"database_uri", logging.RedactURI(varprs.DBURI),
+		"accrual_address", varprs.AccrualSysAddr,
+		"accrual_workers", varprs.AccrualWorkers,
+	)
+	if err := accrual.CheckAddress(varprs.AccrualSysAddr); err != nil {
+		logger.Error("Got bad accrual system address", "error", err)
+		return 1
+	}
+	var storageForHandler storage.Storage
+	switch varprs.StorageType {
+	case "memory":
+		logger.Warn("Using in-memory storage, all data will be lost on restart")
+		storageForHandler = storage.NewMemStorage(logger)
+	case "postgres":
+		if varprs.DBURI == "" {
+			logger.Error("DATABASE_URI is required, set STORAGE_TYPE=memory to run without a database")
+			return 1
+		}
+		if err := db.RunMigrations(varprs.DBURI); err != nil {
+			logger.Error("Could not run migrations", "error", err)
+			return 1
+		}
+		dbStorage, err := storage.GetStorage(varprs.DBURI, logger)
+		if err != nil {
+			logger.Error("Could not create storage", "error", err)
+			return 1
+		}
+		storageForHandler = dbStorage
+	default:
+		logger.Error("Got unknown storage type", "storage", varprs.StorageType)
+		return 1
+	}
+	storageForHandler = storage.NewInstrumentedStorage(storageForHandler)
+	defer func() {
+		if err := storageForHandler.Close(); err != nil {
+			logger.Error("Could not close storage", "error", err)
+		}
+	}()
+	if err := checkStorage(storageForHandler); err != nil {
+		logger.Error("Storage is not ready", "error", err)
+		return 1
+	}
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(signalCtx)
+	defer cancel()
+
+	keys, err := server.CreateKeyring(logger)
+	if err != nil {
+		logger.Error("Could not load cookie signing keys", "error", err)
+		return 1
+	}
+	pingCtx, cancelPing := context.WithTimeout(ctx, startupCheckTimeout)
+	if err := accrual.NewHTTPClient(varprs.AccrualSysAddr).Ping(pingCtx); err != nil {
+		logger.Warn("Accrual system is not reachable yet, orders will wait in the queue", "error", err)
+	}
+	cancelPing()
+	server.PromoteAdmins(ctx, storageForHandler, logger)
+	poller := server.CreatePoller(storageForHandler, logger)
+	serverToRun := server.CreateServer(storageForHandler, poller, keys, logger)
+
+	pollerDone := make(chan struct{})
+	go func() {
+		poller.Run(ctx)
+		close(pollerDone)
+	}()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- serverToRun.ListenAndServe()
+	}()
+
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		logger.Info("Got shutdown signal, stopping GopherMart")
+	case err := <-serverErr:
+		logger.Error("Server stopped with error", "error", err)
+		exitCode = 1
+	}
+	cancel()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := serverToRun.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Could not shutdown server gracefully", "error", err)
+		exitCode = 1
+	}
+	select {
+	case <-pollerDone:
+	case <-shutdownCtx.Done():
+		logger.Error("Accrual poller did not stop in time")
+		exitCode = 1
+	}
+	return exitCode
+}
+
+// checkStorage makes sure the storage answers and has the expected schema before serving requests.
+func checkStorage(storageToCheck storage.Storage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+	defer cancel()
+	if err := storageToCheck.Ping(ctx); err != nil {
+		return err
+	}
+	if varprs.StorageType != "postgres" {
+		return nil
+	}
+	return server.CheckSchemaVersion(ctx, storageToCheck)
 }
@@ -0,0 +1,194 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/money"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+type OrderStatus string
+
+const (
+	StatusRegistered OrderStatus = "REGISTERED"
+	StatusInvalid    OrderStatus = "INVALID"
+	StatusProcessing OrderStatus = "PROCESSING"
+	StatusProcessed  OrderStatus = "PROCESSED"
+)
+
+type OrderInfo struct {
+	Order   string       `json:"order"`
+	Status  OrderStatus  `json:"status"`
+	Accrual money.Amount `json:"accrual,omitempty"`
+}
+
+// UnmarshalJSON decodes the accrual as a float rounded to hundredths, the
+// accrual system may send more fractional digits or an exponent.
+func (info *OrderInfo) UnmarshalJSON(data []byte) error {
+	var decoded struct {
+		Order   string      `json:"order"`
+		Status  OrderStatus `json:"status"`
+		Accrual *float64    `json:"accrual"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*info = OrderInfo{Order: decoded.Order, Status: decoded.Status}
+	if decoded.Accrual != nil {
+		info.Accrual = money.FromFloat(*decoded.Accrual)
+	}
+	return nil
+}
+
+// IsFinal reports whether the accrual system will not change the order any more.
+func (info OrderInfo) IsFinal() bool {
+	return info.Status == StatusInvalid || info.Status == StatusProcessed
+}
+
+var ErrOrderNotRegistered = errors.New("order is not registered in accrual system")
+
+// RateLimitError is returned when the accrual system answers 429.
+// Limit holds the allowed number of requests per minute, or 0 if it could not be parsed.
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Limit      int
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("accrual system rate limit of %d requests per minute exceeded, retry after %s", e.Limit, e.RetryAfter)
+}
+
+type UnexpectedStatusError struct {
+	StatusCode int
+}
+
+func (e *UnexpectedStatusError) Error() string {
+	return fmt.Sprintf("got unexpected status code %d from accrual system", e.StatusCode)
+}
+
+// AccrualClient fetches order calculation results from the accrual system.
+type AccrualClient interface {
+	GetOrder(ctx context.Context, number string) (OrderInfo, error)
+}
+
+// CheckAddress reports whether address is an absolute http(s) URL of the accrual system.
+func CheckAddress(address string) error {
+	if address == "" {
+		return errors.New("accrual system address is not set")
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("could not parse accrual system address: %w", err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("accrual system address %s must be an http or https URL", address)
+	}
+	return nil
+}
+
+type HTTPClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewHTTPClient(baseURL string) *HTTPClient {
+	return &HTTPClient{baseURL: baseURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (c *HTTPClient) GetOrder(ctx context.Context, number string) (OrderInfo, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/orders/"+url.PathEscape(number), nil)
+	if err != nil {
+		return OrderInfo{}, err
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return OrderInfo{}, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		var info OrderInfo
+		data, err := io.ReadAll(response.Body)
+		if err != nil {
+			return OrderInfo{}, err
+		}
+		if err := json.Unmarshal(data, &info); err != nil {
+			return OrderInfo{}, err
+		}
+		return info, nil
+	case http.StatusNoContent:
+		return OrderInfo{}, ErrOrderNotRegistered
+	case http.StatusTooManyRequests:
+		rateLimitErr := &RateLimitError{RetryAfter: parseRetryAfter(response.Header.Get("Retry-After"))}
+		if data, err := io.ReadAll(response.Body); err == nil {
+			rateLimitErr.Limit = parseRequestsLimit(string(data))
+		}
+		return OrderInfo{}, rateLimitErr
+	default:
+		return OrderInfo{}, &UnexpectedStatusError{StatusCode: response.StatusCode}
+	}
+}
+
+// Ping checks that the accrual system accepts connections. It does not send a
+// request, so it does not count against the rate limit of the accrual system.
+func (c *HTTPClient) Ping(ctx context.Context) error {
+	if err := CheckAddress(c.baseURL); err != nil {
+		return err
+	}
+	parsed, _ := url.Parse(c.baseURL)
+	port := parsed.Port()
+	if port == "" {
+		port = "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(parsed.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+var requestsLimitRegexp = regexp.MustCompile(`(\d+) requests per minute`)
+
+// parseRequestsLimit extracts N from the "No more than N requests per minute allowed" body.
+func parseRequestsLimit(body string) int {
+	match := requestsLimitRegexp.FindStringSubmatch(body)
+	if match == nil {
+		return 0
+	}
+	limit, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+	return limit
+}
+
+// parseRetryAfter supports both forms of the header: delay in seconds and HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
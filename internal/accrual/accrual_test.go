@@ -0,0 +1,142 @@
+package accrual
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/money"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPClientGetOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		header     map[string]string
+		body       string
+		wantInfo   OrderInfo
+		wantErr    error
+	}{
+		{
+			name:       "processed_order",
+			statusCode: http.StatusOK,
+			header:     map[string]string{"Content-Type": "application/json"},
+			body:       `{"order": "5843", "status": "PROCESSED", "accrual": 729.98}`,
+			wantInfo:   OrderInfo{Order: "5843", Status: StatusProcessed, Accrual: money.FromFloat(729.98)},
+		},
+		{
+			name:       "float_artifact_accrual",
+			statusCode: http.StatusOK,
+			header:     map[string]string{"Content-Type": "application/json"},
+			body:       `{"order": "5843", "status": "PROCESSED", "accrual": 0.30000000000000004}`,
+			wantInfo:   OrderInfo{Order: "5843", Status: StatusProcessed, Accrual: money.Amount(30)},
+		},
+		{
+			name:       "accrual_rounded_half_away_from_zero",
+			statusCode: http.StatusOK,
+			header:     map[string]string{"Content-Type": "application/json"},
+			body:       `{"order": "5843", "status": "PROCESSED", "accrual": 12.125}`,
+			wantInfo:   OrderInfo{Order: "5843", Status: StatusProcessed, Accrual: money.Amount(1213)},
+		},
+		{
+			name:       "exponent_accrual",
+			statusCode: http.StatusOK,
+			header:     map[string]string{"Content-Type": "application/json"},
+			body:       `{"order": "5843", "status": "PROCESSED", "accrual": 1e3}`,
+			wantInfo:   OrderInfo{Order: "5843", Status: StatusProcessed, Accrual: money.Amount(100000)},
+		},
+		{
+			name:       "order_without_accrual",
+			statusCode: http.StatusOK,
+			header:     map[string]string{"Content-Type": "application/json"},
+			body:       `{"order": "5843", "status": "REGISTERED"}`,
+			wantInfo:   OrderInfo{Order: "5843", Status: StatusRegistered},
+		},
+		{
+			name:       "not_registered_order",
+			statusCode: http.StatusNoContent,
+			wantErr:    ErrOrderNotRegistered,
+		},
+		{
+			name:       "too_many_requests",
+			statusCode: http.StatusTooManyRequests,
+			header:     map[string]string{"Retry-After": "60"},
+			body:       "No more than 10 requests per minute allowed",
+			wantErr:    &RateLimitError{RetryAfter: 60 * time.Second, Limit: 10},
+		},
+		{
+			name:       "internal_error",
+			statusCode: http.StatusInternalServerError,
+			wantErr:    &UnexpectedStatusError{StatusCode: http.StatusInternalServerError},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/orders/5843", r.URL.Path)
+				for key, value := range tt.header {
+					w.Header().Set(key, value)
+				}
+				w.WriteHeader(tt.statusCode)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			info, err := NewHTTPClient(server.URL).GetOrder(context.Background(), "5843")
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.wantInfo, info)
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("abc"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-5"))
+	assert.Equal(t, 60*time.Second, parseRetryAfter("60"))
+	delay := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, delay > 50*time.Second && delay <= time.Minute)
+}
+
+func TestParseRequestsLimit(t *testing.T) {
+	assert.Equal(t, 10, parseRequestsLimit("No more than 10 requests per minute allowed"))
+	assert.Equal(t, 0, parseRequestsLimit("Too many requests"))
+}
+
+func TestCheckAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{"http", "http://localhost:8080", false},
+		{"https_without_port", "https://accrual.example.com", false},
+		{"empty", "", true},
+		{"without_scheme", "localhost:8080", true},
+		{"unsupported_scheme", "ftp://localhost:8080", true},
+		{"without_host", "http://", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckAddress(tt.address)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestHTTPClientPing(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	assert.Nil(t, NewHTTPClient(server.URL).Ping(context.Background()))
+	server.Close()
+	assert.Equal(t, 0, requests)
+	assert.NotNil(t, NewHTTPClient(server.URL).Ping(context.Background()))
+	assert.NotNil(t, NewHTTPClient("").Ping(context.Background()))
+}
@@ -0,0 +1,55 @@
+package accrual
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeClient is an in-memory AccrualClient for tests.
+// Orders without a configured response are reported as not registered.
+type FakeClient struct {
+	mu     sync.Mutex
+	orders map[string]OrderInfo
+	errors map[string]error
+	calls  map[string]int
+}
+
+func NewFakeClient() *FakeClient {
+	return &FakeClient{orders: make(map[string]OrderInfo), errors: make(map[string]error), calls: make(map[string]int)}
+}
+
+func (c *FakeClient) SetOrder(info OrderInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.orders[info.Order] = info
+	delete(c.errors, info.Order)
+}
+
+func (c *FakeClient) SetError(number string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors[number] = err
+}
+
+func (c *FakeClient) Calls(number string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[number]
+}
+
+func (c *FakeClient) GetOrder(ctx context.Context, number string) (OrderInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return OrderInfo{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[number]++
+	if err, ok := c.errors[number]; ok {
+		return OrderInfo{}, err
+	}
+	info, ok := c.orders[number]
+	if !ok {
+		return OrderInfo{}, ErrOrderNotRegistered
+	}
+	return info, nil
+}
@@ -0,0 +1,152 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var DefaultRetryAfter = 1 * time.Second
+
+// RateLimiter is a token bucket shared by all requests to the accrual system.
+// It lets requests through without limit until SetLimit is called and can be
+// paused for a while, which blocks every caller of Wait until the pause ends.
+type RateLimiter struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	burst       float64
+	tokens      float64
+	lastRefill  time.Time
+	pausedUntil time.Time
+}
+
+func NewRateLimiter(requestsPerMinute int, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	limiter := &RateLimiter{burst: float64(burst), tokens: float64(burst), lastRefill: time.Now()}
+	limiter.SetLimit(requestsPerMinute)
+	return limiter
+}
+
+// SetLimit changes the allowed rate, zero or negative value disables the limit.
+func (l *RateLimiter) SetLimit(requestsPerMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if requestsPerMinute <= 0 {
+		l.interval = 0
+		return
+	}
+	l.interval = time.Minute / time.Duration(requestsPerMinute)
+}
+
+// PauseFor blocks all callers of Wait for the given duration and drains the bucket.
+func (l *RateLimiter) PauseFor(delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pausedUntil := time.Now().Add(delay)
+	if pausedUntil.After(l.pausedUntil) {
+		l.pausedUntil = pausedUntil
+	}
+	l.tokens = 0
+	l.lastRefill = l.pausedUntil
+}
+
+// Wait blocks until a request is allowed or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := l.reserve()
+		if delay == 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (l *RateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.interval == 0 {
+		return 0
+	}
+	l.refill(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) * float64(l.interval))
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if now.Before(l.lastRefill) {
+		return
+	}
+	if l.interval > 0 {
+		l.tokens += float64(now.Sub(l.lastRefill)) / float64(l.interval)
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	} else {
+		l.tokens = l.burst
+	}
+	l.lastRefill = now
+}
+
+// RateLimitedClient paces requests of the wrapped client with a RateLimiter and
+// adjusts the limiter whenever the accrual system reports that the limit is exceeded.
+type RateLimitedClient struct {
+	client  AccrualClient
+	limiter *RateLimiter
+	logger  *slog.Logger
+}
+
+func NewRateLimitedClient(client AccrualClient, limiter *RateLimiter, logger *slog.Logger) *RateLimitedClient {
+	return &RateLimitedClient{client: client, limiter: limiter, logger: logger}
+}
+
+// waitContextKey keys the context that interrupts waiting for the rate limit.
+type waitContextKey struct{}
+
+// withWaitContext makes RateLimitedClient stop waiting for the rate limit when
+// waitCtx is done, while the request itself still runs with ctx.
+func withWaitContext(ctx context.Context, waitCtx context.Context) context.Context {
+	return context.WithValue(ctx, waitContextKey{}, waitCtx)
+}
+
+// GetOrder waits for the rate limit with the context set by withWaitContext, if any.
+func (c *RateLimitedClient) GetOrder(ctx context.Context, number string) (OrderInfo, error) {
+	waitCtx := ctx
+	if value, ok := ctx.Value(waitContextKey{}).(context.Context); ok {
+		waitCtx = value
+	}
+	if err := c.limiter.Wait(waitCtx); err != nil {
+		return OrderInfo{}, err
+	}
+	info, err := c.client.GetOrder(ctx, number)
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		retryAfter := rateLimitErr.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = DefaultRetryAfter
+		}
+		c.logger.WarnContext(ctx, "Accrual system rate limit exceeded, pausing requests", "limit_per_minute", rateLimitErr.Limit, "pause", retryAfter)
+		if rateLimitErr.Limit > 0 {
+			c.limiter.SetLimit(rateLimitErr.Limit)
+		}
+		c.limiter.PauseFor(retryAfter)
+	}
+	return info, err
+}
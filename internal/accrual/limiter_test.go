@@ -0,0 +1,58 @@
+package accrual
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWithoutLimit(t *testing.T) {
+	limiter := NewRateLimiter(0, 1)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, limiter.Wait(context.Background()))
+	}
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestRateLimiterPacesRequests(t *testing.T) {
+	limiter := NewRateLimiter(1200, 1)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, limiter.Wait(context.Background()))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	limiter := NewRateLimiter(0, 1)
+	limiter.PauseFor(100 * time.Millisecond)
+	start := time.Now()
+	assert.Nil(t, limiter.Wait(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+	limiter.PauseFor(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, limiter.Wait(ctx), context.DeadlineExceeded)
+}
+
+func TestRateLimitedClientAppliesServerLimit(t *testing.T) {
+	fakeClient := NewFakeClient()
+	fakeClient.SetError("5843", &RateLimitError{RetryAfter: 100 * time.Millisecond, Limit: 60})
+	limiter := NewRateLimiter(0, 1)
+	client := NewRateLimitedClient(fakeClient, limiter, slog.Default())
+
+	_, err := client.GetOrder(context.Background(), "5843")
+	var rateLimitErr *RateLimitError
+	assert.ErrorAs(t, err, &rateLimitErr)
+	assert.Equal(t, time.Second, limiter.interval)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.GetOrder(ctx, "5843")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, fakeClient.Calls("5843"))
+}
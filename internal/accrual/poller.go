@@ -0,0 +1,294 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/metrics"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type PollerConfig struct {
+	Workers      int
+	QueueSize    int
+	PollInterval time.Duration
+	JobLease     time.Duration
+	StatusDelay  time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	// HeartbeatTimeout is how long the dispatch loop may be silent before the poller is considered stuck.
+	HeartbeatTimeout time.Duration
+	// DrainTimeout is how long a request to the accrual system may still run after Run is cancelled.
+	DrainTimeout time.Duration
+}
+
+var DefaultPollerConfig = PollerConfig{
+	Workers:          4,
+	QueueSize:        16,
+	PollInterval:     1 * time.Second,
+	JobLease:         5 * time.Minute,
+	StatusDelay:      1 * time.Second,
+	MinBackoff:       1 * time.Second,
+	MaxBackoff:       1 * time.Minute,
+	HeartbeatTimeout: 30 * time.Second,
+	DrainTimeout:     5 * time.Second,
+}
+
+// Poller claims accrual jobs from storage and hands them to a fixed pool of
+// workers through a bounded queue. Jobs are claimed only while the queue has
+// free slots, so a slow accrual system holds work back in the database.
+type Poller struct {
+	storage   storage.Storage
+	client    AccrualClient
+	config    PollerConfig
+	jobs      chan storage.AccrualJob
+	newOrders chan struct{}
+	logger    *slog.Logger
+	// heartbeat is the Unix time in nanoseconds of the last dispatch loop iteration, 0 when not running.
+	heartbeat atomic.Int64
+}
+
+func NewPoller(storageForPoller storage.Storage, client AccrualClient, config PollerConfig, logger *slog.Logger) *Poller {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.QueueSize < config.Workers {
+		config.QueueSize = config.Workers
+	}
+	if config.HeartbeatTimeout < 2*config.PollInterval {
+		config.HeartbeatTimeout = 2 * config.PollInterval
+	}
+	return &Poller{
+		storage:   storageForPoller,
+		client:    client,
+		config:    config,
+		jobs:      make(chan storage.AccrualJob, config.QueueSize),
+		newOrders: make(chan struct{}, 1),
+		logger:    logger,
+	}
+}
+
+// Notify wakes the poller up without waiting for the next poll interval.
+func (p *Poller) Notify() {
+	select {
+	case p.newOrders <- struct{}{}:
+	default:
+	}
+}
+
+// Run polls the accrual system until ctx is done. Workers finish the order they
+// are processing if the accrual system answers within DrainTimeout, orders
+// waiting for the rate limit and queued jobs are released back to storage,
+// then Run returns.
+func (p *Poller) Run(ctx context.Context) {
+	p.restoreJobs(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < p.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+	p.dispatch(ctx)
+	p.heartbeat.Store(0)
+	close(p.jobs)
+	wg.Wait()
+	p.logger.Info("Accrual poller stopped")
+}
+
+func (p *Poller) dispatch(ctx context.Context) {
+	for ctx.Err() == nil {
+		p.heartbeat.Store(time.Now().UnixNano())
+		free := cap(p.jobs) - len(p.jobs)
+		if free == 0 {
+			p.wait(ctx)
+			continue
+		}
+		jobs, err := p.storage.ClaimAccrualJobs(ctx, free, p.config.JobLease)
+		if err != nil {
+			p.logger.ErrorContext(ctx, "Could not claim accrual jobs", "error", err)
+			p.wait(ctx)
+			continue
+		}
+		if len(jobs) == 0 {
+			p.wait(ctx)
+			continue
+		}
+		for i, job := range jobs {
+			select {
+			case p.jobs <- job:
+				metrics.AccrualQueueDepth.Set(float64(len(p.jobs)))
+			case <-ctx.Done():
+				for _, notQueued := range jobs[i:] {
+					p.release(notQueued)
+				}
+				return
+			}
+		}
+	}
+}
+
+// CheckHeartbeat returns an error when the poller is not running or its dispatch loop is stuck.
+func (p *Poller) CheckHeartbeat() error {
+	heartbeat := p.heartbeat.Load()
+	if heartbeat == 0 {
+		return errors.New("accrual poller is not running")
+	}
+	if silence := time.Since(time.Unix(0, heartbeat)); silence > p.config.HeartbeatTimeout {
+		return fmt.Errorf("accrual poller has not polled for %s", silence.Round(time.Second))
+	}
+	return nil
+}
+
+func (p *Poller) wait(ctx context.Context) {
+	timer := time.NewTimer(p.config.PollInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-p.newOrders:
+	case <-timer.C:
+	}
+}
+
+func (p *Poller) work(ctx context.Context) {
+	for job := range p.jobs {
+		metrics.AccrualQueueDepth.Set(float64(len(p.jobs)))
+		if ctx.Err() != nil {
+			p.release(job)
+			continue
+		}
+		metrics.AccrualInFlight.Inc()
+		p.process(ctx, job)
+		metrics.AccrualInFlight.Dec()
+	}
+}
+
+// release makes a claimed job available again without waiting for its lease to expire.
+func (p *Poller) release(job storage.AccrualJob) {
+	if err := p.storage.RescheduleAccrualJob(context.Background(), job.OrderNumber, 0, job.LastError); err != nil {
+		p.logger.Error("Could not release accrual job", "order", job.OrderNumber, "error", err)
+	}
+}
+
+func (p *Poller) restoreJobs(ctx context.Context) {
+	orders, err := p.storage.GetOrdersInProgress(ctx)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Could not get orders in progress", "error", err)
+		return
+	}
+	for _, order := range orders {
+		if err := p.storage.AddAccrualJob(ctx, order.Number); err != nil {
+			p.logger.ErrorContext(ctx, "Could not restore accrual job", "order", order.Number, "error", err)
+		}
+	}
+}
+
+// process lets the request to the accrual system finish after shutdown within
+// DrainTimeout, but a rate limit pause is interrupted right away. The job is
+// released when shutdown interrupts it. Once the answer is received, storage is
+// updated with a detached context, so the order is always either updated or rescheduled.
+func (p *Poller) process(runCtx context.Context, job storage.AccrualJob) {
+	orderNumber := job.OrderNumber
+	p.logger.DebugContext(runCtx, "Got order to process", "order", orderNumber, "attempt", job.Attempts)
+	requestCtx, cancel := p.drainContext(runCtx)
+	defer cancel()
+	info, err := p.client.GetOrder(withWaitContext(requestCtx, runCtx), orderNumber)
+	if err != nil && runCtx.Err() != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		p.logger.InfoContext(runCtx, "Poller is stopping, releasing accrual job", "order", orderNumber)
+		p.release(job)
+		return
+	}
+	ctx := context.Background()
+	if err != nil {
+		delay := p.backoff(job.Attempts)
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			metrics.AccrualRateLimited.Inc()
+			if rateLimitErr.RetryAfter > delay {
+				delay = rateLimitErr.RetryAfter
+			}
+		}
+		p.logger.WarnContext(ctx, "Could not get order from accrual system", "order", orderNumber, "retry_in", delay, "error", err)
+		metrics.AccrualRetries.Inc()
+		p.reschedule(ctx, orderNumber, delay, err.Error())
+		return
+	}
+	p.logger.DebugContext(ctx, "Got order info", "order", orderNumber, "status", info.Status, "accrual", info.Accrual)
+	newOrder := storage.OrderFromBlackBox{Order: orderNumber, Status: string(info.Status), Accrual: info.Accrual}
+	if info.Status == StatusRegistered {
+		newOrder.Status = string(StatusProcessing)
+	}
+	err = p.storage.UpdateOrder(ctx, newOrder)
+	if errors.Is(err, storage.ErrOrderFinal) {
+		p.logger.InfoContext(ctx, "Order is already final, keeping its status", "order", orderNumber, "got_status", info.Status)
+		p.complete(ctx, orderNumber)
+		return
+	}
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Could not update order", "order", orderNumber, "error", err)
+		metrics.AccrualRetries.Inc()
+		p.reschedule(ctx, orderNumber, p.backoff(job.Attempts), "could not update order: "+err.Error())
+		return
+	}
+	if info.Status == StatusProcessed {
+		metrics.AccruedPoints.Add(info.Accrual.Float64())
+	}
+	if info.IsFinal() {
+		p.complete(ctx, orderNumber)
+		return
+	}
+	p.reschedule(ctx, orderNumber, p.config.StatusDelay, "")
+}
+
+// drainContext returns a context that is cancelled DrainTimeout after runCtx is done.
+func (p *Poller) drainContext(runCtx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(runCtx))
+	stop := context.AfterFunc(runCtx, func() {
+		timer := time.NewTimer(p.config.DrainTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-ctx.Done():
+		}
+	})
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+func (p *Poller) complete(ctx context.Context, orderNumber string) {
+	if err := p.storage.CompleteAccrualJob(ctx, orderNumber); err != nil {
+		p.logger.ErrorContext(ctx, "Could not complete accrual job", "order", orderNumber, "error", err)
+	}
+}
+
+func (p *Poller) reschedule(ctx context.Context, orderNumber string, delay time.Duration, lastError string) {
+	if err := p.storage.RescheduleAccrualJob(ctx, orderNumber, delay, lastError); err != nil {
+		p.logger.ErrorContext(ctx, "Could not reschedule accrual job", "order", orderNumber, "error", err)
+	}
+}
+
+// backoff returns an exponential delay for the given attempt with "equal jitter":
+// a random value between half of the delay and the delay itself.
+func (p *Poller) backoff(attempts int) time.Duration {
+	delay := p.config.MinBackoff
+	for i := 1; i < attempts && delay < p.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.config.MaxBackoff {
+		delay = p.config.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
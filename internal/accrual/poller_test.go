@@ -0,0 +1,293 @@
+package accrual
+
+import (
+	"context"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/metrics"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/mocks"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/money"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestPollerProcess(t *testing.T) {
+	tt := []struct {
+		name       string
+		orderInfo  *OrderInfo
+		orderErr   error
+		wantUpdate *storage.OrderFromBlackBox
+		wantDone   bool
+		wantDelay  time.Duration
+		wantRetry  bool
+		wantPoints float64
+		updateErr  error
+	}{
+		{
+			"processed_order",
+			&OrderInfo{Order: "5843", Status: StatusProcessed, Accrual: money.FromFloat(500)},
+			nil,
+			&storage.OrderFromBlackBox{Order: "5843", Status: "PROCESSED", Accrual: money.FromFloat(500)},
+			true,
+			0,
+			false,
+			500,
+			nil,
+		},
+		{
+			"registered_order",
+			&OrderInfo{Order: "5843", Status: StatusRegistered},
+			nil,
+			&storage.OrderFromBlackBox{Order: "5843", Status: "PROCESSING"},
+			false,
+			DefaultPollerConfig.StatusDelay,
+			false,
+			0,
+			nil,
+		},
+		{
+			"repolled_final_order",
+			&OrderInfo{Order: "5843", Status: StatusProcessing},
+			nil,
+			&storage.OrderFromBlackBox{Order: "5843", Status: "PROCESSING"},
+			true,
+			0,
+			false,
+			0,
+			storage.ErrOrderFinal,
+		},
+		{
+			"rate_limited",
+			nil,
+			&RateLimitError{RetryAfter: time.Hour},
+			nil,
+			false,
+			time.Hour,
+			true,
+			0,
+			nil,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			storageMock := mocks.NewMockStorage(ctrl)
+			client := NewFakeClient()
+			if tc.orderInfo != nil {
+				client.SetOrder(*tc.orderInfo)
+			}
+			if tc.orderErr != nil {
+				client.SetError("5843", tc.orderErr)
+			}
+			if tc.wantUpdate != nil {
+				storageMock.EXPECT().UpdateOrder(gomock.Any(), *tc.wantUpdate).Return(tc.updateErr)
+			}
+			if tc.wantDone {
+				storageMock.EXPECT().CompleteAccrualJob(gomock.Any(), "5843").Return(nil)
+			} else {
+				storageMock.EXPECT().RescheduleAccrualJob(gomock.Any(), "5843", tc.wantDelay, gomock.Any()).Return(nil)
+			}
+			retries := testutil.ToFloat64(metrics.AccrualRetries)
+			rateLimited := testutil.ToFloat64(metrics.AccrualRateLimited)
+			points := testutil.ToFloat64(metrics.AccruedPoints)
+			NewPoller(storageMock, client, DefaultPollerConfig, slog.Default()).process(context.Background(), storage.AccrualJob{OrderNumber: "5843", Attempts: 1})
+			assert.Equal(t, 1, client.Calls("5843"))
+			if tc.wantRetry {
+				assert.Equal(t, retries+1, testutil.ToFloat64(metrics.AccrualRetries))
+				assert.Equal(t, rateLimited+1, testutil.ToFloat64(metrics.AccrualRateLimited))
+			} else {
+				assert.Equal(t, retries, testutil.ToFloat64(metrics.AccrualRetries))
+			}
+			assert.Equal(t, points+tc.wantPoints, testutil.ToFloat64(metrics.AccruedPoints))
+		})
+	}
+}
+
+func TestPollerBackoff(t *testing.T) {
+	config := DefaultPollerConfig
+	config.MinBackoff = time.Second
+	config.MaxBackoff = 10 * time.Second
+	poller := NewPoller(nil, nil, config, slog.Default())
+	for _, tc := range []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{10, 10 * time.Second},
+	} {
+		for i := 0; i < 20; i++ {
+			delay := poller.backoff(tc.attempts)
+			assert.GreaterOrEqual(t, delay, tc.max/2)
+			assert.LessOrEqual(t, delay, tc.max)
+		}
+	}
+}
+
+func TestPollerRunStopsOnCancel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	storageMock := mocks.NewMockStorage(ctrl)
+	client := NewFakeClient()
+	client.SetOrder(OrderInfo{Order: "5843", Status: StatusProcessed, Accrual: money.FromFloat(500)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storageMock.EXPECT().GetOrdersInProgress(gomock.Any()).Return([]storage.Order{{Number: "5843", Status: "NEW"}}, nil)
+	storageMock.EXPECT().AddAccrualJob(gomock.Any(), "5843").Return(nil)
+	first := storageMock.EXPECT().ClaimAccrualJobs(gomock.Any(), gomock.Any(), gomock.Any()).Return([]storage.AccrualJob{{OrderNumber: "5843", Attempts: 1}}, nil)
+	storageMock.EXPECT().ClaimAccrualJobs(gomock.Any(), gomock.Any(), gomock.Any()).Return([]storage.AccrualJob{}, nil).After(first).AnyTimes()
+	storageMock.EXPECT().UpdateOrder(gomock.Any(), storage.OrderFromBlackBox{Order: "5843", Status: "PROCESSED", Accrual: money.FromFloat(500)}).Return(nil)
+	storageMock.EXPECT().CompleteAccrualJob(gomock.Any(), "5843").DoAndReturn(func(context.Context, string) error {
+		cancel()
+		return nil
+	})
+
+	config := DefaultPollerConfig
+	config.PollInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		NewPoller(storageMock, client, config, slog.Default()).Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Poller did not stop after cancel")
+	}
+}
+
+func TestPollerHeartbeat(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	storageMock := mocks.NewMockStorage(ctrl)
+	storageMock.EXPECT().GetOrdersInProgress(gomock.Any()).Return(nil, nil)
+	storageMock.EXPECT().ClaimAccrualJobs(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+	config := DefaultPollerConfig
+	config.PollInterval = 10 * time.Millisecond
+	poller := NewPoller(storageMock, NewFakeClient(), config, slog.Default())
+	assert.NotNil(t, poller.CheckHeartbeat())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		poller.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return poller.CheckHeartbeat() == nil }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+	assert.NotNil(t, poller.CheckHeartbeat())
+}
+
+func TestPollerRunStopsWhileRateLimited(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	storageMock := mocks.NewMockStorage(ctrl)
+	client := NewFakeClient()
+	client.SetOrder(OrderInfo{Order: "5843", Status: StatusProcessed, Accrual: money.FromFloat(500)})
+	limiter := NewRateLimiter(0, 1)
+	limiter.PauseFor(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	claimed := make(chan struct{})
+	storageMock.EXPECT().GetOrdersInProgress(gomock.Any()).Return(nil, nil)
+	first := storageMock.EXPECT().ClaimAccrualJobs(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(context.Context, int, time.Duration) ([]storage.AccrualJob, error) {
+			close(claimed)
+			return []storage.AccrualJob{{OrderNumber: "5843", Attempts: 1}}, nil
+		})
+	storageMock.EXPECT().ClaimAccrualJobs(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil).After(first).AnyTimes()
+	storageMock.EXPECT().RescheduleAccrualJob(gomock.Any(), "5843", time.Duration(0), "").Return(nil)
+
+	config := DefaultPollerConfig
+	config.Workers = 1
+	config.PollInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		NewPoller(storageMock, NewRateLimitedClient(client, limiter, slog.Default()), config, slog.Default()).Run(ctx)
+		close(done)
+	}()
+	<-claimed
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Poller did not stop while the rate limiter is paused")
+	}
+	assert.Equal(t, 0, client.Calls("5843"))
+}
+
+// slowClient answers after delay unless the request context is done first.
+type slowClient struct {
+	delay   time.Duration
+	info    OrderInfo
+	started chan struct{}
+}
+
+func (c *slowClient) GetOrder(ctx context.Context, number string) (OrderInfo, error) {
+	close(c.started)
+	select {
+	case <-time.After(c.delay):
+		return c.info, nil
+	case <-ctx.Done():
+		return OrderInfo{}, ctx.Err()
+	}
+}
+
+func TestPollerRunDrainsInFlightRequest(t *testing.T) {
+	tt := []struct {
+		name         string
+		delay        time.Duration
+		drainTimeout time.Duration
+		wantReleased bool
+	}{
+		{"answer_within_drain_timeout", 100 * time.Millisecond, time.Second, false},
+		{"answer_after_drain_timeout", time.Hour, 50 * time.Millisecond, true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			storageMock := mocks.NewMockStorage(ctrl)
+			client := &slowClient{delay: tc.delay, info: OrderInfo{Order: "5843", Status: StatusProcessed, Accrual: money.FromFloat(500)}, started: make(chan struct{})}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			storageMock.EXPECT().GetOrdersInProgress(gomock.Any()).Return(nil, nil)
+			first := storageMock.EXPECT().ClaimAccrualJobs(gomock.Any(), gomock.Any(), gomock.Any()).Return([]storage.AccrualJob{{OrderNumber: "5843", Attempts: 1}}, nil)
+			storageMock.EXPECT().ClaimAccrualJobs(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil).After(first).AnyTimes()
+			if tc.wantReleased {
+				storageMock.EXPECT().RescheduleAccrualJob(gomock.Any(), "5843", time.Duration(0), "").Return(nil)
+			} else {
+				storageMock.EXPECT().UpdateOrder(gomock.Any(), storage.OrderFromBlackBox{Order: "5843", Status: "PROCESSED", Accrual: money.FromFloat(500)}).Return(nil)
+				storageMock.EXPECT().CompleteAccrualJob(gomock.Any(), "5843").Return(nil)
+			}
+
+			config := DefaultPollerConfig
+			config.Workers = 1
+			config.PollInterval = 10 * time.Millisecond
+			config.DrainTimeout = tc.drainTimeout
+			done := make(chan struct{})
+			go func() {
+				NewPoller(storageMock, NewRateLimitedClient(client, NewRateLimiter(0, 1), slog.Default()), config, slog.Default()).Run(ctx)
+				close(done)
+			}()
+			<-client.started
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				assert.Fail(t, "Poller did not stop")
+			}
+		})
+	}
+}
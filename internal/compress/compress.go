@@ -0,0 +1,175 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/problem"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxBodySize limits decompressed request bodies, it keeps small gzip
+// bombs from taking the whole memory of the service.
+const DefaultMaxBodySize = 1 << 20
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+var writers = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// Middleware decompresses gzip request bodies up to maxBodySize bytes and
+// compresses JSON responses for clients accepting gzip.
+func Middleware(maxBodySize int64, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !decompressRequest(w, r, maxBodySize, logger) {
+				return
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gzipWriter := &responseWriter{ResponseWriter: w, logger: logger, ctx: r.Context()}
+			defer gzipWriter.close()
+			next.ServeHTTP(gzipWriter, r)
+		})
+	}
+}
+
+// decompressRequest replaces a gzip request body with the decompressed one,
+// it writes an error response and returns false when the body can not be used.
+func decompressRequest(w http.ResponseWriter, r *http.Request, maxBodySize int64, logger *slog.Logger) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return true
+	case "gzip", "x-gzip":
+	default:
+		logger.InfoContext(r.Context(), "Got unsupported request encoding", "encoding", encoding)
+		problem.Write(w, r, http.StatusUnsupportedMediaType, problem.CodeUnsupportedEncoding, "Unsupported content encoding")
+		return false
+	}
+	defer r.Body.Close()
+	body, err := readGzip(r.Body, maxBodySize)
+	if errors.Is(err, errBodyTooLarge) {
+		logger.InfoContext(r.Context(), "Got too large decompressed body", "max_body_size", maxBodySize)
+		problem.Write(w, r, http.StatusRequestEntityTooLarge, problem.CodeBodyTooLarge, "Request body is too large")
+		return false
+	}
+	if err != nil {
+		logger.InfoContext(r.Context(), "Could not decompress body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidEncoding, "Could not decompress request body")
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Del("Content-Encoding")
+	return true
+}
+
+func readGzip(body io.Reader, maxBodySize int64) ([]byte, error) {
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBodySize {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
+// acceptsGzip parses Accept-Encoding, gzip explicitly refused with q=0 is not used.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+		if quality > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// responseWriter decides on the first write whether to compress: only JSON
+// responses with a body are compressed, the rest is passed through as is.
+type responseWriter struct {
+	http.ResponseWriter
+	gzipWriter  *gzip.Writer
+	wroteHeader bool
+	logger      *slog.Logger
+	ctx         context.Context
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	if statusCode != http.StatusNoContent && statusCode != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" && isJSON(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gzipWriter = writers.Get().(*gzip.Writer)
+		w.gzipWriter.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gzipWriter == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.gzipWriter.Write(data)
+}
+
+func (w *responseWriter) close() {
+	if w.gzipWriter == nil {
+		return
+	}
+	if err := w.gzipWriter.Close(); err != nil {
+		w.logger.ErrorContext(w.ctx, "Could not finish gzip response", "error", err)
+	}
+	writers.Put(w.gzipWriter)
+	w.gzipWriter = nil
+}
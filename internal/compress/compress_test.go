@@ -0,0 +1,152 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write([]byte(data))
+	require.Nil(t, err)
+	require.Nil(t, writer.Close())
+	return buffer.Bytes()
+}
+
+// echoHandler answers with the request body as JSON or as plain text.
+func echoHandler(contentType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Got err while reading body", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+}
+
+func TestDecompressRequest(t *testing.T) {
+	tests := []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+		wantCode        int
+		wantBody        string
+	}{
+		{"plain", "", []byte(`{"login":"user"}`), http.StatusOK, `{"login":"user"}`},
+		{"identity", "identity", []byte(`{"login":"user"}`), http.StatusOK, `{"login":"user"}`},
+		{"gzip", "gzip", gzipped(t, `{"login":"user"}`), http.StatusOK, `{"login":"user"}`},
+		{"gzip_case_insensitive", " GZIP ", gzipped(t, `{"login":"user"}`), http.StatusOK, `{"login":"user"}`},
+		{"max_size", "gzip", gzipped(t, strings.Repeat("a", 64)), http.StatusOK, strings.Repeat("a", 64)},
+		{"too_large", "gzip", gzipped(t, strings.Repeat("a", 65)), http.StatusRequestEntityTooLarge, ""},
+		{"broken_gzip", "gzip", []byte("not gzip at all"), http.StatusBadRequest, ""},
+		{"truncated_gzip", "gzip", gzipped(t, `{"login":"user"}`)[:20], http.StatusBadRequest, ""},
+		{"unsupported", "br", []byte("data"), http.StatusUnsupportedMediaType, ""},
+	}
+	handler := Middleware(64, slog.Default())(echoHandler("text/plain"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(tt.body))
+			if tt.contentEncoding != "" {
+				request.Header.Set("Content-Encoding", tt.contentEncoding)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.wantCode, result.StatusCode)
+			if tt.wantBody != "" {
+				body, err := io.ReadAll(result.Body)
+				require.Nil(t, err)
+				assert.Equal(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		wantGzip       bool
+	}{
+		{"json", "gzip", "application/json", true},
+		{"problem_json", "gzip, deflate", "application/problem+json", true},
+		{"json_with_charset", "deflate, gzip;q=0.5", "application/json; charset=utf-8", true},
+		{"any_encoding", "*", "application/json", true},
+		{"not_accepted", "deflate", "application/json", false},
+		{"refused", "gzip;q=0", "application/json", false},
+		{"refused_with_spaces", "gzip; q=0.000", "application/json", false},
+		{"no_accept_encoding", "", "application/json", false},
+		{"plain_text", "gzip", "text/plain; charset=utf-8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/user/orders", strings.NewReader(`[{"number":"12345678903"}]`))
+			if tt.acceptEncoding != "" {
+				request.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			Middleware(DefaultMaxBodySize, slog.Default())(echoHandler(tt.contentType)).ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, http.StatusOK, result.StatusCode)
+			assert.Equal(t, "Accept-Encoding", result.Header.Get("Vary"))
+			assert.Equal(t, tt.contentType, result.Header.Get("Content-Type"))
+			body := result.Body
+			if tt.wantGzip {
+				require.Equal(t, "gzip", result.Header.Get("Content-Encoding"))
+				reader, err := gzip.NewReader(result.Body)
+				require.Nil(t, err)
+				body = reader
+			} else {
+				assert.Empty(t, result.Header.Get("Content-Encoding"))
+			}
+			data, err := io.ReadAll(body)
+			require.Nil(t, err)
+			assert.Equal(t, `[{"number":"12345678903"}]`, string(data))
+		})
+	}
+}
+
+func TestCompressEmptyResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"no_content", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNoContent)
+		}},
+		{"implicit_ok", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, 0))
+		}},
+		{"already_encoded", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "br")
+			w.WriteHeader(http.StatusOK)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			request.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			Middleware(DefaultMaxBodySize, slog.Default())(tt.handler).ServeHTTP(w, request)
+			assert.NotEqual(t, "gzip", w.Result().Header.Get("Content-Encoding"))
+			assert.Empty(t, w.Body.Bytes())
+		})
+	}
+}
@@ -1,25 +1,58 @@
 package db
 
 import (
+	"embed"
+	"errors"
 	"fmt"
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"io/fs"
 )
 
+//go:embed migrations/*.sql
+var migrations embed.FS
+
 func RunMigrations(dbURI string) error {
 	if dbURI == "" {
 		return fmt.Errorf("got empty dbURI")
 	}
-	m, err := migrate.New("file://internal/db/migrations", dbURI)
+	source, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		return fmt.Errorf("could not read migrations: %w", err)
+	}
+	m, err := migrate.NewWithSourceInstance("iofs", source, dbURI)
 	if err != nil {
-		fmt.Printf("Got err %s", err.Error())
-		return err
+		return fmt.Errorf("could not connect to database: %w", err)
 	}
+	defer m.Close()
 	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		fmt.Printf("Got err %s", err.Error())
-		return err
+		return fmt.Errorf("could not apply migrations: %w", err)
 	}
 	return nil
 }
+
+// ExpectedVersion returns the version of the latest embedded migration, the
+// database schema has it after RunMigrations.
+func ExpectedVersion() (uint, error) {
+	source, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		return 0, fmt.Errorf("could not read migrations: %w", err)
+	}
+	defer source.Close()
+	version, err := source.First()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := source.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
@@ -0,0 +1,23 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExpectedVersion(t *testing.T) {
+	files, err := fs.Glob(migrations, "migrations/*.up.sql")
+	require.Nil(t, err)
+	require.NotEmpty(t, files)
+	latest := strings.TrimPrefix(files[len(files)-1], "migrations/")
+	want, err := strconv.ParseUint(latest[:strings.Index(latest, "_")], 10, 64)
+	require.Nil(t, err)
+
+	version, err := ExpectedVersion()
+	require.Nil(t, err)
+	assert.Equal(t, uint(want), version)
+}
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS accrual_job;
\ No newline at end of file
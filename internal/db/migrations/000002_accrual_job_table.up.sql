@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS accrual_job (
+    order_external_id varchar(100) PRIMARY KEY,
+    attempts integer default 0 NOT NULL,
+    next_attempt_at timestamp default now() NOT NULL,
+    locked_until timestamp,
+    last_error text,
+    created_at timestamp default now() NOT NULL
+);
+CREATE INDEX IF NOT EXISTS accrual_job_next_attempt_at_idx ON accrual_job (next_attempt_at);
+INSERT INTO accrual_job (order_external_id)
+SELECT DISTINCT external_id FROM "order" WHERE status NOT IN ('INVALID', 'PROCESSED')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_balance;
+DROP TABLE IF EXISTS ledger_entry;
\ No newline at end of file
@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS ledger_entry (
+    id uuid default gen_random_uuid() PRIMARY KEY,
+    user_id uuid NOT NULL,
+    kind varchar(20) NOT NULL,
+    amount real NOT NULL,
+    order_external_id varchar(100),
+    created_at timestamp default now() NOT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id),
+    CONSTRAINT ledger_entry_kind CHECK (kind IN ('accrual', 'withdrawal', 'adjustment'))
+);
+CREATE INDEX IF NOT EXISTS ledger_entry_user_id_idx ON ledger_entry (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_entry_accrual_order_idx ON ledger_entry (order_external_id) WHERE kind = 'accrual';
+CREATE TABLE IF NOT EXISTS user_balance (
+    user_id uuid PRIMARY KEY,
+    current real default 0 NOT NULL,
+    withdrawn real default 0 NOT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id)
+);
+INSERT INTO ledger_entry (user_id, kind, amount, order_external_id, created_at)
+SELECT DISTINCT ON (external_id) user_id, 'accrual', amount, external_id, registered_at
+FROM "order" WHERE status = 'PROCESSED' AND amount > 0
+ORDER BY external_id, registered_at;
+INSERT INTO ledger_entry (user_id, kind, amount, order_external_id, created_at)
+SELECT user_id, 'withdrawal', -amount, external_id, registered_at FROM withdrawal;
+INSERT INTO user_balance (user_id, current, withdrawn)
+SELECT u.id,
+    COALESCE((SELECT sum(l.amount) FROM ledger_entry l WHERE l.user_id = u.id), 0),
+    COALESCE((SELECT -sum(l.amount) FROM ledger_entry l WHERE l.user_id = u.id AND l.kind = 'withdrawal'), 0)
+FROM "user" u
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,4 @@
+ALTER TABLE user_balance ALTER COLUMN current TYPE real, ALTER COLUMN withdrawn TYPE real;
+ALTER TABLE ledger_entry ALTER COLUMN amount TYPE real;
+ALTER TABLE withdrawal ALTER COLUMN amount TYPE real;
+ALTER TABLE "order" ALTER COLUMN amount TYPE real;
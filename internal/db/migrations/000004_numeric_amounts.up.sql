@@ -0,0 +1,4 @@
+ALTER TABLE "order" ALTER COLUMN amount TYPE numeric(14,2);
+ALTER TABLE withdrawal ALTER COLUMN amount TYPE numeric(14,2);
+ALTER TABLE ledger_entry ALTER COLUMN amount TYPE numeric(14,2);
+ALTER TABLE user_balance ALTER COLUMN current TYPE numeric(14,2), ALTER COLUMN withdrawn TYPE numeric(14,2);
@@ -0,0 +1 @@
+ALTER TABLE "user" ALTER COLUMN password_hash TYPE text;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS session (
+    id uuid default gen_random_uuid() PRIMARY KEY,
+    user_id uuid NOT NULL,
+    created_at timestamp default now() NOT NULL,
+    expires_at timestamp NOT NULL,
+    last_seen timestamp default now() NOT NULL,
+    revoked_at timestamp,
+    user_agent text NOT NULL default '',
+    ip varchar(64) NOT NULL default '',
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id)
+);
+CREATE INDEX IF NOT EXISTS session_user_id_idx ON session (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS login_lockout;
+DROP TABLE IF EXISTS login_attempt;
\ No newline at end of file
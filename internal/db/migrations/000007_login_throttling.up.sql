@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS login_attempt (
+    id bigserial PRIMARY KEY,
+    login text NOT NULL,
+    ip varchar(64) NOT NULL,
+    succeeded boolean NOT NULL,
+    attempted_at timestamp default now() NOT NULL
+);
+CREATE INDEX IF NOT EXISTS login_attempt_login_idx ON login_attempt (login, attempted_at);
+CREATE INDEX IF NOT EXISTS login_attempt_ip_idx ON login_attempt (ip, attempted_at);
+CREATE TABLE IF NOT EXISTS login_lockout (
+    id bigserial PRIMARY KEY,
+    kind varchar(16) NOT NULL,
+    key text NOT NULL,
+    failures integer NOT NULL,
+    created_at timestamp default now() NOT NULL,
+    locked_until timestamp NOT NULL
+);
+CREATE INDEX IF NOT EXISTS login_lockout_key_idx ON login_lockout (kind, key, locked_until);
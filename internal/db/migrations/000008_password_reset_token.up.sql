@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS password_reset_token (
+    token_hash varchar(64) PRIMARY KEY,
+    user_id uuid NOT NULL,
+    created_at timestamp default now() NOT NULL,
+    expires_at timestamp NOT NULL,
+    used_at timestamp,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id)
+);
+CREATE INDEX IF NOT EXISTS password_reset_token_user_id_idx ON password_reset_token (user_id);
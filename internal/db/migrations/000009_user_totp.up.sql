@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id uuid PRIMARY KEY,
+    secret text NOT NULL,
+    created_at timestamp default now() NOT NULL,
+    confirmed_at timestamp,
+    last_used_step bigint default 0 NOT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id)
+);
+CREATE TABLE IF NOT EXISTS totp_recovery_code (
+    id bigserial PRIMARY KEY,
+    user_id uuid NOT NULL,
+    code_hash varchar(64) NOT NULL,
+    used_at timestamp,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id)
+);
+CREATE INDEX IF NOT EXISTS totp_recovery_code_user_id_idx ON totp_recovery_code (user_id, code_hash);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS audit_log;
+ALTER TABLE ledger_entry DROP COLUMN IF EXISTS reason;
+ALTER TABLE "user" DROP CONSTRAINT IF EXISTS user_role;
+ALTER TABLE "user" DROP COLUMN IF EXISTS role;
@@ -0,0 +1,13 @@
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS role varchar(16) default 'user' NOT NULL;
+ALTER TABLE "user" ADD CONSTRAINT user_role CHECK (role IN ('user', 'admin'));
+ALTER TABLE ledger_entry ADD COLUMN IF NOT EXISTS reason text;
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    actor_id uuid NOT NULL,
+    action varchar(64) NOT NULL,
+    target_user_id uuid,
+    details text NOT NULL,
+    created_at timestamp default now() NOT NULL,
+    CONSTRAINT fk_actor FOREIGN KEY(actor_id) REFERENCES "user"(id)
+);
+CREATE INDEX IF NOT EXISTS audit_log_target_user_id_idx ON audit_log (target_user_id, created_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS idempotency_key;
+DROP INDEX IF EXISTS withdrawal_external_id_idx;
+ALTER TABLE withdrawal DROP COLUMN IF EXISTS duplicate_of;
@@ -0,0 +1,18 @@
+ALTER TABLE withdrawal ADD COLUMN IF NOT EXISTS duplicate_of uuid;
+-- Withdrawals paid for an already used order number before it became unique are kept, but marked.
+UPDATE withdrawal w SET duplicate_of = first.id
+FROM (SELECT DISTINCT ON (external_id) id, external_id FROM withdrawal ORDER BY external_id, registered_at, id) first
+WHERE w.external_id = first.external_id AND w.id <> first.id;
+CREATE UNIQUE INDEX IF NOT EXISTS withdrawal_external_id_idx ON withdrawal (external_id) WHERE duplicate_of IS NULL;
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    user_id uuid NOT NULL,
+    key varchar(255) NOT NULL,
+    request_hash varchar(64) NOT NULL,
+    status_code integer,
+    content_type text,
+    response_body bytea,
+    created_at timestamp default now() NOT NULL,
+    expires_at timestamp NOT NULL,
+    PRIMARY KEY (user_id, key),
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id)
+);
@@ -0,0 +1,3 @@
+-- A reservation without a saved response is taken over by a retry once its lease ends,
+-- so a crash or a failed save does not block the key until it expires.
+ALTER TABLE idempotency_key ADD COLUMN IF NOT EXISTS locked_until timestamptz;
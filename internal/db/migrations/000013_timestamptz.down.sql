@@ -0,0 +1,34 @@
+ALTER TABLE idempotency_key
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN expires_at TYPE timestamp USING expires_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE audit_log
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE totp_recovery_code
+    ALTER COLUMN used_at TYPE timestamp USING used_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE user_totp
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN confirmed_at TYPE timestamp USING confirmed_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE password_reset_token
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN expires_at TYPE timestamp USING expires_at AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN used_at TYPE timestamp USING used_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE login_lockout
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN locked_until TYPE timestamp USING locked_until AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE login_attempt
+    ALTER COLUMN attempted_at TYPE timestamp USING attempted_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE session
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN expires_at TYPE timestamp USING expires_at AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN last_seen TYPE timestamp USING last_seen AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN revoked_at TYPE timestamp USING revoked_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE ledger_entry
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE accrual_job
+    ALTER COLUMN next_attempt_at TYPE timestamp USING next_attempt_at AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN locked_until TYPE timestamp USING locked_until AT TIME ZONE current_setting('TimeZone'),
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE withdrawal
+    ALTER COLUMN registered_at TYPE timestamp USING registered_at AT TIME ZONE current_setting('TimeZone');
+ALTER TABLE "order"
+    ALTER COLUMN registered_at TYPE timestamp USING registered_at AT TIME ZONE current_setting('TimeZone');
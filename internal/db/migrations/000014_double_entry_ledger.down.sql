@@ -0,0 +1,11 @@
+DROP TRIGGER IF EXISTS ledger_entry_balanced ON ledger_entry;
+DROP FUNCTION IF EXISTS ledger_transaction_balanced();
+DELETE FROM ledger_entry WHERE account <> 'user';
+ALTER TABLE ledger_entry DROP CONSTRAINT IF EXISTS ledger_entry_user_account;
+ALTER TABLE ledger_entry DROP CONSTRAINT IF EXISTS ledger_entry_account;
+DROP INDEX IF EXISTS ledger_entry_transaction_id_idx;
+DROP INDEX IF EXISTS ledger_entry_accrual_order_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_entry_accrual_order_idx ON ledger_entry (order_external_id) WHERE kind = 'accrual';
+ALTER TABLE ledger_entry ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE ledger_entry DROP COLUMN IF EXISTS account;
+ALTER TABLE ledger_entry DROP COLUMN IF EXISTS transaction_id;
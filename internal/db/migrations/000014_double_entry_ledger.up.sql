@@ -0,0 +1,37 @@
+-- Every posting is a ledger transaction of balanced entries: the entry of the
+-- user account and the opposite entry of a system account, accrual_source for
+-- accruals, withdrawal_sink for withdrawals and admin_adjustment for adjustments.
+-- A deferred trigger rejects a commit that leaves a transaction not summing to zero.
+ALTER TABLE ledger_entry ADD COLUMN IF NOT EXISTS transaction_id uuid;
+ALTER TABLE ledger_entry ADD COLUMN IF NOT EXISTS account varchar(32) default 'user' NOT NULL;
+UPDATE ledger_entry SET transaction_id = gen_random_uuid() WHERE transaction_id IS NULL;
+ALTER TABLE ledger_entry ALTER COLUMN transaction_id SET NOT NULL;
+ALTER TABLE ledger_entry ALTER COLUMN account DROP DEFAULT;
+ALTER TABLE ledger_entry ALTER COLUMN user_id DROP NOT NULL;
+DROP INDEX IF EXISTS ledger_entry_accrual_order_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_entry_accrual_order_idx ON ledger_entry (order_external_id) WHERE kind = 'accrual' AND account = 'user';
+CREATE INDEX IF NOT EXISTS ledger_entry_transaction_id_idx ON ledger_entry (transaction_id);
+INSERT INTO ledger_entry (transaction_id, account, user_id, kind, amount, order_external_id, reason, created_at)
+SELECT transaction_id,
+    CASE kind WHEN 'accrual' THEN 'accrual_source' WHEN 'withdrawal' THEN 'withdrawal_sink' ELSE 'admin_adjustment' END,
+    NULL, kind, -amount, order_external_id, reason, created_at
+FROM ledger_entry WHERE account = 'user';
+ALTER TABLE ledger_entry ADD CONSTRAINT ledger_entry_account CHECK (account IN ('user', 'accrual_source', 'withdrawal_sink', 'admin_adjustment'));
+ALTER TABLE ledger_entry ADD CONSTRAINT ledger_entry_user_account CHECK ((account = 'user') = (user_id IS NOT NULL));
+CREATE OR REPLACE FUNCTION ledger_transaction_balanced() RETURNS trigger AS $$
+DECLARE
+    checked uuid;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        checked := OLD.transaction_id;
+    ELSE
+        checked := NEW.transaction_id;
+    END IF;
+    IF (SELECT sum(amount) FROM ledger_entry WHERE transaction_id = checked) <> 0 THEN
+        RAISE EXCEPTION 'ledger transaction % does not sum to zero', checked USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+CREATE CONSTRAINT TRIGGER ledger_entry_balanced AFTER INSERT OR UPDATE OR DELETE ON ledger_entry
+DEFERRABLE INITIALLY DEFERRED FOR EACH ROW EXECUTE FUNCTION ledger_transaction_balanced();
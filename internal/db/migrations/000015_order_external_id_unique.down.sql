@@ -0,0 +1 @@
+DROP INDEX IF EXISTS order_external_id_idx;
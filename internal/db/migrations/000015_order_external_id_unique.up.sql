@@ -0,0 +1,10 @@
+-- Concurrent uploads could add an order number twice before it became unique.
+-- The order credited with the accrual is kept, otherwise the earliest one.
+DELETE FROM "order" o USING (
+    SELECT DISTINCT ON (o.external_id) o.id, o.external_id
+    FROM "order" o
+    LEFT JOIN ledger_entry l ON l.order_external_id = o.external_id AND l.kind = 'accrual' AND l.account = 'user' AND l.user_id = o.user_id
+    ORDER BY o.external_id, l.id IS NULL, o.registered_at, o.id
+) kept
+WHERE o.external_id = kept.external_id AND o.id <> kept.id;
+CREATE UNIQUE INDEX IF NOT EXISTS order_external_id_idx ON "order" (external_id);
@@ -1,17 +1,35 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
-	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base32"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/accrual"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/keyring"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/metrics"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/money"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/notify"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/passwords"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/problem"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/throttle"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/tokens"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/totp"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/varprs"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,26 +37,108 @@ type userCtxName string
 
 var UserCookie = "UserCookie"
 var UserID = userCtxName("UserID")
-var CookieKey = []byte("SecretKeyToUserID")
+var SessionID = userCtxName("SessionID")
+
+const sessionIDLength = 36
+const bearerPrefix = "Bearer "
+const mfaTokenTTL = 5 * time.Minute
+const recoveryCodesCount = 10
+const totpIssuer = "GopherMart"
+const defaultAuditLimit = 100
+const maxAuditLimit = 1000
+const maxAdjustmentReasonLength = 500
+const idempotencyKeyHeader = "Idempotency-Key"
+const maxIdempotencyKeyLength = 255
+const idempotencyKeyTTL = 24 * time.Hour
+const maxPageLimit = 1000
+
+// idempotencyKeyLease is how long a request keeps its idempotency key reserved
+// without a saved response, then a retry may take the key over.
+var idempotencyKeyLease = 1 * time.Minute
+
+var dummyPasswordHash, _ = passwords.Hash("dummy password")
 
 type HandlerWithStorage struct {
-	storage         storage.Storage
-	client          http.Client
-	ordersToProcess chan string
+	storage   storage.Storage
+	poller    *accrual.Poller
+	keys      *keyring.Keyring
+	tokens    *tokens.Manager
+	throttler *throttle.Throttler
+	// resetThrottler limits password reset requests separately from logins, so
+	// requesting resets can not lock a user out of logging in.
+	resetThrottler *throttle.Throttler
+	notifier       notify.Notifier
+	logger         *slog.Logger
+}
+
+func GetHandlerWithStorage(storage storage.Storage, poller *accrual.Poller, keys *keyring.Keyring, logger *slog.Logger) *HandlerWithStorage {
+	throttleConfig := throttle.DefaultConfig
+	throttleConfig.Window = varprs.LoginWindow
+	throttleConfig.MaxLoginFailures = varprs.LoginMaxFailures
+	throttleConfig.MaxIPFailures = varprs.LoginMaxIPFailures
+	throttleConfig.Lockout = varprs.LoginLockout
+	return &HandlerWithStorage{
+		storage:        storage,
+		poller:         poller,
+		keys:           keys,
+		tokens:         tokens.NewManager(keys, varprs.AccessTokenTTL),
+		throttler:      throttle.NewThrottler(storage, throttleConfig, logger),
+		resetThrottler: throttle.NewThrottler(storage, throttle.PasswordResetConfig, logger),
+		notifier:       notify.NewNotifier(varprs.NotifyOutbox, logger),
+		logger:         logger,
+	}
+}
+
+var storageErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{storage.ErrLoginTaken, http.StatusConflict, problem.CodeLoginTaken},
+	{storage.ErrUserNotFound, http.StatusUnauthorized, problem.CodeUserNotFound},
+	{storage.ErrOrderOwnedByOther, http.StatusConflict, problem.CodeOrderOwnedByOther},
+	{storage.ErrInsufficientFunds, http.StatusPaymentRequired, problem.CodeInsufficientFunds},
+	{storage.ErrOrderNotFound, http.StatusNotFound, problem.CodeOrderNotFound},
+	{storage.ErrOrderFinal, http.StatusConflict, problem.CodeOrderFinal},
+	{storage.ErrSessionNotFound, http.StatusUnauthorized, problem.CodeSessionNotFound},
+	{storage.ErrTOTPNotFound, http.StatusNotFound, problem.CodeTwoFactorNotEnrolled},
+	{storage.ErrTOTPAlreadyEnabled, http.StatusConflict, problem.CodeTwoFactorAlreadyEnabled},
+	{storage.ErrWithdrawalOrderUsed, http.StatusConflict, problem.CodeOrderAlreadyPaid},
 }
 
-func GetHandlerWithStorage(storage storage.Storage) *HandlerWithStorage {
-	return &HandlerWithStorage{storage: storage, client: http.Client{}, ordersToProcess: make(chan string, 10)}
+// StorageErrorCode maps storage errors to response codes from SPECIFICATION.md.
+func StorageErrorCode(err error) int {
+	status, _ := storageProblem(err)
+	return status
+}
+
+func storageProblem(err error) (int, string) {
+	for _, storageError := range storageErrors {
+		if errors.Is(err, storageError.err) {
+			return storageError.status, storageError.code
+		}
+	}
+	return http.StatusInternalServerError, problem.CodeInternal
+}
+
+// writeStorageError logs a storage error with attrs and answers with its status and problem code,
+// only failures of the storage itself are logged as errors.
+func (strg *HandlerWithStorage) writeStorageError(w http.ResponseWriter, r *http.Request, err error, detail string, attrs ...interface{}) {
+	status, code := storageProblem(err)
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	strg.logger.Log(r.Context(), level, detail, append(attrs, "error", err)...)
+	problem.Write(w, r, status, code, detail)
 }
 
 func ValidateOrder(order string) (uint, int) {
 	orderNum, err := strconv.Atoi(order)
 	if err != nil {
-		log.Printf("Got err while casting order to int %s", err.Error())
 		return 0, http.StatusBadRequest
 	}
 	if orderNum < 0 {
-		log.Println("Got orderNum < 0")
 		return 0, http.StatusBadRequest
 	}
 	sum := 0
@@ -74,155 +174,339 @@ func ValidateOrder(order string) (uint, int) {
 	}
 }
 
-func CheckAuth(next http.Handler) http.Handler {
+// PublicPaths are served without an authenticated session.
+var PublicPaths = map[string]bool{
+	"/api/user/register":               true,
+	"/api/user/login":                  true,
+	"/api/user/login/2fa":              true,
+	"/api/user/token/refresh":          true,
+	"/api/user/password/reset-request": true,
+	"/api/user/password/reset":         true,
+	"/metrics":                         true,
+	"/healthz":                         true,
+	"/readyz":                          true,
+}
+
+// signSessionID returns the cookie value <key id>.<hex of session id and its sign>.
+func (strg *HandlerWithStorage) signSessionID(sessionID string) string {
+	kid, sign := strg.keys.Sign([]byte(sessionID))
+	return kid + "." + hex.EncodeToString(append([]byte(sessionID)[:], sign[:]...))
+}
+
+func (strg *HandlerWithStorage) sessionIDFromCookie(ctx context.Context, value string) (string, bool) {
+	kid, signed, found := strings.Cut(value, ".")
+	if !found {
+		strg.logger.InfoContext(ctx, "Got cookie without key id")
+		return "", false
+	}
+	data, err := hex.DecodeString(signed)
+	if err != nil {
+		strg.logger.InfoContext(ctx, "Could not decode cookie", "error", err)
+		return "", false
+	}
+	if len(data) <= sessionIDLength {
+		strg.logger.InfoContext(ctx, "Got too short cookie value")
+		return "", false
+	}
+	if !strg.keys.Verify(kid, data[:sessionIDLength], data[sessionIDLength:]) {
+		strg.logger.InfoContext(ctx, "Got cookie with bad sign", "key_id", kid)
+		return "", false
+	}
+	return string(data[:sessionIDLength]), true
+}
+
+// bearerToken returns the token from the Authorization: Bearer header.
+func bearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(authorization[len(bearerPrefix):]), true
+}
+
+func (strg *HandlerWithStorage) CheckAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/api/user/register" || r.URL.Path == "/api/user/login" {
-			log.Printf("Got %s url, skip check", r.URL.Path)
+		if PublicPaths[r.URL.Path] {
+			strg.logger.DebugContext(r.Context(), "Got public path, skip auth check", "path", r.URL.Path)
 			next.ServeHTTP(w, r)
 			return
 		}
-		cookie, err := (*r).Cookie(UserCookie)
-		if cookie != nil && err != nil {
-			log.Println(err.Error())
-			http.Error(w, "Could not auth user", http.StatusUnauthorized)
-			return
-		}
-		if cookie == nil {
-			log.Println("Got null value in Cookie for UserID")
-			http.Error(w, "Could not auth user", http.StatusUnauthorized)
-			return
+		var sessionID, tokenUserID string
+		if token, ok := bearerToken(r); ok {
+			claims, err := strg.tokens.Parse(token, tokens.AccessAudience)
+			if err != nil {
+				strg.logger.InfoContext(r.Context(), "Got bad access token", "error", err)
+				problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Could not auth user")
+				return
+			}
+			sessionID, tokenUserID = claims.SessionID, claims.Subject
+		} else {
+			cookie, err := (*r).Cookie(UserCookie)
+			if cookie != nil && err != nil {
+				strg.logger.InfoContext(r.Context(), "Could not read cookie", "error", err)
+				problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Could not auth user")
+				return
+			}
+			if cookie == nil {
+				strg.logger.InfoContext(r.Context(), "Got request without session cookie")
+				problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Could not auth user")
+				return
+			}
+			sessionID, ok = strg.sessionIDFromCookie(r.Context(), cookie.Value)
+			if !ok {
+				problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Could not auth user")
+				return
+			}
 		}
-		data, err := hex.DecodeString(cookie.Value)
-		log.Printf("Got Cookie: %s", cookie.Value)
+		session, err := strg.storage.TouchSession(r.Context(), sessionID)
 		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, "Could not auth user", http.StatusUnauthorized)
+			strg.writeStorageError(w, r, err, "Could not auth user", "session_id", sessionID)
 			return
 		}
-		h := hmac.New(sha256.New, CookieKey)
-		h.Write(data[:36])
-		sign := h.Sum(nil)
-		if hmac.Equal(sign, data[36:]) {
-			ctx := context.WithValue(r.Context(), UserID, string(data[:36]))
-			next.ServeHTTP(w, r.WithContext(ctx))
+		if tokenUserID != "" && tokenUserID != session.UserID {
+			strg.logger.WarnContext(r.Context(), "Got access token for session of another user", "user_id", tokenUserID, "session_id", sessionID)
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Could not auth user")
 			return
 		}
-		log.Println("Got not equal sign for UserID")
-		http.Error(w, "Could not auth user", http.StatusUnauthorized)
+		ctx := context.WithValue(r.Context(), UserID, session.UserID)
+		ctx = context.WithValue(ctx, SessionID, session.ID)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func (strg *HandlerWithStorage) GetStatusesDaemon() {
-	for orderNumber := range strg.ordersToProcess {
-		log.Printf("Got order %s to process", orderNumber)
-		response, err := strg.client.Get(varprs.AccrualSysAddr + "/api/orders/" + orderNumber)
-		if err != nil {
-			log.Printf("Got error %s", err.Error())
-			continue
-		}
-		if response.StatusCode == http.StatusOK {
-			var newOrder storage.OrderFromBlackBox
-			data, err := io.ReadAll(response.Body)
-			if err != nil {
-				log.Printf("Got error %s", err.Error())
-				continue
-			}
-			err = json.Unmarshal(data, &newOrder)
-			if err != nil {
-				log.Printf("Got error %s", err.Error())
-				continue
-			}
-			log.Printf("Got newOrder %v", newOrder)
-			newOrder.Order = orderNumber
-			strg.storage.UpdateOrder(newOrder)
-			if newOrder.Status != "INVALID" && newOrder.Status != "PROCESSED" {
-				go func(orderNumber string) {
-					strg.ordersToProcess <- orderNumber
-				}(orderNumber)
-			}
-			response.Body.Close()
-		} else {
-			if response.StatusCode == http.StatusTooManyRequests {
-				log.Printf("Got 429 StatusTooManyRequests, need to sleep a bit")
-				time.Sleep(1 * time.Second)
-			}
-			log.Printf("Got bad status code %v for order %s", response.StatusCode, orderNumber)
-			go func(orderNumber string) {
-				strg.ordersToProcess <- orderNumber
-			}(orderNumber)
-		}
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// startSession creates a new session for the user and sets its cookie.
+func (strg *HandlerWithStorage) startSession(w http.ResponseWriter, r *http.Request, userID string) (storage.Session, error) {
+	session, err := strg.storage.CreateSession(
+		r.Context(),
+		storage.Session{UserID: userID, UserAgent: r.UserAgent(), IP: clientIP(r)},
+		varprs.SessionTTL,
+	)
+	if err != nil {
+		return storage.Session{}, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     UserCookie,
+		Value:    strg.signSessionID(session.ID),
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session, nil
+}
+
+// writeSessionResponse answers a successful register or login, clients asking
+// for ?tokens=true also get an access and a refresh token for the session.
+func (strg *HandlerWithStorage) writeSessionResponse(w http.ResponseWriter, r *http.Request, session storage.Session) {
+	if r.URL.Query().Get("tokens") != "true" {
+		w.WriteHeader(http.StatusOK)
+		w.Write(make([]byte, 0))
+		return
+	}
+	strg.writeTokens(w, r, session)
+}
+
+func (strg *HandlerWithStorage) writeTokens(w http.ResponseWriter, r *http.Request, session storage.Session) {
+	tokenPair, err := strg.tokens.Issue(session.UserID, session.ID, session.ExpiresAt)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not issue tokens", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not issue tokens")
+		return
+	}
+	tokensMarshalled, err := json.Marshal(tokenPair)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not encode response", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(tokensMarshalled)
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken exchanges a refresh token of an active session for a new token pair.
+func (strg *HandlerWithStorage) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	jsonBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
+		return
+	}
+	var request refreshRequest
+	if err := json.Unmarshal(jsonBody, &request); err != nil || request.RefreshToken == "" {
+		strg.logger.InfoContext(r.Context(), "Could not get refresh token from body")
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
+		return
+	}
+	claims, err := strg.tokens.Parse(request.RefreshToken, tokens.RefreshAudience)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Got bad refresh token", "error", err)
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Could not auth user")
+		return
+	}
+	session, err := strg.storage.TouchSession(r.Context(), claims.SessionID)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not auth user", "session_id", claims.SessionID)
+		return
+	}
+	if session.UserID != claims.Subject {
+		strg.logger.WarnContext(r.Context(), "Got refresh token for session of another user", "user_id", claims.Subject, "session_id", claims.SessionID)
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Could not auth user")
+		return
 	}
-	close(strg.ordersToProcess)
+	strg.writeTokens(w, r, session)
 }
 
 func (strg *HandlerWithStorage) Register(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	jsonBody, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Got err while reading body: %s", err.Error())
-		http.Error(w, "Got err while reading body", http.StatusBadRequest)
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
 		return
 	}
 	var authData storage.UserAuthData
-	log.Printf("DATA: %v", r.Body)
 	err = json.Unmarshal(jsonBody, &authData)
 	if err != nil {
-		log.Printf("Could not unmarshal body: %s", err.Error())
-		http.Error(w, "Could not unmarshal body", http.StatusBadRequest)
+		strg.logger.InfoContext(r.Context(), "Could not parse request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
 		return
 	}
-	userID, errCode := strg.storage.Register(authData)
-	if errCode != http.StatusOK {
-		log.Println("Could not register user")
-		http.Error(w, "Could not register user", errCode)
+	passwordHash, err := passwords.Hash(authData.Password)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not hash password", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not register user")
 		return
 	}
-	h := hmac.New(sha256.New, CookieKey)
-	h.Write([]byte(userID))
-	sign := h.Sum(nil)
-	newCookie := http.Cookie{Name: UserCookie, Value: hex.EncodeToString(append([]byte(userID)[:], sign[:]...))}
-	log.Printf("Sign %v, wholeCookie %v", sign, []byte(userID))
-	http.SetCookie(w, &newCookie)
-	w.WriteHeader(http.StatusOK)
-	w.Write(make([]byte, 0))
+	userID, err := strg.storage.Register(r.Context(), storage.UserAuthData{Login: authData.Login, Password: passwordHash})
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not register user")
+		return
+	}
+	metrics.Registrations.Inc()
+	session, err := strg.startSession(w, r, userID)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not start session", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not start session")
+		return
+	}
+	strg.writeSessionResponse(w, r, session)
 }
 
 func (strg *HandlerWithStorage) Login(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	jsonData, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Got err while reading body: %s", err.Error())
-		http.Error(w, "Got err while reading body", http.StatusBadRequest)
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
 		return
 	}
 	var authData storage.UserAuthData
 	err = json.Unmarshal(jsonData, &authData)
 	if err != nil {
-		log.Printf("Could not unmarshal body: %s", err.Error())
-		http.Error(w, "Could not unmarshal body", http.StatusBadRequest)
+		strg.logger.InfoContext(r.Context(), "Could not parse request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
 		return
 	}
-	userData, errCode := strg.storage.GetUserByLogin(authData)
-	if errCode != http.StatusOK {
-		log.Println("Could not get user by login")
-		http.Error(w, "Could not get user by login", errCode)
-		return
-	}
-	h := sha256.New()
-	h.Write([]byte(authData.Password))
-	pswdHash := hex.EncodeToString(h.Sum(nil))
-	if pswdHash == userData.Password {
-		h := hmac.New(sha256.New, CookieKey)
-		h.Write([]byte(userData.UserID))
-		sign := h.Sum(nil)
-		newCookie := http.Cookie{Name: UserCookie, Value: hex.EncodeToString(append([]byte(userData.UserID)[:], sign[:]...))}
-		http.SetCookie(w, &newCookie)
-		w.WriteHeader(http.StatusOK)
-		w.Write(make([]byte, 0))
+	ip := clientIP(r)
+	retryAfter, err := strg.throttler.Check(r.Context(), authData.Login, ip)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not check login throttling", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not check login attempts")
+		return
+	}
+	if retryAfter > 0 {
+		strg.logger.InfoContext(r.Context(), "Got throttled login attempt", "ip", ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		problem.Write(w, r, http.StatusTooManyRequests, problem.CodeTooManyAttempts, "Too many login attempts")
+		return
+	}
+	userData, err := strg.storage.GetUserByLogin(r.Context(), authData)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			// Spend the same time as for an existing user, so logins can not be enumerated.
+			passwords.Verify(authData.Password, dummyPasswordHash)
+			strg.loginFailed(r.Context(), authData.Login, ip)
+			strg.logger.InfoContext(r.Context(), "Got login of unknown user")
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeWrongCredentials, "Wrong login or password")
+			return
+		}
+		strg.writeStorageError(w, r, err, "Could not auth user")
+		return
+	}
+	match, needsRehash, err := passwords.Verify(authData.Password, userData.Password)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not verify password", "user_id", userData.UserID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not verify password")
+		return
+	}
+	if needsRehash {
+		strg.rehashPassword(r.Context(), userData.UserID, authData.Password)
+	}
+	if match {
+		userTOTP, err := strg.storage.GetTOTP(r.Context(), userData.UserID)
+		if err != nil && !errors.Is(err, storage.ErrTOTPNotFound) {
+			strg.logger.ErrorContext(r.Context(), "Could not get totp", "user_id", userData.UserID, "error", err)
+			problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not check two-factor authentication")
+			return
+		}
+		if err == nil && userTOTP.Confirmed {
+			// Failures are not reset until the second factor is checked, so codes can not be brute forced.
+			strg.writeMFAChallenge(w, r, userData.UserID)
+			return
+		}
+		strg.loginSucceeded(w, r, authData.Login, userData.UserID)
 	} else {
-		log.Println("Got wrong login-password pair")
-		http.Error(w, "Got wrong login-password pair", http.StatusUnauthorized)
+		strg.logger.InfoContext(r.Context(), "Got wrong password", "user_id", userData.UserID)
+		strg.loginFailed(r.Context(), authData.Login, ip)
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeWrongCredentials, "Wrong login or password")
+	}
+}
+
+func (strg *HandlerWithStorage) loginSucceeded(w http.ResponseWriter, r *http.Request, login string, userID string) {
+	if err := strg.throttler.Succeeded(r.Context(), login, clientIP(r)); err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not record login attempt", "error", err)
+	}
+	session, err := strg.startSession(w, r, userID)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not start session", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not start session")
+		return
+	}
+	strg.writeSessionResponse(w, r, session)
+}
+
+func (strg *HandlerWithStorage) loginFailed(ctx context.Context, login string, ip string) {
+	if err := strg.throttler.Failed(ctx, login, ip); err != nil {
+		strg.logger.ErrorContext(ctx, "Could not record failed login attempt", "error", err)
+	}
+}
+
+func (strg *HandlerWithStorage) rehashPassword(ctx context.Context, userID string, password string) {
+	passwordHash, err := passwords.Hash(password)
+	if err != nil {
+		strg.logger.ErrorContext(ctx, "Could not rehash password", "user_id", userID, "error", err)
+		return
+	}
+	if err := strg.storage.UpdatePasswordHash(ctx, userID, passwordHash); err != nil {
+		strg.logger.ErrorContext(ctx, "Could not update password hash", "user_id", userID, "error", err)
+		return
 	}
+	strg.logger.InfoContext(ctx, "Upgraded password hash", "user_id", userID)
 }
 
 func (strg *HandlerWithStorage) AddOrder(w http.ResponseWriter, r *http.Request) {
@@ -230,50 +514,55 @@ func (strg *HandlerWithStorage) AddOrder(w http.ResponseWriter, r *http.Request)
 	data, err := io.ReadAll(r.Body)
 
 	if err != nil {
-		log.Printf("Got error while reading body: ")
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
+		return
 	}
 
 	_, errCode := ValidateOrder(string(data))
 	if errCode != http.StatusOK {
-		log.Printf("Got bad order number %s", data)
-		http.Error(w, "Got bad order number", errCode)
+		strg.logger.InfoContext(r.Context(), "Got bad order number", "length", len(data))
+		problem.Write(w, r, errCode, problem.CodeInvalidOrderNumber, "Invalid order number")
 		return
 	}
 	userID := r.Context().Value(UserID).(string)
-	errCode = strg.storage.AddOrderForUser(string(data), userID)
-	if errCode != http.StatusOK && errCode != http.StatusAccepted {
-		log.Printf("Could not add order into db, %d", errCode)
-		http.Error(w, "Could not add order into db", errCode)
+	err = strg.storage.AddOrderForUser(r.Context(), string(data), userID)
+	if errors.Is(err, storage.ErrOrderAlreadyUploaded) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(make([]byte, 0))
 		return
 	}
-	if errCode == http.StatusAccepted {
-		go func(orderNumber string) {
-			strg.ordersToProcess <- orderNumber
-		}(string(data))
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not add order", "user_id", userID)
+		return
 	}
-	w.WriteHeader(errCode)
+	strg.poller.Notify()
+	w.WriteHeader(http.StatusAccepted)
 	w.Write(make([]byte, 0))
 }
 
 func (strg *HandlerWithStorage) GetOrders(w http.ResponseWriter, r *http.Request) {
-	log.Println("Got GetOrders request")
 	userID := r.Context().Value(UserID).(string)
-	orders, errCode := strg.storage.GetOrdersByUser(userID)
-	if errCode != http.StatusOK {
-		log.Printf("Got error %v", errCode)
-		http.Error(w, "Got bad status code", errCode)
+	query, err := parseListQuery(r, true)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Got bad list query", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery, "Invalid list query: "+err.Error())
+		return
+	}
+	orders, err := strg.storage.GetOrdersByUser(r.Context(), userID, pageQuery(query))
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get orders", "user_id", userID)
 		return
 	}
+	orders = ordersPage(w, r, query, orders)
 	if len(orders) == 0 {
-		log.Println("Got empty orders")
-		http.Error(w, "Got no orders for this user", http.StatusNoContent)
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	log.Printf("Got orders %v", orders)
 	ordersMarshalled, err := json.Marshal(orders)
 	if err != nil {
-		log.Printf("Got error: %s", err.Error())
-		http.Error(w, "Got error while marshalling", http.StatusInternalServerError)
+		strg.logger.ErrorContext(r.Context(), "Could not encode response", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not encode response")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -281,16 +570,101 @@ func (strg *HandlerWithStorage) GetOrders(w http.ResponseWriter, r *http.Request
 	w.Write(ordersMarshalled)
 }
 
+// orderStatuses are statuses orders can be filtered by.
+var orderStatuses = map[string]bool{"NEW": true, "PROCESSING": true, "INVALID": true, "PROCESSED": true}
+
+// parseListQuery reads limit, after, from and to query parameters and, when
+// withStatus is set, status parameters which can be repeated or separated by commas.
+func parseListQuery(r *http.Request, withStatus bool) (storage.ListQuery, error) {
+	values := r.URL.Query()
+	var query storage.ListQuery
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > maxPageLimit {
+			return storage.ListQuery{}, fmt.Errorf("limit must be from 1 to %d, got %s", maxPageLimit, limit)
+		}
+		query.Limit = parsed
+	}
+	if after := values.Get("after"); after != "" {
+		cursor, err := storage.ParseCursor(after)
+		if err != nil {
+			return storage.ListQuery{}, err
+		}
+		query.After = &cursor
+	}
+	for _, statuses := range values["status"] {
+		if !withStatus {
+			return storage.ListQuery{}, errors.New("status filter is not supported")
+		}
+		for _, status := range strings.Split(statuses, ",") {
+			status = strings.ToUpper(strings.TrimSpace(status))
+			if !orderStatuses[status] {
+				return storage.ListQuery{}, fmt.Errorf("unknown status %s", status)
+			}
+			query.Statuses = append(query.Statuses, status)
+		}
+	}
+	var err error
+	if from := values.Get("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return storage.ListQuery{}, err
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return storage.ListQuery{}, err
+		}
+	}
+	return query, nil
+}
+
+// pageQuery asks storage for one item more than the page to find out whether there is a next page.
+func pageQuery(query storage.ListQuery) storage.ListQuery {
+	if query.Limit > 0 {
+		query.Limit++
+	}
+	return query
+}
+
+// setNextPage points the client at the page after the cursor with the Link and X-Next-Cursor headers.
+func setNextPage(w http.ResponseWriter, r *http.Request, cursor storage.Cursor) {
+	values := r.URL.Query()
+	values.Set("after", cursor.String())
+	w.Header().Set("Link", "<"+r.URL.Path+"?"+values.Encode()+">; rel=\"next\"")
+	w.Header().Set("X-Next-Cursor", cursor.String())
+}
+
+func ordersPage(w http.ResponseWriter, r *http.Request, query storage.ListQuery, orders []storage.Order) []storage.Order {
+	if query.Limit == 0 || len(orders) <= query.Limit {
+		return orders
+	}
+	orders = orders[:query.Limit]
+	last := orders[len(orders)-1]
+	setNextPage(w, r, storage.Cursor{Time: last.UploadedAt, Key: last.Number})
+	return orders
+}
+
+func withdrawalsPage(w http.ResponseWriter, r *http.Request, query storage.ListQuery, withdrawals []storage.Withdrawal) []storage.Withdrawal {
+	if query.Limit == 0 || len(withdrawals) <= query.Limit {
+		return withdrawals
+	}
+	withdrawals = withdrawals[:query.Limit]
+	last := withdrawals[len(withdrawals)-1]
+	setNextPage(w, r, storage.Cursor{Time: last.ProcessedAt, Key: last.Order})
+	return withdrawals
+}
+
 func (strg *HandlerWithStorage) GetBalance(w http.ResponseWriter, r *http.Request) {
-	userBalance, errCode := strg.storage.GetUserBalance(r.Context().Value(UserID).(string))
-	if errCode != http.StatusOK {
-		http.Error(w, "Could not get user balance", errCode)
+	userID := r.Context().Value(UserID).(string)
+	userBalance, err := strg.storage.GetUserBalance(r.Context(), userID)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get user balance", "user_id", userID)
 		return
 	}
 	userBalanceMarshalled, err := json.Marshal(userBalance)
 	if err != nil {
-		log.Printf("Got error while marshalling: %s", err.Error())
-		http.Error(w, "Got error while marshalling", errCode)
+		strg.logger.ErrorContext(r.Context(), "Could not encode response", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not encode response")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -303,52 +677,895 @@ func (strg *HandlerWithStorage) AddWithdrawal(w http.ResponseWriter, r *http.Req
 	defer r.Body.Close()
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Got err %s", err.Error())
-		http.Error(w, "Got error while getting data", http.StatusInternalServerError)
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
 		return
 	}
 	var withdrawal storage.Withdrawal
 	err = json.Unmarshal(data, &withdrawal)
 	if err != nil {
-		log.Printf("Got err %s", err.Error())
-		http.Error(w, "Got error while getting data", http.StatusInternalServerError)
+		strg.logger.InfoContext(r.Context(), "Could not parse request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
+		return
+	}
+	if withdrawal.Sum <= 0 {
+		strg.logger.InfoContext(r.Context(), "Got non-positive withdrawal sum", "sum", withdrawal.Sum)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidSum, "Withdrawal sum must be positive")
 		return
 	}
 	_, errCode := ValidateOrder(withdrawal.Order)
 	if errCode != http.StatusOK {
-		log.Printf("Got bad order number %s", withdrawal.Order)
-		http.Error(w, "Got bad order number", errCode)
+		strg.logger.InfoContext(r.Context(), "Got bad order number", "order", withdrawal.Order)
+		problem.Write(w, r, errCode, problem.CodeInvalidOrderNumber, "Invalid order number")
 		return
 	}
-	errCode = strg.storage.AddWithdrawalForUser(userID, withdrawal)
-	if errCode != http.StatusOK {
-		log.Printf("Got errorCode %v", errCode)
-		http.Error(w, "Got error from AddWithdrawalForUser", errCode)
+	err = strg.storage.AddWithdrawalForUser(r.Context(), userID, withdrawal)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not withdraw points", "user_id", userID)
 		return
 	}
+	metrics.WithdrawnPoints.Add(withdrawal.Sum.Float64())
 	w.WriteHeader(http.StatusOK)
 	w.Write(make([]byte, 0))
 }
 
 func (strg *HandlerWithStorage) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(UserID).(string)
-	withdrawals, errCode := strg.storage.GetWithdrawalsForUser(userID)
-	if errCode != http.StatusOK {
-		log.Printf("Got bad errCode %v", errCode)
-		http.Error(w, "Got bad errCode", errCode)
+	query, err := parseListQuery(r, false)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Got bad list query", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery, "Invalid list query: "+err.Error())
+		return
+	}
+	withdrawals, err := strg.storage.GetWithdrawalsForUser(r.Context(), userID, pageQuery(query))
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get withdrawals", "user_id", userID)
 		return
 	}
+	withdrawals = withdrawalsPage(w, r, query, withdrawals)
 	if len(withdrawals) == 0 {
-		http.Error(w, "Got no withdrawals for this user", http.StatusNoContent)
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 	withdrawalsMarshalled, err := json.Marshal(withdrawals)
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
-		http.Error(w, "Got error", http.StatusInternalServerError)
+		strg.logger.ErrorContext(r.Context(), "Could not encode response", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not encode response")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(withdrawalsMarshalled)
 }
+
+type sessionResponse struct {
+	storage.Session
+	Current bool `json:"current"`
+}
+
+func (strg *HandlerWithStorage) Logout(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserID).(string)
+	sessionID := r.Context().Value(SessionID).(string)
+	if err := strg.storage.RevokeSession(r.Context(), userID, sessionID); err != nil {
+		strg.writeStorageError(w, r, err, "Could not revoke session", "session_id", sessionID)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: UserCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusOK)
+	w.Write(make([]byte, 0))
+}
+
+func (strg *HandlerWithStorage) GetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserID).(string)
+	sessionID := r.Context().Value(SessionID).(string)
+	sessions, err := strg.storage.GetSessionsForUser(r.Context(), userID)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get sessions", "user_id", userID)
+		return
+	}
+	response := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, sessionResponse{Session: session, Current: session.ID == sessionID})
+	}
+	sessionsMarshalled, err := json.Marshal(response)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not encode response", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(sessionsMarshalled)
+}
+
+func (strg *HandlerWithStorage) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserID).(string)
+	sessionID := chi.URLParam(r, "id")
+	err := strg.storage.RevokeSession(r.Context(), userID, sessionID)
+	if errors.Is(err, storage.ErrSessionNotFound) {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeSessionNotFound, "Session not found")
+		return
+	}
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not revoke session", "session_id", sessionID)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(make([]byte, 0))
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword sets a new password after checking the current one and logs out all other sessions of the user.
+func (strg *HandlerWithStorage) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	userID := r.Context().Value(UserID).(string)
+	sessionID := r.Context().Value(SessionID).(string)
+	jsonBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
+		return
+	}
+	var request changePasswordRequest
+	if err := json.Unmarshal(jsonBody, &request); err != nil || request.NewPassword == "" {
+		strg.logger.InfoContext(r.Context(), "Could not get passwords from body")
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
+		return
+	}
+	userData, err := strg.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get user", "user_id", userID)
+		return
+	}
+	ip := clientIP(r)
+	retryAfter, err := strg.throttler.Check(r.Context(), userData.Login, ip)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not check login throttling", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not check login attempts")
+		return
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		problem.Write(w, r, http.StatusTooManyRequests, problem.CodeTooManyAttempts, "Too many login attempts")
+		return
+	}
+	match, _, err := passwords.Verify(request.CurrentPassword, userData.Password)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not verify password", "user_id", userID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not verify password")
+		return
+	}
+	if !match {
+		strg.logger.InfoContext(r.Context(), "Got wrong current password", "user_id", userID)
+		strg.loginFailed(r.Context(), userData.Login, ip)
+		problem.Write(w, r, http.StatusForbidden, problem.CodeWrongPassword, "Wrong current password")
+		return
+	}
+	if err := strg.setPassword(r.Context(), userID, request.NewPassword, sessionID); err != nil {
+		strg.writeStorageError(w, r, err, "Could not change password", "user_id", userID)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(make([]byte, 0))
+}
+
+// setPassword stores the hash of the new password and revokes all sessions of the user except keepSessionID.
+func (strg *HandlerWithStorage) setPassword(ctx context.Context, userID string, password string, keepSessionID string) error {
+	passwordHash, err := passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	if err := strg.storage.UpdatePasswordHash(ctx, userID, passwordHash); err != nil {
+		return err
+	}
+	return strg.storage.RevokeOtherSessions(ctx, userID, keepSessionID)
+}
+
+type passwordResetRequest struct {
+	Login string `json:"login"`
+}
+
+func hashResetToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(tokenHash[:])
+}
+
+// RequestPasswordReset sends a single use reset token to the user, the answer
+// is the same for unknown logins, so logins can not be enumerated.
+func (strg *HandlerWithStorage) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	jsonBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
+		return
+	}
+	var request passwordResetRequest
+	if err := json.Unmarshal(jsonBody, &request); err != nil || request.Login == "" {
+		strg.logger.InfoContext(r.Context(), "Could not get login from body")
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
+		return
+	}
+	// Throttled requests are answered like the others, so they do not reveal whether the login exists.
+	ip := clientIP(r)
+	retryAfter, err := strg.resetThrottler.Check(r.Context(), request.Login, ip)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not check password reset throttling", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not request password reset")
+		return
+	}
+	if retryAfter > 0 {
+		strg.logger.InfoContext(r.Context(), "Got throttled password reset request", "ip", ip)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(make([]byte, 0))
+		return
+	}
+	if err := strg.resetThrottler.Failed(r.Context(), request.Login, ip); err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not record password reset request", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not request password reset")
+		return
+	}
+	userData, err := strg.storage.GetUserByLogin(r.Context(), storage.UserAuthData{Login: request.Login})
+	if errors.Is(err, storage.ErrUserNotFound) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(make([]byte, 0))
+		return
+	}
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not request password reset")
+		return
+	}
+	tokenData := make([]byte, 32)
+	if _, err := rand.Read(tokenData); err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not generate reset token", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not request password reset")
+		return
+	}
+	token := hex.EncodeToString(tokenData)
+	if err := strg.storage.CreatePasswordResetToken(r.Context(), userData.UserID, hashResetToken(token), varprs.PasswordResetTTL); err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not save reset token", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not request password reset")
+		return
+	}
+	message := notify.Message{
+		UserID:  userData.UserID,
+		Login:   userData.Login,
+		Subject: "Password reset",
+		Text:    fmt.Sprintf("Use token %s to reset your password, it expires in %s", token, varprs.PasswordResetTTL),
+	}
+	if err := strg.notifier.Send(r.Context(), message); err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not send reset token", "user_id", userData.UserID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not request password reset")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(make([]byte, 0))
+}
+
+type passwordResetData struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ResetPassword sets a new password by a reset token and logs out all sessions of the user.
+func (strg *HandlerWithStorage) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	jsonBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
+		return
+	}
+	var request passwordResetData
+	if err := json.Unmarshal(jsonBody, &request); err != nil || request.Token == "" || request.NewPassword == "" {
+		strg.logger.InfoContext(r.Context(), "Could not get reset token and password from body")
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
+		return
+	}
+	userID, err := strg.storage.UsePasswordResetToken(r.Context(), hashResetToken(request.Token))
+	if errors.Is(err, storage.ErrResetTokenNotFound) {
+		strg.logger.InfoContext(r.Context(), "Got unknown, used or expired reset token")
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidResetToken, "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not reset password")
+		return
+	}
+	if err := strg.setPassword(r.Context(), userID, request.NewPassword, ""); err != nil {
+		strg.writeStorageError(w, r, err, "Could not reset password", "user_id", userID)
+		return
+	}
+	strg.logger.InfoContext(r.Context(), "Reset password", "user_id", userID)
+	w.WriteHeader(http.StatusOK)
+	w.Write(make([]byte, 0))
+}
+
+type mfaChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// writeMFAChallenge answers a login with the right password of a user with two-factor
+// authentication, the pre-auth token is exchanged for a session at /api/user/login/2fa.
+func (strg *HandlerWithStorage) writeMFAChallenge(w http.ResponseWriter, r *http.Request, userID string) {
+	mfaToken, err := strg.tokens.IssueMFA(userID, mfaTokenTTL)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not issue pre-auth token", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not issue pre-auth token")
+		return
+	}
+	challengeMarshalled, err := json.Marshal(mfaChallenge{MFARequired: true, MFAToken: mfaToken, ExpiresIn: int64(mfaTokenTTL.Seconds())})
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not encode response", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(challengeMarshalled)
+}
+
+type mfaLoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// LoginTOTP finishes a two-step login with a TOTP code or a recovery code.
+func (strg *HandlerWithStorage) LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	jsonBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
+		return
+	}
+	var request mfaLoginRequest
+	if err := json.Unmarshal(jsonBody, &request); err != nil || request.MFAToken == "" || request.Code == "" {
+		strg.logger.InfoContext(r.Context(), "Could not get pre-auth token and code from body")
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
+		return
+	}
+	claims, err := strg.tokens.Parse(request.MFAToken, tokens.MFAAudience)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Got bad pre-auth token", "error", err)
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Could not auth user")
+		return
+	}
+	userData, err := strg.storage.GetUserByID(r.Context(), claims.Subject)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not auth user", "user_id", claims.Subject)
+		return
+	}
+	ip := clientIP(r)
+	retryAfter, err := strg.throttler.Check(r.Context(), userData.Login, ip)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not check login throttling", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not check login attempts")
+		return
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		problem.Write(w, r, http.StatusTooManyRequests, problem.CodeTooManyAttempts, "Too many login attempts")
+		return
+	}
+	valid, err := strg.checkSecondFactor(r.Context(), userData.UserID, request.Code)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not check two-factor code", "user_id", userData.UserID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not check two-factor code")
+		return
+	}
+	if !valid {
+		strg.logger.InfoContext(r.Context(), "Got wrong two-factor code", "user_id", userData.UserID)
+		strg.loginFailed(r.Context(), userData.Login, ip)
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeWrongTwoFactorCode, "Wrong two-factor code")
+		return
+	}
+	strg.loginSucceeded(w, r, userData.Login, userData.UserID)
+}
+
+// checkSecondFactor accepts a TOTP code not used before or an unused recovery code.
+func (strg *HandlerWithStorage) checkSecondFactor(ctx context.Context, userID string, code string) (bool, error) {
+	userTOTP, err := strg.storage.GetTOTP(ctx, userID)
+	if errors.Is(err, storage.ErrTOTPNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !userTOTP.Confirmed {
+		return false, nil
+	}
+	if len(strings.TrimSpace(code)) == totp.Digits {
+		step, ok := totp.Validate(userTOTP.Secret, code, time.Now(), 1)
+		if !ok {
+			return false, nil
+		}
+		err = strg.storage.UseTOTPStep(ctx, userID, step)
+		if errors.Is(err, storage.ErrTOTPCodeUsed) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	err = strg.storage.UseRecoveryCode(ctx, userID, hashRecoveryCode(code))
+	if errors.Is(err, storage.ErrRecoveryCodeNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	codeHash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(codeHash[:])
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		data := make([]byte, 7)
+		if _, err := rand.Read(data); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(data))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+type totpEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// EnrollTOTP starts enrollment into two-factor authentication, it is enabled only after ConfirmTOTP.
+func (strg *HandlerWithStorage) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(UserID).(string)
+	userData, err := strg.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get user", "user_id", userID)
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not generate totp secret", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not enroll two-factor authentication")
+		return
+	}
+	if err := strg.storage.SetTOTPSecret(r.Context(), userID, secret); err != nil {
+		strg.writeStorageError(w, r, err, "Could not enroll two-factor authentication", "user_id", userID)
+		return
+	}
+	enrollmentMarshalled, err := json.Marshal(totpEnrollment{Secret: secret, OTPAuthURI: totp.URI(totpIssuer, userData.Login, secret)})
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not encode response", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(enrollmentMarshalled)
+}
+
+type totpConfirmation struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// ConfirmTOTP enables two-factor authentication with the first code from the app and returns recovery codes.
+func (strg *HandlerWithStorage) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	userID := r.Context().Value(UserID).(string)
+	jsonBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
+		return
+	}
+	var request totpConfirmation
+	if err := json.Unmarshal(jsonBody, &request); err != nil || request.Code == "" {
+		strg.logger.InfoContext(r.Context(), "Could not get code from body")
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
+		return
+	}
+	userTOTP, err := strg.storage.GetTOTP(r.Context(), userID)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not confirm two-factor authentication", "user_id", userID)
+		return
+	}
+	if userTOTP.Confirmed {
+		problem.Write(w, r, http.StatusConflict, problem.CodeTwoFactorAlreadyEnabled, "Two-factor authentication is already enabled")
+		return
+	}
+	step, ok := totp.Validate(userTOTP.Secret, request.Code, time.Now(), 1)
+	if !ok {
+		strg.logger.InfoContext(r.Context(), "Got wrong totp code", "user_id", userID)
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeWrongTwoFactorCode, "Wrong two-factor code")
+		return
+	}
+	recoveryCodes, err := generateRecoveryCodes()
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not generate recovery codes", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not confirm two-factor authentication")
+		return
+	}
+	codeHashes := make([]string, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		codeHashes = append(codeHashes, hashRecoveryCode(code))
+	}
+	if err := strg.storage.ConfirmTOTP(r.Context(), userID, step, codeHashes); err != nil {
+		strg.writeStorageError(w, r, err, "Could not confirm two-factor authentication", "user_id", userID)
+		return
+	}
+	strg.logger.InfoContext(r.Context(), "Enabled two-factor authentication", "user_id", userID)
+	codesMarshalled, err := json.Marshal(recoveryCodesResponse{RecoveryCodes: recoveryCodes})
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not encode response", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(codesMarshalled)
+}
+
+// RequireAdmin lets only users with the admin role through, it must run after CheckAuth.
+func (strg *HandlerWithStorage) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(UserID).(string)
+		userData, err := strg.storage.GetUserByID(r.Context(), userID)
+		if err != nil {
+			strg.writeStorageError(w, r, err, "Could not check user role", "user_id", userID)
+			return
+		}
+		if userData.Role != storage.RoleAdmin {
+			strg.logger.WarnContext(r.Context(), "Got admin request from user without admin role", "user_id", userID, "role", userData.Role, "method", r.Method, "path", r.URL.Path)
+			problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "Admin role is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// audit records an admin action, data is not returned to the admin when it could not be recorded.
+func (strg *HandlerWithStorage) audit(w http.ResponseWriter, r *http.Request, action string, targetUserID string, details string) bool {
+	actorID := r.Context().Value(UserID).(string)
+	err := strg.storage.AddAuditRecord(r.Context(), storage.AuditRecord{ActorID: actorID, Action: action, TargetUserID: targetUserID, Details: details})
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not record admin action", "action", action, "admin_id", actorID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not record admin action")
+		return false
+	}
+	strg.logger.InfoContext(r.Context(), "Recorded admin action", "action", action, "admin_id", actorID, "target_user_id", targetUserID, "details", details)
+	return true
+}
+
+func (strg *HandlerWithStorage) writeJSON(w http.ResponseWriter, r *http.Request, value interface{}) {
+	valueMarshalled, err := json.Marshal(value)
+	if err != nil {
+		strg.logger.ErrorContext(r.Context(), "Could not encode response", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(valueMarshalled)
+}
+
+type adminUser struct {
+	ID    string `json:"id"`
+	Login string `json:"login"`
+	Role  string `json:"role"`
+}
+
+// adminTargetUser returns the user from the {id} url parameter.
+func (strg *HandlerWithStorage) adminTargetUser(w http.ResponseWriter, r *http.Request) (storage.UserAuthData, bool) {
+	userID := chi.URLParam(r, "id")
+	userData, err := strg.storage.GetUserByID(r.Context(), userID)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "User not found")
+		return storage.UserAuthData{}, false
+	}
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get user", "user_id", userID)
+		return storage.UserAuthData{}, false
+	}
+	return userData, true
+}
+
+// AdminFindUser looks a user up by the login query parameter.
+func (strg *HandlerWithStorage) AdminFindUser(w http.ResponseWriter, r *http.Request) {
+	login := r.URL.Query().Get("login")
+	if login == "" {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery, "Login is required")
+		return
+	}
+	userData, err := strg.storage.GetUserByLogin(r.Context(), storage.UserAuthData{Login: login})
+	if errors.Is(err, storage.ErrUserNotFound) {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get user")
+		return
+	}
+	if !strg.audit(w, r, storage.AuditUserLookup, userData.UserID, "login "+login) {
+		return
+	}
+	strg.writeJSON(w, r, adminUser{ID: userData.UserID, Login: userData.Login, Role: userData.Role})
+}
+
+func (strg *HandlerWithStorage) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	userData, ok := strg.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	if !strg.audit(w, r, storage.AuditUserLookup, userData.UserID, "id "+userData.UserID) {
+		return
+	}
+	strg.writeJSON(w, r, adminUser{ID: userData.UserID, Login: userData.Login, Role: userData.Role})
+}
+
+func (strg *HandlerWithStorage) AdminGetOrders(w http.ResponseWriter, r *http.Request) {
+	userData, ok := strg.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	query, err := parseListQuery(r, true)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery, "Invalid list query: "+err.Error())
+		return
+	}
+	orders, err := strg.storage.GetOrdersByUser(r.Context(), userData.UserID, pageQuery(query))
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get orders", "user_id", userData.UserID)
+		return
+	}
+	orders = ordersPage(w, r, query, orders)
+	if !strg.audit(w, r, storage.AuditOrdersView, userData.UserID, fmt.Sprintf("%d orders", len(orders))) {
+		return
+	}
+	strg.writeJSON(w, r, orders)
+}
+
+func (strg *HandlerWithStorage) AdminGetWithdrawals(w http.ResponseWriter, r *http.Request) {
+	userData, ok := strg.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	query, err := parseListQuery(r, false)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery, "Invalid list query: "+err.Error())
+		return
+	}
+	withdrawals, err := strg.storage.GetWithdrawalsForUser(r.Context(), userData.UserID, pageQuery(query))
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get withdrawals", "user_id", userData.UserID)
+		return
+	}
+	withdrawals = withdrawalsPage(w, r, query, withdrawals)
+	if !strg.audit(w, r, storage.AuditWithdrawalsView, userData.UserID, fmt.Sprintf("%d withdrawals", len(withdrawals))) {
+		return
+	}
+	strg.writeJSON(w, r, withdrawals)
+}
+
+func (strg *HandlerWithStorage) AdminGetBalance(w http.ResponseWriter, r *http.Request) {
+	userData, ok := strg.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	userBalance, err := strg.storage.GetUserBalance(r.Context(), userData.UserID)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get user balance", "user_id", userData.UserID)
+		return
+	}
+	if !strg.audit(w, r, storage.AuditBalanceView, userData.UserID, "current "+userBalance.Orders.String()) {
+		return
+	}
+	strg.writeJSON(w, r, userBalance)
+}
+
+type balanceAdjustmentRequest struct {
+	Amount money.Amount `json:"amount"`
+	Reason string       `json:"reason"`
+}
+
+// AdminAdjustBalance adds points to or takes them off a user balance, the reason is mandatory.
+func (strg *HandlerWithStorage) AdminAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	userData, ok := strg.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	jsonBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
+		return
+	}
+	var request balanceAdjustmentRequest
+	if err := json.Unmarshal(jsonBody, &request); err != nil {
+		strg.logger.InfoContext(r.Context(), "Could not parse request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not parse request body")
+		return
+	}
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.Amount == 0 || request.Reason == "" || len(request.Reason) > maxAdjustmentReasonLength {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Amount and reason are required")
+		return
+	}
+	balance, err := strg.storage.AdjustBalance(r.Context(), storage.BalanceAdjustment{
+		UserID:  userData.UserID,
+		ActorID: r.Context().Value(UserID).(string),
+		Amount:  request.Amount,
+		Reason:  request.Reason,
+	})
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not adjust balance", "user_id", userData.UserID)
+		return
+	}
+	strg.logger.InfoContext(r.Context(), "Adjusted balance", "user_id", userData.UserID, "amount", request.Amount, "reason", request.Reason)
+	strg.writeJSON(w, r, balance)
+}
+
+// AdminRepollOrder makes the poller ask the accrual system about the order again.
+// PROCESSED and INVALID orders are final and get 409 without an audit record.
+func (strg *HandlerWithStorage) AdminRepollOrder(w http.ResponseWriter, r *http.Request) {
+	orderNumber := chi.URLParam(r, "number")
+	ownerID, err := strg.storage.RequeueAccrualJob(r.Context(), orderNumber)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not requeue order", "order", orderNumber)
+		return
+	}
+	if !strg.audit(w, r, storage.AuditOrderRepoll, ownerID, "order "+orderNumber) {
+		return
+	}
+	strg.poller.Notify()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(make([]byte, 0))
+}
+
+// AdminGetAudit returns the newest audit records, of one user when user_id is set.
+func (strg *HandlerWithStorage) AdminGetAudit(w http.ResponseWriter, r *http.Request) {
+	limit := defaultAuditLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed < 1 || parsed > maxAuditLimit {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery, "Invalid limit")
+			return
+		}
+		limit = parsed
+	}
+	records, err := strg.storage.GetAuditRecords(r.Context(), r.URL.Query().Get("user_id"), limit)
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get audit records")
+		return
+	}
+	strg.writeJSON(w, r, records)
+}
+
+// responseRecorder passes the response through and keeps a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.statusCode == 0 {
+		rec.statusCode = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.statusCode = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+func hashRequest(r *http.Request, body []byte) string {
+	requestHash := sha256.New()
+	requestHash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	requestHash.Write(body)
+	return hex.EncodeToString(requestHash.Sum(nil))
+}
+
+// Idempotent replays the saved response to a retried request with the same
+// Idempotency-Key header. Server errors are not saved, so such requests can be retried.
+// When the response could not be saved, a retry after idempotencyKeyLease runs the
+// request again, the withdrawal itself is protected by the unique order number.
+func (strg *HandlerWithStorage) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeIdempotencyKeyTooLong, "Idempotency key is too long")
+			return
+		}
+		userID := r.Context().Value(UserID).(string)
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			strg.logger.InfoContext(r.Context(), "Could not read request body", "error", err)
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, "Could not read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		record := storage.IdempotencyRecord{UserID: userID, Key: key, RequestHash: hashRequest(r, body)}
+		err = strg.storage.CreateIdempotencyKey(r.Context(), record, idempotencyKeyTTL, idempotencyKeyLease)
+		if errors.Is(err, storage.ErrIdempotencyKeyExists) {
+			strg.replayResponse(w, r, record)
+			return
+		}
+		if err != nil {
+			strg.logger.ErrorContext(r.Context(), "Could not save idempotency key", "user_id", userID, "error", err)
+			problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not save idempotency key")
+			return
+		}
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.statusCode == 0 {
+			recorder.statusCode = http.StatusOK
+		}
+		// The request may be cancelled by now, the response must be saved anyway.
+		ctx := context.Background()
+		if recorder.statusCode >= http.StatusInternalServerError {
+			if err := strg.storage.DeleteIdempotencyKey(ctx, userID, key); err != nil {
+				strg.logger.ErrorContext(r.Context(), "Could not delete idempotency key", "user_id", userID, "error", err)
+			}
+			return
+		}
+		record.StatusCode = recorder.statusCode
+		record.ContentType = recorder.Header().Get("Content-Type")
+		record.ResponseBody = recorder.body.Bytes()
+		if err := strg.storage.SaveIdempotentResponse(ctx, record); err != nil {
+			strg.logger.ErrorContext(r.Context(), "Could not save response for idempotency key, it is released after the lease", "user_id", userID, "lease", idempotencyKeyLease, "error", err)
+		}
+	})
+}
+
+func (strg *HandlerWithStorage) replayResponse(w http.ResponseWriter, r *http.Request, request storage.IdempotencyRecord) {
+	saved, err := strg.storage.GetIdempotencyKey(r.Context(), request.UserID, request.Key)
+	if errors.Is(err, storage.ErrIdempotencyKeyNotFound) {
+		// The first request failed with a server error just now and released the key.
+		problem.Write(w, r, http.StatusConflict, problem.CodeIdempotencyKeyInProgress, "Request with this idempotency key is in progress")
+		return
+	}
+	if err != nil {
+		strg.writeStorageError(w, r, err, "Could not get idempotency key", "user_id", request.UserID)
+		return
+	}
+	if saved.RequestHash != request.RequestHash {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeIdempotencyKeyReused, "Idempotency key is already used for another request")
+		return
+	}
+	if saved.StatusCode == 0 {
+		problem.Write(w, r, http.StatusConflict, problem.CodeIdempotencyKeyInProgress, "Request with this idempotency key is in progress")
+		return
+	}
+	strg.logger.InfoContext(r.Context(), "Replaying response for idempotency key", "user_id", request.UserID)
+	if saved.ContentType != "" {
+		w.Header().Set("Content-Type", saved.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(saved.StatusCode)
+	w.Write(saved.ResponseBody)
+}
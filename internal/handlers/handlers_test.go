@@ -2,20 +2,63 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/accrual"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/keyring"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/mocks"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/money"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/notify"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/passwords"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/problem"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/throttle"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/tokens"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/totp"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
+// hashedAuthData matches UserAuthData whose Password is a hash of the expected password.
+type hashedAuthData struct {
+	authData storage.UserAuthData
+}
+
+func (m hashedAuthData) Matches(x interface{}) bool {
+	authData, ok := x.(storage.UserAuthData)
+	if !ok || authData.Login != m.authData.Login {
+		return false
+	}
+	match, _, err := passwords.Verify(m.authData.Password, authData.Password)
+	return err == nil && match
+}
+
+func (m hashedAuthData) String() string {
+	return fmt.Sprintf("has login %s and hash of password %s", m.authData.Login, m.authData.Password)
+}
+
+var testKeys, _ = keyring.Parse("new:0123456789abcdef0123,old:fedcba9876543210fedc")
+
+// signedWith returns a session cookie value signed by the given keys.
+func signedWith(keys *keyring.Keyring, sessionID string) string {
+	kid, sign := keys.Sign([]byte(sessionID))
+	return kid + "." + hex.EncodeToString(append([]byte(sessionID), sign...))
+}
+
 type wantResponse struct {
 	code            int
 	headerContent   string
@@ -77,11 +120,12 @@ func TestValidateOrder(t *testing.T) {
 
 func TestRegisterHandler(t *testing.T) {
 	tt := []struct {
-		name                string
-		want                wantResponse
-		registerData        storage.UserAuthData
-		mockResponseID      string
-		mockResponseErrCode int
+		name            string
+		want            wantResponse
+		registerData    storage.UserAuthData
+		mockResponseID  string
+		mockResponseErr error
+		mockSessionID   string
 	}{
 		{
 			"success_register",
@@ -92,29 +136,32 @@ func TestRegisterHandler(t *testing.T) {
 			},
 			storage.UserAuthData{Login: "NewLogin", Password: "MyPassword"},
 			"ad29ba3c-7eba-4223-9635-fc71e9c1fa28",
-			http.StatusOK,
+			nil,
+			"0c7d4a4e-3f0a-4a4b-8c71-39f3f2d1a7b5",
 		},
 		{
 			"fail_register_same_login",
 			wantResponse{
-				http.StatusFailedDependency,
-				"text/plain; charset=utf-8",
-				"Could not register user\n",
+				http.StatusConflict,
+				"application/problem+json",
+				`{"type":"about:blank","title":"Conflict","status":409,"detail":"Could not register user","instance":"/api/user/register","code":"login_taken"}`,
 			},
 			storage.UserAuthData{Login: "NewLogin", Password: "MyPassword"},
 			"",
-			http.StatusFailedDependency,
+			storage.ErrLoginTaken,
+			"",
 		},
 		{
 			"fail_register_internal_error",
 			wantResponse{
 				http.StatusInternalServerError,
-				"text/plain; charset=utf-8",
-				"Could not register user\n",
+				"application/problem+json",
+				`{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"Could not register user","instance":"/api/user/register","code":"internal_error"}`,
 			},
 			storage.UserAuthData{Login: "NewLogin", Password: "MyPassword"},
 			"",
-			http.StatusInternalServerError,
+			errors.New("connection refused"),
+			"",
 		},
 	}
 	for _, tc := range tt {
@@ -125,8 +172,11 @@ func TestRegisterHandler(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			defer ctrl.Finish()
 			storage := mocks.NewMockStorage(ctrl)
-			storage.EXPECT().Register(tc.registerData).Return(tc.mockResponseID, tc.mockResponseErrCode)
-			handler := http.HandlerFunc(GetHandlerWithStorage(storage).Register)
+			storage.EXPECT().Register(gomock.Any(), hashedAuthData{tc.registerData}).Return(tc.mockResponseID, tc.mockResponseErr)
+			if tc.mockResponseErr == nil {
+				storage.EXPECT().CreateSession(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(sessionFor(tc.mockSessionID))
+			}
+			handler := http.HandlerFunc(GetHandlerWithStorage(storage, accrual.NewPoller(storage, accrual.NewFakeClient(), accrual.DefaultPollerConfig, slog.Default()), testKeys, slog.Default()).Register)
 			handler.ServeHTTP(w, request)
 			result := w.Result()
 			defer result.Body.Close()
@@ -135,10 +185,11 @@ func TestRegisterHandler(t *testing.T) {
 				cookies := result.Cookies()
 				for _, cookie := range cookies {
 					if cookie.Name == UserCookie {
-						h := hmac.New(sha256.New, CookieKey)
-						h.Write([]byte(tc.mockResponseID))
+						h := hmac.New(sha256.New, []byte("0123456789abcdef0123"))
+						h.Write([]byte(tc.mockSessionID))
 						sign := h.Sum(nil)
-						assert.Equal(t, hex.EncodeToString(append([]byte(tc.mockResponseID)[:], sign[:]...)), cookie.Value)
+						assert.Equal(t, "new."+hex.EncodeToString(append([]byte(tc.mockSessionID)[:], sign[:]...)), cookie.Value)
+						assert.True(t, cookie.HttpOnly)
 						break
 					}
 					assert.Fail(t, "Got no cookies for UserID")
@@ -151,3 +202,804 @@ func TestRegisterHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestStorageErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"login_taken", storage.ErrLoginTaken, http.StatusConflict},
+		{"user_not_found", storage.ErrUserNotFound, http.StatusUnauthorized},
+		{"order_owned_by_other", storage.ErrOrderOwnedByOther, http.StatusConflict},
+		{"insufficient_funds", storage.ErrInsufficientFunds, http.StatusPaymentRequired},
+		{"session_not_found", storage.ErrSessionNotFound, http.StatusUnauthorized},
+		{"wrapped_error", fmt.Errorf("could not add withdrawal: %w", storage.ErrInsufficientFunds), http.StatusPaymentRequired},
+		{"unknown_error", errors.New("connection refused"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, StorageErrorCode(tt.err))
+		})
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	argonHash, _ := passwords.Hash("MyPassword")
+	legacyHash := "dc1e7c03e162397b355b6f1c895dfdf3790d98c10b920c55e91272b8eecada2a"
+	userID := "ad29ba3c-7eba-4223-9635-fc71e9c1fa28"
+	tt := []struct {
+		name         string
+		password     string
+		storedHash   string
+		userErr      error
+		wantCode     int
+		wantRehashed bool
+	}{
+		{"success_login", "MyPassword", argonHash, nil, http.StatusOK, false},
+		{"success_login_with_legacy_hash", "MyPassword", legacyHash, nil, http.StatusOK, true},
+		{"wrong_password", "WrongPassword", argonHash, nil, http.StatusUnauthorized, false},
+		{"wrong_password_with_legacy_hash", "WrongPassword", legacyHash, nil, http.StatusUnauthorized, false},
+		{"unknown_login", "MyPassword", "", storage.ErrUserNotFound, http.StatusUnauthorized, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			authData := storage.UserAuthData{Login: "NewLogin", Password: tc.password}
+			marshalledData, _ := json.Marshal(authData)
+			request := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewBuffer(marshalledData))
+			w := httptest.NewRecorder()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			storageMock := mocks.NewMockStorage(ctrl)
+			allowLogins(storageMock)
+			storageMock.EXPECT().GetUserByLogin(gomock.Any(), authData).Return(
+				userDataWithHash(userID, tc.storedHash), tc.userErr,
+			)
+			if tc.wantRehashed {
+				storageMock.EXPECT().UpdatePasswordHash(gomock.Any(), userID, gomock.Any()).DoAndReturn(
+					func(_ context.Context, _ string, passwordHash string) error {
+						match, needsRehash, err := passwords.Verify(tc.password, passwordHash)
+						assert.Nil(t, err)
+						assert.True(t, match)
+						assert.False(t, needsRehash)
+						return nil
+					},
+				)
+			}
+			if tc.wantCode == http.StatusOK {
+				storageMock.EXPECT().GetTOTP(gomock.Any(), userID).Return(storage.TOTP{}, storage.ErrTOTPNotFound)
+				storageMock.EXPECT().CreateSession(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					sessionFor("0c7d4a4e-3f0a-4a4b-8c71-39f3f2d1a7b5"),
+				)
+			}
+			handler := http.HandlerFunc(GetHandlerWithStorage(storageMock, nil, testKeys, slog.Default()).Login)
+			handler.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tc.wantCode, result.StatusCode)
+			assert.Equal(t, tc.wantCode == http.StatusOK, len(result.Cookies()) == 1)
+		})
+	}
+}
+
+func userDataWithHash(userID string, passwordHash string) storage.UserAuthData {
+	return storage.UserAuthData{Login: "NewLogin", Password: passwordHash, UserID: userID}
+}
+
+// allowLogins makes the login throttler to find no failures or lockouts.
+func allowLogins(storageMock *mocks.MockStorage) {
+	storageMock.EXPECT().GetLoginLockout(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.LoginLockout{}, storage.ErrLockoutNotFound).AnyTimes()
+	storageMock.EXPECT().GetLoginFailures(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.LoginFailures{}, nil).AnyTimes()
+	storageMock.EXPECT().RecordLoginAttempt(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+}
+
+func sessionFor(sessionID string) func(context.Context, storage.Session, time.Duration) (storage.Session, error) {
+	return func(_ context.Context, session storage.Session, ttl time.Duration) (storage.Session, error) {
+		session.ID = sessionID
+		session.CreatedAt = time.Now()
+		session.LastSeen = session.CreatedAt
+		session.ExpiresAt = session.CreatedAt.Add(ttl)
+		return session, nil
+	}
+}
+
+func TestCheckAuth(t *testing.T) {
+	userID := "ad29ba3c-7eba-4223-9635-fc71e9c1fa28"
+	sessionID := "0c7d4a4e-3f0a-4a4b-8c71-39f3f2d1a7b5"
+	oldKeys, _ := keyring.Parse("old:fedcba9876543210fedc")
+	removedKeys, _ := keyring.Parse("removed:aaaaaaaaaaaaaaaaaaaa")
+	tt := []struct {
+		name       string
+		path       string
+		cookie     string
+		touchErr   error
+		wantTouch  bool
+		wantCode   int
+		wantUserID string
+	}{
+		{"public_path", "/api/user/login", "", nil, false, http.StatusOK, ""},
+		{"no_cookie", "/api/user/orders", "", nil, false, http.StatusUnauthorized, ""},
+		{"bad_cookie", "/api/user/orders", "not-hex", nil, false, http.StatusUnauthorized, ""},
+		{"short_cookie", "/api/user/orders", hex.EncodeToString([]byte("short")), nil, false, http.StatusUnauthorized, ""},
+		{"no_key_id", "/api/user/orders", hex.EncodeToString([]byte(sessionID + "wrong sign")), nil, false, http.StatusUnauthorized, ""},
+		{"wrong_sign", "/api/user/orders", "new." + hex.EncodeToString([]byte(sessionID+"wrong sign")), nil, false, http.StatusUnauthorized, ""},
+		{"valid_session", "/api/user/orders", signedWith(testKeys, sessionID), nil, true, http.StatusOK, userID},
+		{"signed_by_previous_key", "/api/user/orders", signedWith(oldKeys, sessionID), nil, true, http.StatusOK, userID},
+		{"signed_by_removed_key", "/api/user/orders", signedWith(removedKeys, sessionID), nil, false, http.StatusUnauthorized, ""},
+		{"revoked_session", "/api/user/orders", signedWith(testKeys, sessionID), storage.ErrSessionNotFound, true, http.StatusUnauthorized, ""},
+		{"storage_error", "/api/user/orders", signedWith(testKeys, sessionID), errors.New("connection refused"), true, http.StatusInternalServerError, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.cookie != "" {
+				request.AddCookie(&http.Cookie{Name: UserCookie, Value: tc.cookie})
+			}
+			w := httptest.NewRecorder()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			storageMock := mocks.NewMockStorage(ctrl)
+			if tc.wantTouch {
+				storageMock.EXPECT().TouchSession(gomock.Any(), sessionID).Return(
+					storage.Session{ID: sessionID, UserID: userID}, tc.touchErr,
+				)
+			}
+			var gotUserID string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if userID, ok := r.Context().Value(UserID).(string); ok {
+					gotUserID = userID
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+			GetHandlerWithStorage(storageMock, nil, testKeys, slog.Default()).CheckAuth(next).ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tc.wantCode, result.StatusCode)
+			assert.Equal(t, tc.wantUserID, gotUserID)
+		})
+	}
+}
+
+func TestCheckAuthBearer(t *testing.T) {
+	userID := "ad29ba3c-7eba-4223-9635-fc71e9c1fa28"
+	sessionID := "0c7d4a4e-3f0a-4a4b-8c71-39f3f2d1a7b5"
+	tokenManager := tokens.NewManager(testKeys, time.Minute)
+	tokenPair, _ := tokenManager.Issue(userID, sessionID, time.Now().Add(time.Hour))
+	anotherUserPair, _ := tokenManager.Issue("5a1f2b5e-0c0e-4e8f-9a57-4b0c7a1b2c3d", sessionID, time.Now().Add(time.Hour))
+	removedKeys, _ := keyring.Parse("removed:aaaaaaaaaaaaaaaaaaaa")
+	removedKeyPair, _ := tokens.NewManager(removedKeys, time.Minute).Issue(userID, sessionID, time.Now().Add(time.Hour))
+	tt := []struct {
+		name          string
+		authorization string
+		touchErr      error
+		wantTouch     bool
+		wantCode      int
+		wantUserID    string
+	}{
+		{"valid_token", "Bearer " + tokenPair.AccessToken, nil, true, http.StatusOK, userID},
+		{"lowercase_scheme", "bearer " + tokenPair.AccessToken, nil, true, http.StatusOK, userID},
+		{"refresh_token", "Bearer " + tokenPair.RefreshToken, nil, false, http.StatusUnauthorized, ""},
+		{"garbage_token", "Bearer garbage", nil, false, http.StatusUnauthorized, ""},
+		{"removed_key", "Bearer " + removedKeyPair.AccessToken, nil, false, http.StatusUnauthorized, ""},
+		{"revoked_session", "Bearer " + tokenPair.AccessToken, storage.ErrSessionNotFound, true, http.StatusUnauthorized, ""},
+		{"session_of_another_user", "Bearer " + anotherUserPair.AccessToken, nil, true, http.StatusUnauthorized, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			request.Header.Set("Authorization", tc.authorization)
+			w := httptest.NewRecorder()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			storageMock := mocks.NewMockStorage(ctrl)
+			if tc.wantTouch {
+				storageMock.EXPECT().TouchSession(gomock.Any(), sessionID).Return(
+					storage.Session{ID: sessionID, UserID: userID}, tc.touchErr,
+				)
+			}
+			var gotUserID string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUserID = r.Context().Value(UserID).(string)
+				w.WriteHeader(http.StatusOK)
+			})
+			GetHandlerWithStorage(storageMock, nil, testKeys, slog.Default()).CheckAuth(next).ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tc.wantCode, result.StatusCode)
+			assert.Equal(t, tc.wantUserID, gotUserID)
+		})
+	}
+}
+
+func TestLoginHandlerWithTokens(t *testing.T) {
+	userID := "ad29ba3c-7eba-4223-9635-fc71e9c1fa28"
+	sessionID := "0c7d4a4e-3f0a-4a4b-8c71-39f3f2d1a7b5"
+	argonHash, _ := passwords.Hash("MyPassword")
+	authData := storage.UserAuthData{Login: "NewLogin", Password: "MyPassword"}
+	marshalledData, _ := json.Marshal(authData)
+	request := httptest.NewRequest(http.MethodPost, "/api/user/login?tokens=true", bytes.NewBuffer(marshalledData))
+	w := httptest.NewRecorder()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	storageMock := mocks.NewMockStorage(ctrl)
+	allowLogins(storageMock)
+	storageMock.EXPECT().GetUserByLogin(gomock.Any(), authData).Return(userDataWithHash(userID, argonHash), nil)
+	storageMock.EXPECT().GetTOTP(gomock.Any(), userID).Return(storage.TOTP{}, storage.ErrTOTPNotFound)
+	storageMock.EXPECT().CreateSession(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(sessionFor(sessionID))
+	GetHandlerWithStorage(storageMock, nil, testKeys, slog.Default()).Login(w, request)
+	result := w.Result()
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
+	assert.Len(t, result.Cookies(), 1, "cookie is set for token clients too")
+	var tokenPair tokens.TokenPair
+	assert.Nil(t, json.NewDecoder(result.Body).Decode(&tokenPair))
+	assert.Equal(t, "Bearer", tokenPair.TokenType)
+	claims, err := tokens.NewManager(testKeys, time.Minute).Parse(tokenPair.AccessToken, tokens.AccessAudience)
+	assert.Nil(t, err)
+	assert.Equal(t, userID, claims.Subject)
+	assert.Equal(t, sessionID, claims.SessionID)
+}
+
+func TestRefreshTokenHandler(t *testing.T) {
+	userID := "ad29ba3c-7eba-4223-9635-fc71e9c1fa28"
+	sessionID := "0c7d4a4e-3f0a-4a4b-8c71-39f3f2d1a7b5"
+	tokenPair, _ := tokens.NewManager(testKeys, time.Minute).Issue(userID, sessionID, time.Now().Add(time.Hour))
+	tt := []struct {
+		name      string
+		body      string
+		touchErr  error
+		wantTouch bool
+		wantCode  int
+	}{
+		{"success_refresh", `{"refresh_token":"` + tokenPair.RefreshToken + `"}`, nil, true, http.StatusOK},
+		{"access_token", `{"refresh_token":"` + tokenPair.AccessToken + `"}`, nil, false, http.StatusUnauthorized},
+		{"revoked_session", `{"refresh_token":"` + tokenPair.RefreshToken + `"}`, storage.ErrSessionNotFound, true, http.StatusUnauthorized},
+		{"no_token", `{}`, nil, false, http.StatusBadRequest},
+		{"bad_body", `refresh`, nil, false, http.StatusBadRequest},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/user/token/refresh", bytes.NewBufferString(tc.body))
+			w := httptest.NewRecorder()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			storageMock := mocks.NewMockStorage(ctrl)
+			if tc.wantTouch {
+				storageMock.EXPECT().TouchSession(gomock.Any(), sessionID).Return(
+					storage.Session{ID: sessionID, UserID: userID, ExpiresAt: time.Now().Add(time.Hour)}, tc.touchErr,
+				)
+			}
+			GetHandlerWithStorage(storageMock, nil, testKeys, slog.Default()).RefreshToken(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tc.wantCode, result.StatusCode)
+			if tc.wantCode == http.StatusOK {
+				var refreshed tokens.TokenPair
+				assert.Nil(t, json.NewDecoder(result.Body).Decode(&refreshed))
+				assert.NotEmpty(t, refreshed.AccessToken)
+				assert.NotEmpty(t, refreshed.RefreshToken)
+			}
+		})
+	}
+}
+
+func TestLoginHandlerThrottled(t *testing.T) {
+	tt := []struct {
+		name           string
+		lockout        storage.LoginLockout
+		lockoutErr     error
+		failures       storage.LoginFailures
+		wantRetryAfter string
+	}{
+		{
+			"locked_out",
+			storage.LoginLockout{Kind: storage.LockoutByLogin, Key: "NewLogin", LockedUntil: time.Now().Add(10 * time.Minute)},
+			nil,
+			storage.LoginFailures{},
+			"600",
+		},
+		{
+			"progressive_delay",
+			storage.LoginLockout{},
+			storage.ErrLockoutNotFound,
+			storage.LoginFailures{ByLogin: 3, ByIP: 3, LastFailure: time.Now()},
+			"4",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			authData := storage.UserAuthData{Login: "NewLogin", Password: "MyPassword"}
+			marshalledData, _ := json.Marshal(authData)
+			request := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewBuffer(marshalledData))
+			w := httptest.NewRecorder()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			storageMock := mocks.NewMockStorage(ctrl)
+			storageMock.EXPECT().GetLoginLockout(gomock.Any(), "NewLogin", "192.0.2.1").Return(tc.lockout, tc.lockoutErr)
+			if tc.lockoutErr != nil {
+				storageMock.EXPECT().GetLoginFailures(gomock.Any(), "NewLogin", "192.0.2.1", gomock.Any()).Return(tc.failures, nil)
+			}
+			GetHandlerWithStorage(storageMock, nil, testKeys, slog.Default()).Login(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, http.StatusTooManyRequests, result.StatusCode)
+			assert.Equal(t, tc.wantRetryAfter, result.Header.Get("Retry-After"))
+			assert.Empty(t, result.Cookies())
+		})
+	}
+}
+
+func TestLoginHandlerRecordsFailures(t *testing.T) {
+	argonHash, _ := passwords.Hash("MyPassword")
+	authData := storage.UserAuthData{Login: "NewLogin", Password: "WrongPassword"}
+	marshalledData, _ := json.Marshal(authData)
+	request := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewBuffer(marshalledData))
+	w := httptest.NewRecorder()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	storageMock := mocks.NewMockStorage(ctrl)
+	storageMock.EXPECT().GetLoginLockout(gomock.Any(), "NewLogin", "192.0.2.1").Return(storage.LoginLockout{}, storage.ErrLockoutNotFound)
+	storageMock.EXPECT().GetLoginFailures(gomock.Any(), "NewLogin", "192.0.2.1", gomock.Any()).Return(storage.LoginFailures{}, nil)
+	storageMock.EXPECT().GetUserByLogin(gomock.Any(), authData).Return(userDataWithHash("ad29ba3c-7eba-4223-9635-fc71e9c1fa28", argonHash), nil)
+	storageMock.EXPECT().RecordLoginAttempt(gomock.Any(), "NewLogin", "192.0.2.1", false).Return(nil)
+	storageMock.EXPECT().GetLoginFailures(gomock.Any(), "NewLogin", "192.0.2.1", gomock.Any()).Return(storage.LoginFailures{ByLogin: 5, ByIP: 5, LastFailure: time.Now()}, nil)
+	storageMock.EXPECT().AddLoginLockout(gomock.Any(), storage.LoginLockout{Kind: storage.LockoutByLogin, Key: "NewLogin", Failures: 5}, gomock.Any()).Return(
+		storage.LoginLockout{Kind: storage.LockoutByLogin, Key: "NewLogin", Failures: 5, LockedUntil: time.Now().Add(time.Minute)}, nil,
+	)
+	GetHandlerWithStorage(storageMock, nil, testKeys, slog.Default()).Login(w, request)
+	result := w.Result()
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, result.StatusCode)
+}
+
+// recordingNotifier keeps sent messages for assertions.
+type recordingNotifier struct {
+	messages []notify.Message
+}
+
+func (n *recordingNotifier) Send(ctx context.Context, message notify.Message) error {
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+func withUser(request *http.Request, userID string, sessionID string) *http.Request {
+	ctx := context.WithValue(request.Context(), UserID, userID)
+	ctx = context.WithValue(ctx, SessionID, sessionID)
+	return request.WithContext(ctx)
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	userID := "ad29ba3c-7eba-4223-9635-fc71e9c1fa28"
+	sessionID := "0c7d4a4e-3f0a-4a4b-8c71-39f3f2d1a7b5"
+	argonHash, _ := passwords.Hash("MyPassword")
+	tt := []struct {
+		name       string
+		body       string
+		wantUpdate bool
+		wantCode   int
+	}{
+		{"success_change", `{"current_password":"MyPassword","new_password":"NewPassword"}`, true, http.StatusOK},
+		{"wrong_current_password", `{"current_password":"WrongPassword","new_password":"NewPassword"}`, false, http.StatusForbidden},
+		{"empty_new_password", `{"current_password":"MyPassword","new_password":""}`, false, http.StatusBadRequest},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := withUser(httptest.NewRequest(http.MethodPost, "/api/user/password", bytes.NewBufferString(tc.body)), userID, sessionID)
+			w := httptest.NewRecorder()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			storageMock := mocks.NewMockStorage(ctrl)
+			allowLogins(storageMock)
+			storageMock.EXPECT().GetUserByID(gomock.Any(), userID).Return(userDataWithHash(userID, argonHash), nil).AnyTimes()
+			if tc.wantUpdate {
+				storageMock.EXPECT().UpdatePasswordHash(gomock.Any(), userID, gomock.Any()).DoAndReturn(
+					func(_ context.Context, _ string, passwordHash string) error {
+						match, _, err := passwords.Verify("NewPassword", passwordHash)
+						assert.Nil(t, err)
+						assert.True(t, match)
+						return nil
+					},
+				)
+				storageMock.EXPECT().RevokeOtherSessions(gomock.Any(), userID, sessionID).Return(nil)
+			}
+			GetHandlerWithStorage(storageMock, nil, testKeys, slog.Default()).ChangePassword(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tc.wantCode, result.StatusCode)
+		})
+	}
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	userID := "ad29ba3c-7eba-4223-9635-fc71e9c1fa28"
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	storageMock := mocks.NewMockStorage(ctrl)
+	handler := GetHandlerWithStorage(storageMock, nil, testKeys, slog.Default())
+	handler.resetThrottler = throttle.NewThrottler(storage.NewMemStorage(slog.Default()), throttle.PasswordResetConfig, slog.Default())
+	notifier := &recordingNotifier{}
+	handler.notifier = notifier
+
+	storageMock.EXPECT().GetUserByLogin(gomock.Any(), storage.UserAuthData{Login: "Unknown"}).Return(storage.UserAuthData{}, storage.ErrUserNotFound)
+	w := httptest.NewRecorder()
+	handler.RequestPasswordReset(w, httptest.NewRequest(http.MethodPost, "/api/user/password/reset-request", bytes.NewBufferString(`{"login":"Unknown"}`)))
+	assert.Equal(t, http.StatusAccepted, w.Result().StatusCode, "unknown logins get the same answer")
+	assert.Empty(t, notifier.messages)
+
+	var savedHash string
+	storageMock.EXPECT().GetUserByLogin(gomock.Any(), storage.UserAuthData{Login: "NewLogin"}).Return(userDataWithHash(userID, "hash"), nil)
+	storageMock.EXPECT().CreatePasswordResetToken(gomock.Any(), userID, gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ string, tokenHash string, _ time.Duration) error {
+			savedHash = tokenHash
+			return nil
+		},
+	)
+	w = httptest.NewRecorder()
+	handler.RequestPasswordReset(w, httptest.NewRequest(http.MethodPost, "/api/user/password/reset-request", bytes.NewBufferString(`{"login":"NewLogin"}`)))
+	assert.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+	require.Len(t, notifier.messages, 1)
+	assert.Equal(t, userID, notifier.messages[0].UserID)
+	var token string
+	_, err := fmt.Sscanf(notifier.messages[0].Text, "Use token %s", &token)
+	require.Nil(t, err)
+	assert.Equal(t, hashResetToken(token), savedHash, "only the hash of the token is stored")
+	assert.NotContains(t, savedHash, token)
+
+	storageMock.EXPECT().UsePasswordResetToken(gomock.Any(), savedHash).Return(userID, nil)
+	storageMock.EXPECT().UpdatePasswordHash(gomock.Any(), userID, gomock.Any()).Return(nil)
+	storageMock.EXPECT().RevokeOtherSessions(gomock.Any(), userID, "").Return(nil)
+	w = httptest.NewRecorder()
+	handler.ResetPassword(w, httptest.NewRequest(http.MethodPost, "/api/user/password/reset", bytes.NewBufferString(`{"token":"`+token+`","new_password":"NewPassword"}`)))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	storageMock.EXPECT().UsePasswordResetToken(gomock.Any(), savedHash).Return("", storage.ErrResetTokenNotFound)
+	w = httptest.NewRecorder()
+	handler.ResetPassword(w, httptest.NewRequest(http.MethodPost, "/api/user/password/reset", bytes.NewBufferString(`{"token":"`+token+`","new_password":"NewPassword"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode, "tokens are single use")
+}
+
+func TestPasswordResetThrottling(t *testing.T) {
+	memStorage := storage.NewMemStorage(slog.Default())
+	handler := GetHandlerWithStorage(memStorage, nil, testKeys, slog.Default())
+	handler.throttler = throttle.NewThrottler(memStorage, throttle.Config{Window: time.Minute, MaxLoginFailures: 10, MaxIPFailures: 10, Lockout: time.Minute}, slog.Default())
+	notifier := &recordingNotifier{}
+	handler.notifier = notifier
+	passwordHash, _ := passwords.Hash("MyPassword")
+	_, err := memStorage.Register(context.Background(), storage.UserAuthData{Login: "NewLogin", Password: passwordHash})
+	require.Nil(t, err)
+	requestReset := func(login string, remoteAddr string) int {
+		request := httptest.NewRequest(http.MethodPost, "/api/user/password/reset-request", bytes.NewBufferString(`{"login":"`+login+`"}`))
+		request.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.RequestPasswordReset(w, request)
+		return w.Result().StatusCode
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusAccepted, requestReset("NewLogin", "192.0.2.1:1234"), "throttled requests get the same answer")
+	}
+	assert.Len(t, notifier.messages, 1, "repeated requests of a login are throttled")
+
+	for i := 0; i < throttle.PasswordResetConfig.MaxIPFailures+1; i++ {
+		assert.Equal(t, http.StatusAccepted, requestReset(fmt.Sprintf("Unknown%d", i), "192.0.2.2:1234"))
+	}
+	retryAfter, err := handler.resetThrottler.Check(context.Background(), "Unknown100", "192.0.2.2")
+	require.Nil(t, err)
+	assert.Greater(t, retryAfter, time.Duration(0), "the ip is locked out after too many requests")
+
+	request := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewBufferString(`{"login":"NewLogin","password":"MyPassword"}`))
+	request.RemoteAddr = "192.0.2.2:1234"
+	w := httptest.NewRecorder()
+	handler.Login(w, request)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode, "reset requests do not lock out logins")
+}
+
+func TestTwoFactorFlow(t *testing.T) {
+	memStorage := storage.NewMemStorage(slog.Default())
+	handler := GetHandlerWithStorage(memStorage, nil, testKeys, slog.Default())
+	handler.throttler = throttle.NewThrottler(memStorage, throttle.Config{Window: time.Minute, MaxLoginFailures: 10, MaxIPFailures: 10, Lockout: time.Minute}, slog.Default())
+	passwordHash, _ := passwords.Hash("MyPassword")
+	userID, err := memStorage.Register(context.Background(), storage.UserAuthData{Login: "NewLogin", Password: passwordHash})
+	require.Nil(t, err)
+	post := func(handlerFunc http.HandlerFunc, path string, body string) *http.Response {
+		request := withUser(httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body)), userID, "")
+		w := httptest.NewRecorder()
+		handlerFunc(w, request)
+		return w.Result()
+	}
+
+	result := post(handler.EnrollTOTP, "/api/user/2fa/enroll", "")
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var enrollment totpEnrollment
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&enrollment))
+	assert.Contains(t, enrollment.OTPAuthURI, "otpauth://totp/GopherMart:NewLogin?")
+
+	result = post(handler.Login, "/api/user/login", `{"login":"NewLogin","password":"MyPassword"}`)
+	assert.Equal(t, http.StatusOK, result.StatusCode, "not confirmed enrollment does not require a code")
+
+	result = post(handler.ConfirmTOTP, "/api/user/2fa/confirm", `{"code":"000000"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, result.StatusCode)
+	step := totp.Step(time.Now())
+	code, _ := totp.Code(enrollment.Secret, step)
+	result = post(handler.ConfirmTOTP, "/api/user/2fa/confirm", `{"code":"`+code+`"}`)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var recoveryCodes recoveryCodesResponse
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&recoveryCodes))
+	assert.Len(t, recoveryCodes.RecoveryCodes, recoveryCodesCount)
+	result = post(handler.EnrollTOTP, "/api/user/2fa/enroll", "")
+	assert.Equal(t, http.StatusConflict, result.StatusCode, "confirmed secret can not be replaced")
+
+	result = post(handler.Login, "/api/user/login", `{"login":"NewLogin","password":"MyPassword"}`)
+	require.Equal(t, http.StatusAccepted, result.StatusCode)
+	assert.Empty(t, result.Cookies(), "no session before the second factor")
+	var challenge mfaChallenge
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&challenge))
+	assert.True(t, challenge.MFARequired)
+
+	result = post(handler.LoginTOTP, "/api/user/login/2fa", `{"mfa_token":"`+challenge.MFAToken+`","code":"`+code+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, result.StatusCode, "code used for confirmation can not be reused")
+	nextCode, _ := totp.Code(enrollment.Secret, step+1)
+	result = post(handler.LoginTOTP, "/api/user/login/2fa", `{"mfa_token":"garbage","code":"`+nextCode+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, result.StatusCode)
+	result = post(handler.LoginTOTP, "/api/user/login/2fa", `{"mfa_token":"`+challenge.MFAToken+`","code":"`+nextCode+`"}`)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Len(t, result.Cookies(), 1)
+
+	recoveryCode := strings.ToUpper(recoveryCodes.RecoveryCodes[0])
+	result = post(handler.LoginTOTP, "/api/user/login/2fa", `{"mfa_token":"`+challenge.MFAToken+`","code":"`+recoveryCode+`"}`)
+	assert.Equal(t, http.StatusOK, result.StatusCode, "recovery codes are case insensitive")
+	result = post(handler.LoginTOTP, "/api/user/login/2fa", `{"mfa_token":"`+challenge.MFAToken+`","code":"`+recoveryCode+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, result.StatusCode, "recovery codes are single use")
+}
+
+func TestAdminAPI(t *testing.T) {
+	memStorage := storage.NewMemStorage(slog.Default())
+	handler := GetHandlerWithStorage(memStorage, accrual.NewPoller(memStorage, accrual.NewFakeClient(), accrual.DefaultPollerConfig, slog.Default()), testKeys, slog.Default())
+	adminID, err := memStorage.Register(context.Background(), storage.UserAuthData{Login: "Admin", Password: "hash"})
+	require.Nil(t, err)
+	require.Nil(t, memStorage.SetUserRole(context.Background(), "Admin", storage.RoleAdmin))
+	userID, err := memStorage.Register(context.Background(), storage.UserAuthData{Login: "Customer", Password: "hash"})
+	require.Nil(t, err)
+	require.Nil(t, memStorage.AddOrderForUser(context.Background(), "12345678903", userID))
+	require.Nil(t, memStorage.UpdateOrder(context.Background(), storage.OrderFromBlackBox{Order: "12345678903", Status: "PROCESSED", Accrual: money.FromFloat(100)}))
+	require.Nil(t, memStorage.AddOrderForUser(context.Background(), "2377225624", userID))
+
+	router := chi.NewRouter()
+	router.Route("/api/admin", func(adminRouter chi.Router) {
+		adminRouter.Use(handler.RequireAdmin)
+		adminRouter.Get("/users", handler.AdminFindUser)
+		adminRouter.Get("/users/{id}", handler.AdminGetUser)
+		adminRouter.Get("/users/{id}/orders", handler.AdminGetOrders)
+		adminRouter.Get("/users/{id}/balance", handler.AdminGetBalance)
+		adminRouter.Post("/users/{id}/balance/adjustments", handler.AdminAdjustBalance)
+		adminRouter.Post("/orders/{number}/repoll", handler.AdminRepollOrder)
+		adminRouter.Get("/audit", handler.AdminGetAudit)
+	})
+	call := func(actorID string, method string, path string, body string) *http.Response {
+		request := withUser(httptest.NewRequest(method, path, bytes.NewBufferString(body)), actorID, "")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	tt := []struct {
+		name     string
+		actorID  string
+		method   string
+		path     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"not_admin", userID, http.MethodGet, "/api/admin/users?login=Admin", "", http.StatusForbidden, ""},
+		{"find_user", adminID, http.MethodGet, "/api/admin/users?login=Customer", "", http.StatusOK, `{"id":"` + userID + `","login":"Customer","role":"user"}`},
+		{"find_unknown_user", adminID, http.MethodGet, "/api/admin/users?login=Unknown", "", http.StatusNotFound, ""},
+		{"get_user", adminID, http.MethodGet, "/api/admin/users/" + adminID, "", http.StatusOK, `{"id":"` + adminID + `","login":"Admin","role":"admin"}`},
+		{"get_unknown_user", adminID, http.MethodGet, "/api/admin/users/unknown/balance", "", http.StatusNotFound, ""},
+		{"get_orders", adminID, http.MethodGet, "/api/admin/users/" + userID + "/orders", "", http.StatusOK, ""},
+		{"get_balance", adminID, http.MethodGet, "/api/admin/users/" + userID + "/balance", "", http.StatusOK, `{"current":100,"withdrawn":0}`},
+		{"adjust_without_reason", adminID, http.MethodPost, "/api/admin/users/" + userID + "/balance/adjustments", `{"amount":10,"reason":" "}`, http.StatusBadRequest, ""},
+		{"adjust_without_amount", adminID, http.MethodPost, "/api/admin/users/" + userID + "/balance/adjustments", `{"reason":"goodwill"}`, http.StatusBadRequest, ""},
+		{"adjust_below_zero", adminID, http.MethodPost, "/api/admin/users/" + userID + "/balance/adjustments", `{"amount":-100.01,"reason":"fraud"}`, http.StatusPaymentRequired, ""},
+		{"adjust", adminID, http.MethodPost, "/api/admin/users/" + userID + "/balance/adjustments", `{"amount":-20.5,"reason":"duplicate accrual"}`, http.StatusOK, `{"current":79.5,"withdrawn":0}`},
+		{"repoll_unknown_order", adminID, http.MethodPost, "/api/admin/orders/79927398713/repoll", "", http.StatusNotFound, ""},
+		{"repoll_processed_order", adminID, http.MethodPost, "/api/admin/orders/12345678903/repoll", "", http.StatusConflict, ""},
+		{"repoll", adminID, http.MethodPost, "/api/admin/orders/2377225624/repoll", "", http.StatusAccepted, ""},
+		{"bad_audit_limit", adminID, http.MethodGet, "/api/admin/audit?limit=0", "", http.StatusBadRequest, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			result := call(tc.actorID, tc.method, tc.path, tc.body)
+			defer result.Body.Close()
+			assert.Equal(t, tc.wantCode, result.StatusCode)
+			if tc.wantBody != "" {
+				body, err := io.ReadAll(result.Body)
+				require.Nil(t, err)
+				assert.JSONEq(t, tc.wantBody, string(body))
+			}
+		})
+	}
+
+	result := call(adminID, http.MethodGet, "/api/admin/audit?user_id="+userID, "")
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var records []storage.AuditRecord
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&records))
+	actions := make([]string, 0, len(records))
+	for _, record := range records {
+		assert.Equal(t, adminID, record.ActorID)
+		actions = append(actions, record.Action)
+	}
+	assert.Equal(t, []string{
+		storage.AuditOrderRepoll,
+		storage.AuditBalanceAdjustment,
+		storage.AuditBalanceView,
+		storage.AuditOrdersView,
+		storage.AuditUserLookup,
+	}, actions, "only successful actions are recorded")
+	assert.Equal(t, "order 2377225624", records[0].Details)
+	assert.Equal(t, "amount -20.5: duplicate accrual", records[1].Details)
+}
+
+func TestWithdrawalIdempotency(t *testing.T) {
+	memStorage := storage.NewMemStorage(slog.Default())
+	handler := GetHandlerWithStorage(memStorage, nil, testKeys, slog.Default())
+	userID, err := memStorage.Register(context.Background(), storage.UserAuthData{Login: "Customer", Password: "hash"})
+	require.Nil(t, err)
+	require.Nil(t, memStorage.AddOrderForUser(context.Background(), "12345678903", userID))
+	require.Nil(t, memStorage.UpdateOrder(context.Background(), storage.OrderFromBlackBox{Order: "12345678903", Status: "PROCESSED", Accrual: money.FromFloat(100)}))
+	inProgressHash := hashRequest(httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", nil), []byte(`{"order":"79927398713","sum":10}`))
+	require.Nil(t, memStorage.CreateIdempotencyKey(context.Background(), storage.IdempotencyRecord{UserID: userID, Key: "in-progress", RequestHash: inProgressHash}, time.Hour, time.Hour))
+	withdraw := handler.Idempotent(http.HandlerFunc(handler.AddWithdrawal))
+
+	tt := []struct {
+		name         string
+		key          string
+		body         string
+		wantCode     int
+		wantReplayed bool
+	}{
+		{"first", "first-key", `{"order":"2377225624","sum":10}`, http.StatusOK, false},
+		{"retry", "first-key", `{"order":"2377225624","sum":10}`, http.StatusOK, true},
+		{"same_key_another_request", "first-key", `{"order":"79927398713","sum":10}`, http.StatusUnprocessableEntity, false},
+		{"same_order_another_key", "second-key", `{"order":"2377225624","sum":10}`, http.StatusConflict, false},
+		{"same_order_without_key", "", `{"order":"2377225624","sum":10}`, http.StatusConflict, false},
+		{"insufficient_funds", "third-key", `{"order":"79927398713","sum":1000}`, http.StatusPaymentRequired, false},
+		{"insufficient_funds_retry", "third-key", `{"order":"79927398713","sum":1000}`, http.StatusPaymentRequired, true},
+		{"in_progress", "in-progress", `{"order":"79927398713","sum":10}`, http.StatusConflict, false},
+		{"too_long_key", strings.Repeat("k", maxIdempotencyKeyLength+1), `{"order":"79927398713","sum":10}`, http.StatusBadRequest, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := withUser(httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(tc.body)), userID, "")
+			if tc.key != "" {
+				request.Header.Set(idempotencyKeyHeader, tc.key)
+			}
+			w := httptest.NewRecorder()
+			withdraw.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tc.wantCode, result.StatusCode)
+			assert.Equal(t, tc.wantReplayed, result.Header.Get("Idempotent-Replayed") == "true")
+		})
+	}
+	balance, err := memStorage.GetUserBalance(context.Background(), userID)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.UserBalance{Orders: money.FromFloat(90), Withdrawn: money.FromFloat(10)}, balance, "points are withdrawn once")
+}
+
+// failingSaveStorage loses every idempotent response, like a crash right after the withdrawal.
+type failingSaveStorage struct {
+	storage.Storage
+}
+
+func (s failingSaveStorage) SaveIdempotentResponse(ctx context.Context, record storage.IdempotencyRecord) error {
+	return errors.New("connection reset")
+}
+
+func TestWithdrawalIdempotencyFailedSave(t *testing.T) {
+	memStorage := storage.NewMemStorage(slog.Default())
+	handler := GetHandlerWithStorage(failingSaveStorage{memStorage}, nil, testKeys, slog.Default())
+	userID, err := memStorage.Register(context.Background(), storage.UserAuthData{Login: "Customer", Password: "hash"})
+	require.Nil(t, err)
+	require.Nil(t, memStorage.AddOrderForUser(context.Background(), "12345678903", userID))
+	require.Nil(t, memStorage.UpdateOrder(context.Background(), storage.OrderFromBlackBox{Order: "12345678903", Status: "PROCESSED", Accrual: money.FromFloat(100)}))
+	withdraw := handler.Idempotent(http.HandlerFunc(handler.AddWithdrawal))
+	defer func(lease time.Duration) { idempotencyKeyLease = lease }(idempotencyKeyLease)
+	idempotencyKeyLease = 200 * time.Millisecond
+
+	tt := []struct {
+		name        string
+		wait        time.Duration
+		wantCode    int
+		wantProblem string
+	}{
+		{"first", 0, http.StatusOK, ""},
+		{"retry_within_lease", 0, http.StatusConflict, problem.CodeIdempotencyKeyInProgress},
+		{"retry_after_lease", 250 * time.Millisecond, http.StatusConflict, problem.CodeOrderAlreadyPaid},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			time.Sleep(tc.wait)
+			request := withUser(httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(`{"order":"2377225624","sum":10}`)), userID, "")
+			request.Header.Set(idempotencyKeyHeader, "lost-response")
+			w := httptest.NewRecorder()
+			withdraw.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			require.Equal(t, tc.wantCode, result.StatusCode)
+			if tc.wantProblem != "" {
+				var details problem.Details
+				require.Nil(t, json.NewDecoder(result.Body).Decode(&details))
+				assert.Equal(t, tc.wantProblem, details.Code)
+			}
+		})
+	}
+	balance, err := memStorage.GetUserBalance(context.Background(), userID)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.UserBalance{Orders: money.FromFloat(90), Withdrawn: money.FromFloat(10)}, balance, "points are withdrawn once")
+}
+
+func TestListPagination(t *testing.T) {
+	memStorage := storage.NewMemStorage(slog.Default())
+	handler := GetHandlerWithStorage(memStorage, nil, testKeys, slog.Default())
+	userID, err := memStorage.Register(context.Background(), storage.UserAuthData{Login: "Customer", Password: "hash"})
+	require.Nil(t, err)
+	numbers := []string{"12345678903", "2377225624", "79927398713"}
+	for _, number := range numbers {
+		require.Nil(t, memStorage.AddOrderForUser(context.Background(), number, userID))
+		time.Sleep(time.Millisecond)
+	}
+	get := func(handlerFunc http.HandlerFunc, target string) *http.Response {
+		w := httptest.NewRecorder()
+		handlerFunc(w, withUser(httptest.NewRequest(http.MethodGet, target, nil), userID, ""))
+		return w.Result()
+	}
+
+	result := get(handler.GetOrders, "/api/user/orders?limit=2&status=new")
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var orders []storage.Order
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&orders))
+	result.Body.Close()
+	require.Len(t, orders, 2)
+	assert.Equal(t, numbers[:2], []string{orders[0].Number, orders[1].Number})
+	cursor := result.Header.Get("X-Next-Cursor")
+	require.NotEmpty(t, cursor)
+	link := result.Header.Get("Link")
+	assert.True(t, strings.HasPrefix(link, "</api/user/orders?"), link)
+	assert.True(t, strings.HasSuffix(link, `>; rel="next"`), link)
+	assert.Contains(t, link, "after="+cursor)
+	assert.Contains(t, link, "status=new")
+
+	next := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+	result = get(handler.GetOrders, next)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&orders))
+	result.Body.Close()
+	require.Len(t, orders, 1)
+	assert.Equal(t, numbers[2], orders[0].Number)
+	assert.Empty(t, result.Header.Get("Link"), "last page has no next page")
+
+	result = get(handler.GetOrders, "/api/user/orders?status=PROCESSED")
+	result.Body.Close()
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+
+	for _, target := range []string{
+		"/api/user/orders?limit=0",
+		"/api/user/orders?limit=1001",
+		"/api/user/orders?after=garbage",
+		"/api/user/orders?status=DONE",
+		"/api/user/orders?from=yesterday",
+		"/api/user/orders?to=2023-01-01",
+	} {
+		result = get(handler.GetOrders, target)
+		result.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, result.StatusCode, target)
+	}
+	result = get(handler.GetWithdrawals, "/api/user/withdrawals?status=NEW")
+	result.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, result.StatusCode, "withdrawals have no status")
+	result = get(handler.GetWithdrawals, "/api/user/withdrawals?from=2023-01-01T00:00:00Z&limit=10")
+	result.Body.Close()
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+}
@@ -0,0 +1,110 @@
+// Package health serves liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/problem"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// DefaultTimeout bounds all checks of a readiness probe together.
+const DefaultTimeout = 2 * time.Second
+
+// Check is a named dependency check, Run returns nil when the dependency is usable.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Live answers liveness probes, the process is alive as long as it can answer.
+func Live(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, r, http.StatusOK, Report{Status: StatusOK})
+}
+
+// Checker answers readiness probes by running all checks concurrently.
+type Checker struct {
+	checks  []Check
+	timeout time.Duration
+	logger  *slog.Logger
+}
+
+func NewChecker(timeout time.Duration, logger *slog.Logger, checks ...Check) *Checker {
+	return &Checker{checks: checks, timeout: timeout, logger: logger}
+}
+
+// Run returns the report of all checks, its status is ok only when every check passed.
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			started := time.Now()
+			err := check.Run(ctx)
+			result := CheckResult{Status: StatusOK, Duration: time.Since(started).String()}
+			if err != nil {
+				result.Status = StatusUnavailable
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if err != nil {
+				report.Status = StatusUnavailable
+			}
+		}(check)
+	}
+	wg.Wait()
+	return report
+}
+
+// Ready answers readiness probes with 200 when all checks passed and 503 otherwise.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+		for name, result := range report.Checks {
+			if result.Status != StatusOK {
+				c.logger.WarnContext(r.Context(), "Readiness check failed", "check", name, "error", result.Error)
+			}
+		}
+	}
+	writeReport(w, r, status, report)
+}
+
+func writeReport(w http.ResponseWriter, r *http.Request, status int, report Report) {
+	reportMarshalled, err := json.Marshal(report)
+	if err != nil {
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Could not marshal health report")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(reportMarshalled)
+}
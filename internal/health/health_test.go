@@ -0,0 +1,75 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLive(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	Live(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status":"ok"}`, recorder.Body.String())
+}
+
+func TestReady(t *testing.T) {
+	passing := Check{Name: "database", Run: func(ctx context.Context) error { return nil }}
+	failing := Check{Name: "accrual_system", Run: func(ctx context.Context) error { return errors.New("connection refused") }}
+	hanging := Check{Name: "accrual_poller", Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	tests := []struct {
+		name       string
+		checks     []Check
+		wantStatus int
+		wantChecks map[string]string
+		wantError  map[string]string
+	}{
+		{"no_checks", nil, http.StatusOK, map[string]string{}, map[string]string{}},
+		{"all_passed", []Check{passing}, http.StatusOK, map[string]string{"database": StatusOK}, map[string]string{}},
+		{
+			"one_failed",
+			[]Check{passing, failing},
+			http.StatusServiceUnavailable,
+			map[string]string{"database": StatusOK, "accrual_system": StatusUnavailable},
+			map[string]string{"accrual_system": "connection refused"},
+		},
+		{
+			"timed_out",
+			[]Check{passing, hanging},
+			http.StatusServiceUnavailable,
+			map[string]string{"database": StatusOK, "accrual_poller": StatusUnavailable},
+			map[string]string{"accrual_poller": context.DeadlineExceeded.Error()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker(50*time.Millisecond, slog.Default(), tt.checks...)
+			recorder := httptest.NewRecorder()
+			checker.Ready(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tt.wantStatus, recorder.Code)
+			var report Report
+			require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, StatusOK, report.Status)
+			} else {
+				assert.Equal(t, StatusUnavailable, report.Status)
+			}
+			require.Len(t, report.Checks, len(tt.wantChecks))
+			for name, status := range tt.wantChecks {
+				assert.Equal(t, status, report.Checks[name].Status, name)
+				assert.Equal(t, tt.wantError[name], report.Checks[name].Error, name)
+			}
+		})
+	}
+}
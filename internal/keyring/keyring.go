@@ -0,0 +1,144 @@
+package keyring
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MinSecretLength is the shortest secret accepted for a signing key.
+const MinSecretLength = 16
+
+var ErrNoKeys = errors.New("no signing keys configured")
+var ErrInvalidKey = errors.New("invalid signing key")
+
+// Key is an HMAC-SHA256 secret identified by ID, the ID is embedded in every
+// signed token, so the key can be found again after rotation.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring signs with the active key and verifies with any known key, so old
+// keys can be kept around until tokens signed by them expire.
+type Keyring struct {
+	active Key
+	keys   map[string]Key
+}
+
+// New returns a Keyring with the first key active and the rest accepted for verification only.
+func New(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	keyring := &Keyring{active: keys[0], keys: make(map[string]Key, len(keys))}
+	for _, key := range keys {
+		if !validID(key.ID) {
+			return nil, fmt.Errorf("%w: bad key id %q", ErrInvalidKey, key.ID)
+		}
+		if len(key.Secret) < MinSecretLength {
+			return nil, fmt.Errorf("%w: secret of key %q is shorter than %d bytes", ErrInvalidKey, key.ID, MinSecretLength)
+		}
+		if _, ok := keyring.keys[key.ID]; ok {
+			return nil, fmt.Errorf("%w: duplicate key id %q", ErrInvalidKey, key.ID)
+		}
+		keyring.keys[key.ID] = key
+	}
+	return keyring, nil
+}
+
+// Parse reads keys in the form id:secret separated by commas or new lines,
+// the first key is active. Empty lines and lines starting with # are skipped.
+func Parse(spec string) (*Keyring, error) {
+	keys := make([]Key, 0)
+	for _, line := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, secret, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("%w: expected id:secret", ErrInvalidKey)
+		}
+		keys = append(keys, Key{ID: id, Secret: []byte(secret)})
+	}
+	return New(keys...)
+}
+
+// Load parses keys from the file at path if it is set, otherwise from spec.
+func Load(spec string, path string) (*Keyring, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read signing keys: %w", err)
+		}
+		spec = string(data)
+	}
+	return Parse(spec)
+}
+
+// Generate returns a Keyring with a single random key.
+func Generate() (*Keyring, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return New(Key{ID: hex.EncodeToString(id), Secret: secret})
+}
+
+// ActiveID returns the ID of the key used for signing.
+func (k *Keyring) ActiveID() string {
+	return k.active.ID
+}
+
+// Active returns the key used for signing.
+func (k *Keyring) Active() Key {
+	return k.active
+}
+
+// Secret returns the secret of the key kid for verification.
+func (k *Keyring) Secret(kid string) ([]byte, bool) {
+	key, ok := k.keys[kid]
+	return key.Secret, ok
+}
+
+// Sign returns the ID of the active key and the MAC of payload.
+func (k *Keyring) Sign(payload []byte) (string, []byte) {
+	return k.active.ID, mac(k.active.Secret, payload)
+}
+
+// Verify checks the MAC of payload with the key kid, unknown keys never match.
+func (k *Keyring) Verify(kid string, payload []byte, sign []byte) bool {
+	key, ok := k.keys[kid]
+	if !ok {
+		return false
+	}
+	return hmac.Equal(mac(key.Secret, payload), sign)
+}
+
+func mac(secret []byte, payload []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package keyring
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	keys, err := Parse("new:0123456789abcdef0123, old:fedcba9876543210fedc")
+	require.Nil(t, err)
+	assert.Equal(t, "new", keys.ActiveID())
+	assert.Len(t, keys.keys, 2)
+	assert.Equal(t, []byte("fedcba9876543210fedc"), keys.keys["old"].Secret)
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		err  error
+	}{
+		{"empty", "", ErrNoKeys},
+		{"only_comments", "# no keys yet\n\n", ErrNoKeys},
+		{"no_id", "0123456789abcdef0123", ErrInvalidKey},
+		{"empty_id", ":0123456789abcdef0123", ErrInvalidKey},
+		{"bad_id", "key.1:0123456789abcdef0123", ErrInvalidKey},
+		{"short_secret", "key:short", ErrInvalidKey},
+		{"duplicate_id", "key:0123456789abcdef0123,key:fedcba9876543210fedc", ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.spec)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestLoadFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.Nil(t, os.WriteFile(path, []byte("# active key first\nnew:0123456789abcdef0123\nold:fedcba9876543210fedc\n"), 0600))
+	keys, err := Load("ignored:0123456789abcdef0123", path)
+	require.Nil(t, err)
+	assert.Equal(t, "new", keys.ActiveID())
+
+	_, err = Load("", filepath.Join(t.TempDir(), "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestSignAndVerifyAfterRotation(t *testing.T) {
+	oldKeys, err := Parse("old:fedcba9876543210fedc")
+	require.Nil(t, err)
+	oldKid, oldSign := oldKeys.Sign([]byte("payload"))
+	assert.Equal(t, "old", oldKid)
+
+	keys, err := Parse("new:0123456789abcdef0123,old:fedcba9876543210fedc")
+	require.Nil(t, err)
+	kid, sign := keys.Sign([]byte("payload"))
+	assert.Equal(t, "new", kid)
+	assert.True(t, keys.Verify(kid, []byte("payload"), sign))
+	assert.True(t, keys.Verify(oldKid, []byte("payload"), oldSign), "tokens signed by previous keys must stay valid")
+	assert.False(t, keys.Verify(kid, []byte("another payload"), sign))
+	assert.False(t, keys.Verify(oldKid, []byte("payload"), sign))
+	assert.False(t, keys.Verify("unknown", []byte("payload"), sign))
+
+	assert.False(t, oldKeys.Verify(kid, []byte("payload"), sign), "removed keys must not verify")
+}
+
+func TestGenerate(t *testing.T) {
+	keys, err := Generate()
+	require.Nil(t, err)
+	anotherKeys, err := Generate()
+	require.Nil(t, err)
+	kid, sign := keys.Sign([]byte("payload"))
+	assert.True(t, keys.Verify(kid, []byte("payload"), sign))
+	assert.False(t, anotherKeys.Verify(kid, []byte("payload"), sign))
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(Middleware)
+	router.Get("/api/admin/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	router.Post("/api/user/orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		route  string
+		status string
+	}{
+		{"route_pattern", http.MethodGet, "/api/admin/users/42", "/api/admin/users/{id}", "418"},
+		{"same_route_other_id", http.MethodGet, "/api/admin/users/43", "/api/admin/users/{id}", "418"},
+		{"implicit_ok", http.MethodPost, "/api/user/orders", "/api/user/orders", "200"},
+		{"not_found", http.MethodGet, "/random/path", unmatchedRoute, "404"},
+		{"method_not_allowed", http.MethodDelete, "/api/user/orders", unmatchedRoute, "405"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := HTTPRequests.WithLabelValues(tt.method, tt.route, tt.status)
+			before := testutil.ToFloat64(counter)
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+			assert.Equal(t, before+1, testutil.ToFloat64(counter))
+		})
+	}
+}
+
+func TestObserveDBQuery(t *testing.T) {
+	ObserveDBQuery("TestObserveDBQuery", time.Now())
+	assert.Equal(t, 1, testutil.CollectAndCount(DBQueryDuration, namespace+"_db_query_duration_seconds"))
+}
+
+func TestHandler(t *testing.T) {
+	Registrations.Inc()
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	body, err := io.ReadAll(recorder.Body)
+	require.Nil(t, err)
+	for _, name := range []string{
+		"gophermart_registrations_total",
+		"gophermart_accrual_queue_depth",
+		"gophermart_accrual_orders_in_flight",
+		"gophermart_accrual_rate_limited_total",
+		"gophermart_accrual_retries_total",
+		"gophermart_accrued_points_total",
+		"gophermart_withdrawn_points_total",
+		"go_goroutines",
+	} {
+		assert.True(t, strings.Contains(string(body), name), name)
+	}
+}
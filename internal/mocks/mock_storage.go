@@ -5,7 +5,9 @@
 package mocks
 
 import (
+	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	storage "github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
@@ -34,134 +36,640 @@ func (m *MockStorage) EXPECT() *MockStorageMockRecorder {
 	return m.recorder
 }
 
+// AddAccrualJob mocks base method.
+func (m *MockStorage) AddAccrualJob(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddAccrualJob", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddAccrualJob indicates an expected call of AddAccrualJob.
+func (mr *MockStorageMockRecorder) AddAccrualJob(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddAccrualJob", reflect.TypeOf((*MockStorage)(nil).AddAccrualJob), arg0, arg1)
+}
+
+// AddAuditRecord mocks base method.
+func (m *MockStorage) AddAuditRecord(arg0 context.Context, arg1 storage.AuditRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddAuditRecord", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddAuditRecord indicates an expected call of AddAuditRecord.
+func (mr *MockStorageMockRecorder) AddAuditRecord(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddAuditRecord", reflect.TypeOf((*MockStorage)(nil).AddAuditRecord), arg0, arg1)
+}
+
+// AddLoginLockout mocks base method.
+func (m *MockStorage) AddLoginLockout(arg0 context.Context, arg1 storage.LoginLockout, arg2 time.Duration) (storage.LoginLockout, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddLoginLockout", arg0, arg1, arg2)
+	ret0, _ := ret[0].(storage.LoginLockout)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddLoginLockout indicates an expected call of AddLoginLockout.
+func (mr *MockStorageMockRecorder) AddLoginLockout(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddLoginLockout", reflect.TypeOf((*MockStorage)(nil).AddLoginLockout), arg0, arg1, arg2)
+}
+
 // AddOrderForUser mocks base method.
-func (m *MockStorage) AddOrderForUser(arg0, arg1 string) int {
+func (m *MockStorage) AddOrderForUser(arg0 context.Context, arg1, arg2 string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddOrderForUser", arg0, arg1)
-	ret0, _ := ret[0].(int)
+	ret := m.ctrl.Call(m, "AddOrderForUser", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // AddOrderForUser indicates an expected call of AddOrderForUser.
-func (mr *MockStorageMockRecorder) AddOrderForUser(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) AddOrderForUser(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrderForUser", reflect.TypeOf((*MockStorage)(nil).AddOrderForUser), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrderForUser", reflect.TypeOf((*MockStorage)(nil).AddOrderForUser), arg0, arg1, arg2)
 }
 
 // AddWithdrawalForUser mocks base method.
-func (m *MockStorage) AddWithdrawalForUser(arg0 string, arg1 storage.Withdrawal) int {
+func (m *MockStorage) AddWithdrawalForUser(arg0 context.Context, arg1 string, arg2 storage.Withdrawal) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddWithdrawalForUser", arg0, arg1)
-	ret0, _ := ret[0].(int)
+	ret := m.ctrl.Call(m, "AddWithdrawalForUser", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // AddWithdrawalForUser indicates an expected call of AddWithdrawalForUser.
-func (mr *MockStorageMockRecorder) AddWithdrawalForUser(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) AddWithdrawalForUser(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddWithdrawalForUser", reflect.TypeOf((*MockStorage)(nil).AddWithdrawalForUser), arg0, arg1, arg2)
+}
+
+// AdjustBalance mocks base method.
+func (m *MockStorage) AdjustBalance(arg0 context.Context, arg1 storage.BalanceAdjustment) (storage.UserBalance, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AdjustBalance", arg0, arg1)
+	ret0, _ := ret[0].(storage.UserBalance)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AdjustBalance indicates an expected call of AdjustBalance.
+func (mr *MockStorageMockRecorder) AdjustBalance(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AdjustBalance", reflect.TypeOf((*MockStorage)(nil).AdjustBalance), arg0, arg1)
+}
+
+// ClaimAccrualJobs mocks base method.
+func (m *MockStorage) ClaimAccrualJobs(arg0 context.Context, arg1 int, arg2 time.Duration) ([]storage.AccrualJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimAccrualJobs", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]storage.AccrualJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimAccrualJobs indicates an expected call of ClaimAccrualJobs.
+func (mr *MockStorageMockRecorder) ClaimAccrualJobs(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimAccrualJobs", reflect.TypeOf((*MockStorage)(nil).ClaimAccrualJobs), arg0, arg1, arg2)
+}
+
+// Close mocks base method.
+func (m *MockStorage) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockStorageMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockStorage)(nil).Close))
+}
+
+// CompleteAccrualJob mocks base method.
+func (m *MockStorage) CompleteAccrualJob(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompleteAccrualJob", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CompleteAccrualJob indicates an expected call of CompleteAccrualJob.
+func (mr *MockStorageMockRecorder) CompleteAccrualJob(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteAccrualJob", reflect.TypeOf((*MockStorage)(nil).CompleteAccrualJob), arg0, arg1)
+}
+
+// ConfirmTOTP mocks base method.
+func (m *MockStorage) ConfirmTOTP(arg0 context.Context, arg1 string, arg2 int64, arg3 []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConfirmTOTP", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ConfirmTOTP indicates an expected call of ConfirmTOTP.
+func (mr *MockStorageMockRecorder) ConfirmTOTP(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConfirmTOTP", reflect.TypeOf((*MockStorage)(nil).ConfirmTOTP), arg0, arg1, arg2, arg3)
+}
+
+// CreateIdempotencyKey mocks base method.
+func (m *MockStorage) CreateIdempotencyKey(arg0 context.Context, arg1 storage.IdempotencyRecord, arg2, arg3 time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateIdempotencyKey", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateIdempotencyKey indicates an expected call of CreateIdempotencyKey.
+func (mr *MockStorageMockRecorder) CreateIdempotencyKey(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).CreateIdempotencyKey), arg0, arg1, arg2, arg3)
+}
+
+// CreatePasswordResetToken mocks base method.
+func (m *MockStorage) CreatePasswordResetToken(arg0 context.Context, arg1, arg2 string, arg3 time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreatePasswordResetToken", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreatePasswordResetToken indicates an expected call of CreatePasswordResetToken.
+func (mr *MockStorageMockRecorder) CreatePasswordResetToken(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreatePasswordResetToken", reflect.TypeOf((*MockStorage)(nil).CreatePasswordResetToken), arg0, arg1, arg2, arg3)
+}
+
+// CreateSession mocks base method.
+func (m *MockStorage) CreateSession(arg0 context.Context, arg1 storage.Session, arg2 time.Duration) (storage.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSession", arg0, arg1, arg2)
+	ret0, _ := ret[0].(storage.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateSession indicates an expected call of CreateSession.
+func (mr *MockStorageMockRecorder) CreateSession(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSession", reflect.TypeOf((*MockStorage)(nil).CreateSession), arg0, arg1, arg2)
+}
+
+// DeleteIdempotencyKey mocks base method.
+func (m *MockStorage) DeleteIdempotencyKey(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteIdempotencyKey", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteIdempotencyKey indicates an expected call of DeleteIdempotencyKey.
+func (mr *MockStorageMockRecorder) DeleteIdempotencyKey(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).DeleteIdempotencyKey), arg0, arg1, arg2)
+}
+
+// GetAuditRecords mocks base method.
+func (m *MockStorage) GetAuditRecords(arg0 context.Context, arg1 string, arg2 int) ([]storage.AuditRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAuditRecords", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]storage.AuditRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAuditRecords indicates an expected call of GetAuditRecords.
+func (mr *MockStorageMockRecorder) GetAuditRecords(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAuditRecords", reflect.TypeOf((*MockStorage)(nil).GetAuditRecords), arg0, arg1, arg2)
+}
+
+// GetIdempotencyKey mocks base method.
+func (m *MockStorage) GetIdempotencyKey(arg0 context.Context, arg1, arg2 string) (storage.IdempotencyRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetIdempotencyKey", arg0, arg1, arg2)
+	ret0, _ := ret[0].(storage.IdempotencyRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetIdempotencyKey indicates an expected call of GetIdempotencyKey.
+func (mr *MockStorageMockRecorder) GetIdempotencyKey(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).GetIdempotencyKey), arg0, arg1, arg2)
+}
+
+// GetLoginFailures mocks base method.
+func (m *MockStorage) GetLoginFailures(arg0 context.Context, arg1, arg2 string, arg3 time.Duration) (storage.LoginFailures, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLoginFailures", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(storage.LoginFailures)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLoginFailures indicates an expected call of GetLoginFailures.
+func (mr *MockStorageMockRecorder) GetLoginFailures(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddWithdrawalForUser", reflect.TypeOf((*MockStorage)(nil).AddWithdrawalForUser), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLoginFailures", reflect.TypeOf((*MockStorage)(nil).GetLoginFailures), arg0, arg1, arg2, arg3)
+}
+
+// GetLoginLockout mocks base method.
+func (m *MockStorage) GetLoginLockout(arg0 context.Context, arg1, arg2 string) (storage.LoginLockout, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLoginLockout", arg0, arg1, arg2)
+	ret0, _ := ret[0].(storage.LoginLockout)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLoginLockout indicates an expected call of GetLoginLockout.
+func (mr *MockStorageMockRecorder) GetLoginLockout(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLoginLockout", reflect.TypeOf((*MockStorage)(nil).GetLoginLockout), arg0, arg1, arg2)
 }
 
 // GetOrdersByUser mocks base method.
-func (m *MockStorage) GetOrdersByUser(arg0 string) ([]storage.Order, int) {
+func (m *MockStorage) GetOrdersByUser(arg0 context.Context, arg1 string, arg2 storage.ListQuery) ([]storage.Order, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetOrdersByUser", arg0)
+	ret := m.ctrl.Call(m, "GetOrdersByUser", arg0, arg1, arg2)
 	ret0, _ := ret[0].([]storage.Order)
-	ret1, _ := ret[1].(int)
+	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetOrdersByUser indicates an expected call of GetOrdersByUser.
-func (mr *MockStorageMockRecorder) GetOrdersByUser(arg0 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) GetOrdersByUser(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrdersByUser", reflect.TypeOf((*MockStorage)(nil).GetOrdersByUser), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrdersByUser", reflect.TypeOf((*MockStorage)(nil).GetOrdersByUser), arg0, arg1, arg2)
 }
 
 // GetOrdersInProgress mocks base method.
-func (m *MockStorage) GetOrdersInProgress() ([]storage.Order, int) {
+func (m *MockStorage) GetOrdersInProgress(arg0 context.Context) ([]storage.Order, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetOrdersInProgress")
+	ret := m.ctrl.Call(m, "GetOrdersInProgress", arg0)
 	ret0, _ := ret[0].([]storage.Order)
-	ret1, _ := ret[1].(int)
+	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetOrdersInProgress indicates an expected call of GetOrdersInProgress.
-func (mr *MockStorageMockRecorder) GetOrdersInProgress() *gomock.Call {
+func (mr *MockStorageMockRecorder) GetOrdersInProgress(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrdersInProgress", reflect.TypeOf((*MockStorage)(nil).GetOrdersInProgress), arg0)
+}
+
+// GetSessionsForUser mocks base method.
+func (m *MockStorage) GetSessionsForUser(arg0 context.Context, arg1 string) ([]storage.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSessionsForUser", arg0, arg1)
+	ret0, _ := ret[0].([]storage.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSessionsForUser indicates an expected call of GetSessionsForUser.
+func (mr *MockStorageMockRecorder) GetSessionsForUser(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSessionsForUser", reflect.TypeOf((*MockStorage)(nil).GetSessionsForUser), arg0, arg1)
+}
+
+// GetTOTP mocks base method.
+func (m *MockStorage) GetTOTP(arg0 context.Context, arg1 string) (storage.TOTP, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTOTP", arg0, arg1)
+	ret0, _ := ret[0].(storage.TOTP)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTOTP indicates an expected call of GetTOTP.
+func (mr *MockStorageMockRecorder) GetTOTP(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrdersInProgress", reflect.TypeOf((*MockStorage)(nil).GetOrdersInProgress))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTOTP", reflect.TypeOf((*MockStorage)(nil).GetTOTP), arg0, arg1)
 }
 
 // GetUserBalance mocks base method.
-func (m *MockStorage) GetUserBalance(arg0 string) (storage.UserBalance, int) {
+func (m *MockStorage) GetUserBalance(arg0 context.Context, arg1 string) (storage.UserBalance, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserBalance", arg0)
+	ret := m.ctrl.Call(m, "GetUserBalance", arg0, arg1)
 	ret0, _ := ret[0].(storage.UserBalance)
-	ret1, _ := ret[1].(int)
+	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetUserBalance indicates an expected call of GetUserBalance.
-func (mr *MockStorageMockRecorder) GetUserBalance(arg0 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) GetUserBalance(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalance", reflect.TypeOf((*MockStorage)(nil).GetUserBalance), arg0, arg1)
+}
+
+// GetUserByID mocks base method.
+func (m *MockStorage) GetUserByID(arg0 context.Context, arg1 string) (storage.UserAuthData, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserByID", arg0, arg1)
+	ret0, _ := ret[0].(storage.UserAuthData)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserByID indicates an expected call of GetUserByID.
+func (mr *MockStorageMockRecorder) GetUserByID(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalance", reflect.TypeOf((*MockStorage)(nil).GetUserBalance), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByID", reflect.TypeOf((*MockStorage)(nil).GetUserByID), arg0, arg1)
 }
 
 // GetUserByLogin mocks base method.
-func (m *MockStorage) GetUserByLogin(arg0 storage.UserAuthData) (storage.UserAuthData, int) {
+func (m *MockStorage) GetUserByLogin(arg0 context.Context, arg1 storage.UserAuthData) (storage.UserAuthData, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserByLogin", arg0)
+	ret := m.ctrl.Call(m, "GetUserByLogin", arg0, arg1)
 	ret0, _ := ret[0].(storage.UserAuthData)
-	ret1, _ := ret[1].(int)
+	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetUserByLogin indicates an expected call of GetUserByLogin.
-func (mr *MockStorageMockRecorder) GetUserByLogin(arg0 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) GetUserByLogin(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByLogin", reflect.TypeOf((*MockStorage)(nil).GetUserByLogin), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByLogin", reflect.TypeOf((*MockStorage)(nil).GetUserByLogin), arg0, arg1)
 }
 
 // GetWithdrawalsForUser mocks base method.
-func (m *MockStorage) GetWithdrawalsForUser(arg0 string) ([]storage.Withdrawal, int) {
+func (m *MockStorage) GetWithdrawalsForUser(arg0 context.Context, arg1 string, arg2 storage.ListQuery) ([]storage.Withdrawal, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetWithdrawalsForUser", arg0)
+	ret := m.ctrl.Call(m, "GetWithdrawalsForUser", arg0, arg1, arg2)
 	ret0, _ := ret[0].([]storage.Withdrawal)
-	ret1, _ := ret[1].(int)
+	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetWithdrawalsForUser indicates an expected call of GetWithdrawalsForUser.
-func (mr *MockStorageMockRecorder) GetWithdrawalsForUser(arg0 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) GetWithdrawalsForUser(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithdrawalsForUser", reflect.TypeOf((*MockStorage)(nil).GetWithdrawalsForUser), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithdrawalsForUser", reflect.TypeOf((*MockStorage)(nil).GetWithdrawalsForUser), arg0, arg1, arg2)
+}
+
+// Ping mocks base method.
+func (m *MockStorage) Ping(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Ping", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Ping indicates an expected call of Ping.
+func (mr *MockStorageMockRecorder) Ping(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockStorage)(nil).Ping), arg0)
+}
+
+// RecordLoginAttempt mocks base method.
+func (m *MockStorage) RecordLoginAttempt(arg0 context.Context, arg1, arg2 string, arg3 bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordLoginAttempt", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordLoginAttempt indicates an expected call of RecordLoginAttempt.
+func (mr *MockStorageMockRecorder) RecordLoginAttempt(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordLoginAttempt", reflect.TypeOf((*MockStorage)(nil).RecordLoginAttempt), arg0, arg1, arg2, arg3)
 }
 
 // Register mocks base method.
-func (m *MockStorage) Register(arg0 storage.UserAuthData) (string, int) {
+func (m *MockStorage) Register(arg0 context.Context, arg1 storage.UserAuthData) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Register", arg0)
+	ret := m.ctrl.Call(m, "Register", arg0, arg1)
 	ret0, _ := ret[0].(string)
-	ret1, _ := ret[1].(int)
+	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Register indicates an expected call of Register.
-func (mr *MockStorageMockRecorder) Register(arg0 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) Register(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Register", reflect.TypeOf((*MockStorage)(nil).Register), arg0, arg1)
+}
+
+// RequeueAccrualJob mocks base method.
+func (m *MockStorage) RequeueAccrualJob(arg0 context.Context, arg1 string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequeueAccrualJob", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RequeueAccrualJob indicates an expected call of RequeueAccrualJob.
+func (mr *MockStorageMockRecorder) RequeueAccrualJob(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueAccrualJob", reflect.TypeOf((*MockStorage)(nil).RequeueAccrualJob), arg0, arg1)
+}
+
+// RescheduleAccrualJob mocks base method.
+func (m *MockStorage) RescheduleAccrualJob(arg0 context.Context, arg1 string, arg2 time.Duration, arg3 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RescheduleAccrualJob", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RescheduleAccrualJob indicates an expected call of RescheduleAccrualJob.
+func (mr *MockStorageMockRecorder) RescheduleAccrualJob(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RescheduleAccrualJob", reflect.TypeOf((*MockStorage)(nil).RescheduleAccrualJob), arg0, arg1, arg2, arg3)
+}
+
+// RevokeOtherSessions mocks base method.
+func (m *MockStorage) RevokeOtherSessions(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeOtherSessions", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeOtherSessions indicates an expected call of RevokeOtherSessions.
+func (mr *MockStorageMockRecorder) RevokeOtherSessions(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeOtherSessions", reflect.TypeOf((*MockStorage)(nil).RevokeOtherSessions), arg0, arg1, arg2)
+}
+
+// RevokeSession mocks base method.
+func (m *MockStorage) RevokeSession(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeSession", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeSession indicates an expected call of RevokeSession.
+func (mr *MockStorageMockRecorder) RevokeSession(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeSession", reflect.TypeOf((*MockStorage)(nil).RevokeSession), arg0, arg1, arg2)
+}
+
+// SaveIdempotentResponse mocks base method.
+func (m *MockStorage) SaveIdempotentResponse(arg0 context.Context, arg1 storage.IdempotencyRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveIdempotentResponse", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveIdempotentResponse indicates an expected call of SaveIdempotentResponse.
+func (mr *MockStorageMockRecorder) SaveIdempotentResponse(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveIdempotentResponse", reflect.TypeOf((*MockStorage)(nil).SaveIdempotentResponse), arg0, arg1)
+}
+
+// SchemaVersion mocks base method.
+func (m *MockStorage) SchemaVersion(arg0 context.Context) (uint, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SchemaVersion", arg0)
+	ret0, _ := ret[0].(uint)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// SchemaVersion indicates an expected call of SchemaVersion.
+func (mr *MockStorageMockRecorder) SchemaVersion(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SchemaVersion", reflect.TypeOf((*MockStorage)(nil).SchemaVersion), arg0)
+}
+
+// SetTOTPSecret mocks base method.
+func (m *MockStorage) SetTOTPSecret(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTOTPSecret", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTOTPSecret indicates an expected call of SetTOTPSecret.
+func (mr *MockStorageMockRecorder) SetTOTPSecret(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Register", reflect.TypeOf((*MockStorage)(nil).Register), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTOTPSecret", reflect.TypeOf((*MockStorage)(nil).SetTOTPSecret), arg0, arg1, arg2)
+}
+
+// SetUserRole mocks base method.
+func (m *MockStorage) SetUserRole(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserRole", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetUserRole indicates an expected call of SetUserRole.
+func (mr *MockStorageMockRecorder) SetUserRole(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserRole", reflect.TypeOf((*MockStorage)(nil).SetUserRole), arg0, arg1, arg2)
+}
+
+// TouchSession mocks base method.
+func (m *MockStorage) TouchSession(arg0 context.Context, arg1 string) (storage.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TouchSession", arg0, arg1)
+	ret0, _ := ret[0].(storage.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TouchSession indicates an expected call of TouchSession.
+func (mr *MockStorageMockRecorder) TouchSession(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TouchSession", reflect.TypeOf((*MockStorage)(nil).TouchSession), arg0, arg1)
 }
 
 // UpdateOrder mocks base method.
-func (m *MockStorage) UpdateOrder(arg0 storage.OrderFromBlackBox) int {
+func (m *MockStorage) UpdateOrder(arg0 context.Context, arg1 storage.OrderFromBlackBox) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateOrder", arg0)
-	ret0, _ := ret[0].(int)
+	ret := m.ctrl.Call(m, "UpdateOrder", arg0, arg1)
+	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // UpdateOrder indicates an expected call of UpdateOrder.
-func (mr *MockStorageMockRecorder) UpdateOrder(arg0 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) UpdateOrder(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateOrder", reflect.TypeOf((*MockStorage)(nil).UpdateOrder), arg0, arg1)
+}
+
+// UpdatePasswordHash mocks base method.
+func (m *MockStorage) UpdatePasswordHash(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdatePasswordHash", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdatePasswordHash indicates an expected call of UpdatePasswordHash.
+func (mr *MockStorageMockRecorder) UpdatePasswordHash(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdatePasswordHash", reflect.TypeOf((*MockStorage)(nil).UpdatePasswordHash), arg0, arg1, arg2)
+}
+
+// UsePasswordResetToken mocks base method.
+func (m *MockStorage) UsePasswordResetToken(arg0 context.Context, arg1 string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UsePasswordResetToken", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UsePasswordResetToken indicates an expected call of UsePasswordResetToken.
+func (mr *MockStorageMockRecorder) UsePasswordResetToken(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UsePasswordResetToken", reflect.TypeOf((*MockStorage)(nil).UsePasswordResetToken), arg0, arg1)
+}
+
+// UseRecoveryCode mocks base method.
+func (m *MockStorage) UseRecoveryCode(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseRecoveryCode", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UseRecoveryCode indicates an expected call of UseRecoveryCode.
+func (mr *MockStorageMockRecorder) UseRecoveryCode(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseRecoveryCode", reflect.TypeOf((*MockStorage)(nil).UseRecoveryCode), arg0, arg1, arg2)
+}
+
+// UseTOTPStep mocks base method.
+func (m *MockStorage) UseTOTPStep(arg0 context.Context, arg1 string, arg2 int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseTOTPStep", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UseTOTPStep indicates an expected call of UseTOTPStep.
+func (mr *MockStorageMockRecorder) UseTOTPStep(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseTOTPStep", reflect.TypeOf((*MockStorage)(nil).UseTOTPStep), arg0, arg1, arg2)
+}
+
+// VerifyLedger mocks base method.
+func (m *MockStorage) VerifyLedger(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "VerifyLedger", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// VerifyLedger indicates an expected call of VerifyLedger.
+func (mr *MockStorageMockRecorder) VerifyLedger(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateOrder", reflect.TypeOf((*MockStorage)(nil).UpdateOrder), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VerifyLedger", reflect.TypeOf((*MockStorage)(nil).VerifyLedger), arg0)
 }
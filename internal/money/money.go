@@ -0,0 +1,140 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amount is an exact amount of loyalty points stored in hundredths (kopecks).
+// It is rendered in JSON and SQL as a decimal number like 729.98.
+type Amount int64
+
+const scale = 100
+
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// FromFloat rounds a float value to the nearest hundredth, halves away from zero.
+func FromFloat(value float64) Amount {
+	return Amount(math.Round(value * scale))
+}
+
+// Parse converts a decimal string with up to two fractional digits into Amount,
+// it is strict and meant for user input, amounts of other systems use FromFloat.
+func Parse(value string) (Amount, error) {
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "-"), "+")
+	intPart, fracPart, hasFrac := strings.Cut(value, ".")
+	if intPart == "" && fracPart == "" {
+		return 0, ErrInvalidAmount
+	}
+	if hasFrac {
+		fracPart = strings.TrimRight(fracPart, "0")
+	}
+	if len(fracPart) > 2 {
+		return 0, fmt.Errorf("%w: more than two fractional digits in %s", ErrInvalidAmount, value)
+	}
+	if !isDigits(intPart) || !isDigits(fracPart) {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidAmount, value)
+	}
+	var units int64
+	if intPart != "" {
+		var err error
+		units, err = strconv.ParseInt(intPart, 10, 64)
+		if err != nil || units > math.MaxInt64/scale {
+			return 0, fmt.Errorf("%w: %s is out of range", ErrInvalidAmount, value)
+		}
+	}
+	cents := int64(0)
+	if fracPart != "" {
+		cents, _ = strconv.ParseInt((fracPart + "0")[:2], 10, 64)
+	}
+	result := units*scale + cents
+	if negative {
+		result = -result
+	}
+	return Amount(result), nil
+}
+
+func isDigits(value string) bool {
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (a Amount) Float64() float64 {
+	return float64(a) / scale
+}
+
+// String renders the amount without trailing zeros: 500, 500.5, 729.98.
+func (a Amount) String() string {
+	sign := ""
+	value := int64(a)
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	units, cents := value/scale, value%scale
+	if cents == 0 {
+		return fmt.Sprintf("%s%d", sign, units)
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%02d", sign, units, cents), "0")
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		return nil
+	}
+	value = strings.Trim(value, `"`)
+	parsed, err := Parse(value)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner, NULL is scanned as zero amount.
+func (a *Amount) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*a = 0
+	case int64:
+		*a = Amount(value * scale)
+	case float64:
+		*a = FromFloat(value)
+	case []byte:
+		return a.scanString(string(value))
+	case string:
+		return a.scanString(value)
+	default:
+		return fmt.Errorf("%w: can not scan %T", ErrInvalidAmount, src)
+	}
+	return nil
+}
+
+func (a *Amount) scanString(value string) error {
+	parsed, err := Parse(value)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Value implements driver.Valuer, the amount is sent as a decimal string for numeric columns.
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
@@ -0,0 +1,80 @@
+package money
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value   string
+		result  Amount
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"500", 50000, false},
+		{"500.5", 50050, false},
+		{"729.98", 72998, false},
+		{"729.980", 72998, false},
+		{".5", 50, false},
+		{"-42.01", -4201, false},
+		{"1.001", 0, true},
+		{"abc", 0, true},
+		{"1e3", 0, true},
+		{"", 0, true},
+		{"99999999999999999999", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			result, err := Parse(tt.value)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.result, result)
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "0", Amount(0).String())
+	assert.Equal(t, "500", Amount(50000).String())
+	assert.Equal(t, "500.5", Amount(50050).String())
+	assert.Equal(t, "729.98", Amount(72998).String())
+	assert.Equal(t, "0.05", Amount(5).String())
+	assert.Equal(t, "-42.01", Amount(-4201).String())
+}
+
+func TestJSON(t *testing.T) {
+	var data struct {
+		Sum Amount `json:"sum"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(`{"sum": 729.98}`), &data))
+	assert.Equal(t, Amount(72998), data.Sum)
+	marshalled, err := json.Marshal(data)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"sum":729.98}`, string(marshalled))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"sum": 1.234}`), &data))
+}
+
+func TestSumIsExact(t *testing.T) {
+	var sum Amount
+	var floatSum float64
+	for i := 0; i < 1000; i++ {
+		sum += FromFloat(0.1)
+		floatSum += 0.1
+	}
+	assert.Equal(t, "100", sum.String())
+	assert.NotEqual(t, 100.0, floatSum)
+}
+
+func TestScan(t *testing.T) {
+	var amount Amount
+	assert.Nil(t, amount.Scan("729.98"))
+	assert.Equal(t, Amount(72998), amount)
+	assert.Nil(t, amount.Scan([]byte("12.50")))
+	assert.Equal(t, Amount(1250), amount)
+	assert.Nil(t, amount.Scan(int64(3)))
+	assert.Equal(t, Amount(300), amount)
+	assert.Nil(t, amount.Scan(nil))
+	assert.Equal(t, Amount(0), amount)
+	assert.NotNil(t, amount.Scan(true))
+}
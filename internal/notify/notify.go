@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Message is a notification for a user, e.g. a password reset token.
+type Message struct {
+	UserID    string    `json:"user_id"`
+	Login     string    `json:"login"`
+	Subject   string    `json:"subject"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Notifier delivers messages to users, implementations may send emails, push notifications and so on.
+type Notifier interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// NewNotifier returns an OutboxNotifier writing to outboxPath, or a LogNotifier when the path is empty.
+func NewNotifier(outboxPath string, logger *slog.Logger) Notifier {
+	if outboxPath == "" {
+		return LogNotifier{Logger: logger}
+	}
+	return NewOutboxNotifier(outboxPath)
+}
+
+// LogNotifier writes messages to the service log, it is meant for local development only.
+// The text may hold secrets like reset tokens, so it is logged only at debug level.
+type LogNotifier struct {
+	Logger *slog.Logger
+}
+
+func (n LogNotifier) Send(ctx context.Context, message Message) error {
+	n.Logger.InfoContext(ctx, "Notification for user", "login", message.Login, "subject", message.Subject)
+	n.Logger.DebugContext(ctx, "Notification text", "login", message.Login, "text", message.Text)
+	return nil
+}
+
+// OutboxNotifier appends messages as JSON lines to a local file, which is
+// picked up by a separate delivery process.
+type OutboxNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewOutboxNotifier(path string) *OutboxNotifier {
+	return &OutboxNotifier{path: path}
+}
+
+func (n *OutboxNotifier) Send(ctx context.Context, message Message) error {
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = time.Now()
+	}
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	file, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,45 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewNotifier(t *testing.T) {
+	assert.IsType(t, LogNotifier{}, NewNotifier("", slog.Default()))
+	assert.IsType(t, &OutboxNotifier{}, NewNotifier(filepath.Join(t.TempDir(), "outbox"), slog.Default()))
+}
+
+func TestOutboxNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	notifier := NewOutboxNotifier(path)
+	require.Nil(t, notifier.Send(context.Background(), Message{UserID: "1", Login: "first", Subject: "Password reset", Text: "token"}))
+	require.Nil(t, notifier.Send(context.Background(), Message{UserID: "2", Login: "second", Subject: "Password reset", Text: "another token"}))
+
+	file, err := os.Open(path)
+	require.Nil(t, err)
+	defer file.Close()
+	var messages []Message
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var message Message
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &message))
+		messages = append(messages, message)
+	}
+	require.Len(t, messages, 2)
+	assert.Equal(t, "first", messages[0].Login)
+	assert.Equal(t, "another token", messages[1].Text)
+	assert.False(t, messages[0].CreatedAt.IsZero())
+}
+
+func TestOutboxNotifierBadPath(t *testing.T) {
+	notifier := NewOutboxNotifier(filepath.Join(t.TempDir(), "missing", "outbox"))
+	assert.NotNil(t, notifier.Send(context.Background(), Message{Login: "first"}))
+}
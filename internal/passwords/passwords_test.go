@@ -0,0 +1,56 @@
+package passwords
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	hash, err := Hash("MyPassword")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=1,p=4$"))
+	anotherHash, err := Hash("MyPassword")
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, anotherHash, "hashes must be salted")
+
+	match, needsRehash, err := Verify("MyPassword", hash)
+	assert.Nil(t, err)
+	assert.True(t, match)
+	assert.False(t, needsRehash)
+
+	match, needsRehash, err = Verify("WrongPassword", hash)
+	assert.Nil(t, err)
+	assert.False(t, match)
+	assert.False(t, needsRehash)
+}
+
+func TestVerifyLegacyHash(t *testing.T) {
+	legacyHash := "dc1e7c03e162397b355b6f1c895dfdf3790d98c10b920c55e91272b8eecada2a"
+
+	match, needsRehash, err := Verify("MyPassword", legacyHash)
+	assert.Nil(t, err)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+
+	match, needsRehash, err = Verify("WrongPassword", legacyHash)
+	assert.Nil(t, err)
+	assert.False(t, match)
+	assert.False(t, needsRehash)
+}
+
+func TestVerifyOutdatedParams(t *testing.T) {
+	hash, err := hashWithParams("MyPassword", Params{Memory: 32 * 1024, Iterations: 2, Parallelism: 2, SaltLength: 16, KeyLength: 32})
+	assert.Nil(t, err)
+	match, needsRehash, err := Verify("MyPassword", hash)
+	assert.Nil(t, err)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+}
+
+func TestVerifyInvalidHash(t *testing.T) {
+	for _, hash := range []string{"", "plain", "$argon2i$v=19$m=65536,t=1,p=4$c2FsdA$a2V5", "$argon2id$v=19$m=x,t=1,p=4$c2FsdA$a2V5", "$argon2id$v=19$m=65536,t=1,p=4$!!!$a2V5"} {
+		_, _, err := Verify("MyPassword", hash)
+		assert.ErrorIs(t, err, ErrInvalidHash, hash)
+	}
+}
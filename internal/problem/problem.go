@@ -0,0 +1,99 @@
+// Package problem writes error responses as application/problem+json (RFC 7807).
+package problem
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5/middleware"
+	"log/slog"
+	"net/http"
+)
+
+const ContentType = "application/problem+json"
+
+// Codes are stable machine-readable error identifiers, clients must rely on them
+// and not on detail messages, which may change.
+const (
+	CodeInternal                 = "internal_error"
+	CodeUnauthorized             = "unauthorized"
+	CodeForbidden                = "forbidden"
+	CodeNotFound                 = "not_found"
+	CodeMethodNotAllowed         = "method_not_allowed"
+	CodeInvalidBody              = "invalid_body"
+	CodeInvalidOrderNumber       = "invalid_order_number"
+	CodeInvalidSum               = "invalid_sum"
+	CodeInvalidQuery             = "invalid_query"
+	CodeInvalidResetToken        = "invalid_reset_token"
+	CodeTooManyAttempts          = "too_many_attempts"
+	CodeWrongCredentials         = "wrong_credentials"
+	CodeWrongPassword            = "wrong_password"
+	CodeWrongTwoFactorCode       = "wrong_two_factor_code"
+	CodeLoginTaken               = "login_taken"
+	CodeUserNotFound             = "user_not_found"
+	CodeSessionNotFound          = "session_not_found"
+	CodeOrderNotFound            = "order_not_found"
+	CodeOrderOwnedByOther        = "order_owned_by_other"
+	CodeOrderAlreadyPaid         = "order_already_paid"
+	CodeOrderFinal               = "order_final"
+	CodeInsufficientFunds        = "insufficient_funds"
+	CodeTwoFactorNotEnrolled     = "two_factor_not_enrolled"
+	CodeTwoFactorAlreadyEnabled  = "two_factor_already_enabled"
+	CodeIdempotencyKeyTooLong    = "idempotency_key_too_long"
+	CodeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	CodeIdempotencyKeyReused     = "idempotency_key_reused"
+	CodeUnsupportedEncoding      = "unsupported_encoding"
+	CodeInvalidEncoding          = "invalid_encoding"
+	CodeBodyTooLarge             = "body_too_large"
+)
+
+// Details is the problem document, Code and RequestID are extension members.
+type Details struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Write answers the request with a problem document, detail is shown to users as is.
+func Write(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	problemMarshalled, err := json.Marshal(Details{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not marshal problem", "problem", code, "error", err)
+		http.Error(w, detail, status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(problemMarshalled)
+}
+
+// RequestID keeps the X-Request-Id of the client or generates a new one and
+// returns it in the response header, Write puts it into every problem document.
+func RequestID(next http.Handler) http.Handler {
+	return middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// NotFound answers requests to unknown routes.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusNotFound, CodeNotFound, "Route not found")
+}
+
+// MethodNotAllowed answers requests with a method the route does not support.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+}
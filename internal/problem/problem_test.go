@@ -0,0 +1,82 @@
+package problem
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name          string
+		requestID     string
+		handler       http.HandlerFunc
+		wantStatus    int
+		wantCode      string
+		wantDetail    string
+		wantRequestID bool
+	}{
+		{
+			"with_detail",
+			"",
+			func(w http.ResponseWriter, r *http.Request) {
+				Write(w, r, http.StatusPaymentRequired, CodeInsufficientFunds, "Not enough points")
+			},
+			http.StatusPaymentRequired,
+			CodeInsufficientFunds,
+			"Not enough points",
+			true,
+		},
+		{
+			"client_request_id",
+			"my-request",
+			func(w http.ResponseWriter, r *http.Request) {
+				Write(w, r, http.StatusUnauthorized, CodeUnauthorized, "Could not auth user")
+			},
+			http.StatusUnauthorized,
+			CodeUnauthorized,
+			"Could not auth user",
+			true,
+		},
+		{"not_found", "", NotFound, http.StatusNotFound, CodeNotFound, "Route not found", true},
+		{"method_not_allowed", "", MethodNotAllowed, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", nil)
+			if tt.requestID != "" {
+				request.Header.Set("X-Request-Id", tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			RequestID(tt.handler).ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.wantStatus, result.StatusCode)
+			assert.Equal(t, ContentType, result.Header.Get("Content-Type"))
+			var details Details
+			require.Nil(t, json.NewDecoder(result.Body).Decode(&details))
+			assert.Equal(t, "about:blank", details.Type)
+			assert.Equal(t, http.StatusText(tt.wantStatus), details.Title)
+			assert.Equal(t, tt.wantStatus, details.Status)
+			assert.Equal(t, tt.wantCode, details.Code)
+			assert.Equal(t, tt.wantDetail, details.Detail)
+			assert.Equal(t, "/api/user/balance/withdraw", details.Instance)
+			assert.NotEmpty(t, details.RequestID)
+			assert.Equal(t, result.Header.Get("X-Request-Id"), details.RequestID)
+			if tt.requestID != "" {
+				assert.Equal(t, tt.requestID, details.RequestID)
+			}
+		})
+	}
+}
+
+func TestWriteWithoutRequestID(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+	w := httptest.NewRecorder()
+	Write(w, request, http.StatusInternalServerError, CodeInternal, "Could not get orders")
+	assert.Equal(t, `{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"Could not get orders","instance":"/api/user/orders","code":"internal_error"}`, w.Body.String())
+	assert.Empty(t, w.Result().Header.Get("X-Request-Id"))
+}
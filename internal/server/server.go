@@ -1,30 +1,152 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/go-chi/chi/v5"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/accrual"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/compress"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/db"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/handlers"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/health"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/keyring"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/logging"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/metrics"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/problem"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
 	"github.com/tank4gun/go-musthave-diploma-tpl/internal/varprs"
+	"log/slog"
 	"net/http"
+	"strings"
 )
 
-func CreateServer(storageForHandler storage.Storage) *http.Server {
+func CreatePoller(storageForPoller storage.Storage, logger *slog.Logger) *accrual.Poller {
+	accrualClient := accrual.NewRateLimitedClient(accrual.NewHTTPClient(varprs.AccrualSysAddr), accrual.NewRateLimiter(0, 1), logger)
+	pollerConfig := accrual.DefaultPollerConfig
+	pollerConfig.Workers = varprs.AccrualWorkers
+	pollerConfig.QueueSize = varprs.AccrualQueueSize
+	return accrual.NewPoller(storageForPoller, accrualClient, pollerConfig, logger)
+}
+
+// CreateKeyring loads cookie signing keys from COOKIE_KEYS_FILE or COOKIE_KEYS,
+// a random key is generated when none are configured.
+func CreateKeyring(logger *slog.Logger) (*keyring.Keyring, error) {
+	keys, err := keyring.Load(varprs.CookieKeys, varprs.CookieKeysFile)
+	if errors.Is(err, keyring.ErrNoKeys) {
+		logger.Warn("No cookie signing keys configured, using a random key, sessions will not survive restart")
+		return keyring.Generate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Signing cookies", "key_id", keys.ActiveID())
+	return keys, nil
+}
+
+// PromoteAdmins grants the admin role to already registered users from ADMIN_LOGINS,
+// the role is kept in storage, so removing a login from the list does not revoke it.
+func PromoteAdmins(ctx context.Context, storageForAdmins storage.Storage, logger *slog.Logger) {
+	for _, login := range strings.Split(varprs.AdminLogins, ",") {
+		login = strings.TrimSpace(login)
+		if login == "" {
+			continue
+		}
+		err := storageForAdmins.SetUserRole(ctx, login, storage.RoleAdmin)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			logger.WarnContext(ctx, "Could not make admin, user is not registered", "login", login)
+			continue
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "Could not make admin", "login", login, "error", err)
+			continue
+		}
+		logger.InfoContext(ctx, "Granted admin role", "login", login)
+	}
+}
+
+// CreateReadinessChecker checks the database, its schema version for postgres
+// storage, the accrual system and the poller heartbeat.
+func CreateReadinessChecker(storageForChecks storage.Storage, poller *accrual.Poller, logger *slog.Logger) *health.Checker {
+	checks := []health.Check{
+		{Name: "database", Run: storageForChecks.Ping},
+		{Name: "accrual_system", Run: accrual.NewHTTPClient(varprs.AccrualSysAddr).Ping},
+		{Name: "accrual_poller", Run: func(ctx context.Context) error { return poller.CheckHeartbeat() }},
+	}
+	if varprs.StorageType == "postgres" {
+		checks = append(checks, health.Check{Name: "migrations", Run: func(ctx context.Context) error {
+			return CheckSchemaVersion(ctx, storageForChecks)
+		}})
+	}
+	return health.NewChecker(health.DefaultTimeout, logger, checks...)
+}
+
+// CheckSchemaVersion returns an error unless all embedded migrations are applied.
+func CheckSchemaVersion(ctx context.Context, storageForCheck storage.Storage) error {
+	expectedVersion, err := db.ExpectedVersion()
+	if err != nil {
+		return err
+	}
+	version, dirty, err := storageForCheck.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("migration %d failed and left the schema dirty", version)
+	}
+	if version != expectedVersion {
+		return fmt.Errorf("schema version is %d, expected %d", version, expectedVersion)
+	}
+	return nil
+}
+
+func CreateServer(storageForHandler storage.Storage, poller *accrual.Poller, keys *keyring.Keyring, logger *slog.Logger) *http.Server {
 	router := chi.NewRouter()
 
-	handlerWithStorage := handlers.GetHandlerWithStorage(storageForHandler)
-	router.Use(handlers.CheckAuth)
-	go handlerWithStorage.GetStatusesDaemon()
+	handlerWithStorage := handlers.GetHandlerWithStorage(storageForHandler, poller, keys, logger)
+	router.NotFound(problem.NotFound)
+	router.MethodNotAllowed(problem.MethodNotAllowed)
+	router.Use(problem.RequestID)
+	router.Use(logging.Middleware(logger))
+	router.Use(metrics.Middleware)
+	router.Use(compress.Middleware(compress.DefaultMaxBodySize, logger))
+	router.Use(handlerWithStorage.CheckAuth)
 	router.Post("/api/user/register", handlerWithStorage.Register)
 	router.Post("/api/user/login", handlerWithStorage.Login)
+	router.Post("/api/user/login/2fa", handlerWithStorage.LoginTOTP)
+	router.Post("/api/user/token/refresh", handlerWithStorage.RefreshToken)
+	router.Post("/api/user/logout", handlerWithStorage.Logout)
+	router.Post("/api/user/password", handlerWithStorage.ChangePassword)
+	router.Post("/api/user/password/reset-request", handlerWithStorage.RequestPasswordReset)
+	router.Post("/api/user/password/reset", handlerWithStorage.ResetPassword)
+	router.Post("/api/user/2fa/enroll", handlerWithStorage.EnrollTOTP)
+	router.Post("/api/user/2fa/confirm", handlerWithStorage.ConfirmTOTP)
+	router.Get("/api/user/sessions", handlerWithStorage.GetSessions)
+	router.Delete("/api/user/sessions/{id}", handlerWithStorage.RevokeSession)
 	router.Post("/api/user/orders", handlerWithStorage.AddOrder)
 	router.Get("/api/user/orders", handlerWithStorage.GetOrders)
 	router.Get("/api/user/balance", handlerWithStorage.GetBalance)
-	router.Post("/api/user/balance/withdraw", handlerWithStorage.AddWithdrawal)
+	router.With(handlerWithStorage.Idempotent).Post("/api/user/balance/withdraw", handlerWithStorage.AddWithdrawal)
 	router.Get("/api/user/withdrawals", handlerWithStorage.GetWithdrawals)
+	router.Method(http.MethodGet, "/metrics", metrics.Handler())
+	router.Get("/healthz", health.Live)
+	router.Get("/readyz", CreateReadinessChecker(storageForHandler, poller, logger).Ready)
+	router.Route("/api/admin", func(adminRouter chi.Router) {
+		adminRouter.Use(handlerWithStorage.RequireAdmin)
+		adminRouter.Get("/users", handlerWithStorage.AdminFindUser)
+		adminRouter.Get("/users/{id}", handlerWithStorage.AdminGetUser)
+		adminRouter.Get("/users/{id}/orders", handlerWithStorage.AdminGetOrders)
+		adminRouter.Get("/users/{id}/withdrawals", handlerWithStorage.AdminGetWithdrawals)
+		adminRouter.Get("/users/{id}/balance", handlerWithStorage.AdminGetBalance)
+		adminRouter.Post("/users/{id}/balance/adjustments", handlerWithStorage.AdminAdjustBalance)
+		adminRouter.Post("/orders/{number}/repoll", handlerWithStorage.AdminRepollOrder)
+		adminRouter.Get("/audit", handlerWithStorage.AdminGetAudit)
+	})
 
 	server := &http.Server{
-		Addr:    varprs.ServerAddr,
-		Handler: router,
+		Addr:     varprs.ServerAddr,
+		Handler:  router,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
 	}
 	return server
 }
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/health"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/keyring"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/problem"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+)
+
+func gzipped(t *testing.T, data string) io.Reader {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write([]byte(data))
+	require.Nil(t, err)
+	require.Nil(t, writer.Close())
+	return &buffer
+}
+
+// TestCompressedRequests sends every request gzipped and checks that handlers
+// got the decompressed body and that JSON responses and errors come back gzipped.
+func TestCompressedRequests(t *testing.T) {
+	memStorage := storage.NewMemStorage(slog.Default())
+	keys, err := keyring.Generate()
+	require.Nil(t, err)
+	testServer := httptest.NewServer(CreateServer(memStorage, CreatePoller(memStorage, slog.Default()), keys, slog.Default()).Handler)
+	defer testServer.Close()
+	jar, err := cookiejar.New(nil)
+	require.Nil(t, err)
+	client := &http.Client{Jar: jar, Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+		wantJSON bool
+	}{
+		{"register", http.MethodPost, "/api/user/register", `{"login":"gopher","password":"MyPassword"}`, http.StatusOK, false},
+		{"login", http.MethodPost, "/api/user/login", `{"login":"gopher","password":"MyPassword"}`, http.StatusOK, false},
+		{"login_with_tokens", http.MethodPost, "/api/user/login?tokens=true", `{"login":"gopher","password":"MyPassword"}`, http.StatusOK, true},
+		{"login_2fa", http.MethodPost, "/api/user/login/2fa", `{"mfa_token":"garbage","code":"123456"}`, http.StatusUnauthorized, false},
+		{"refresh_token", http.MethodPost, "/api/user/token/refresh", `{"refresh_token":"garbage"}`, http.StatusUnauthorized, false},
+		{"add_order", http.MethodPost, "/api/user/orders", `12345678903`, http.StatusAccepted, false},
+		{"get_orders", http.MethodGet, "/api/user/orders", ``, http.StatusOK, true},
+		{"get_balance", http.MethodGet, "/api/user/balance", ``, http.StatusOK, true},
+		{"withdraw_without_points", http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624","sum":10}`, http.StatusPaymentRequired, false},
+		{"admin_forbidden", http.MethodGet, "/api/admin/users?login=gopher", ``, http.StatusForbidden, false},
+		{"admin_find_user", http.MethodGet, "/api/admin/users?login=gopher", ``, http.StatusOK, true},
+		{"admin_adjust_balance", http.MethodPost, "/api/admin/users/{id}/balance/adjustments", `{"amount":100,"reason":"welcome bonus"}`, http.StatusOK, true},
+		{"admin_get_orders", http.MethodGet, "/api/admin/users/{id}/orders", ``, http.StatusOK, true},
+		{"admin_get_balance", http.MethodGet, "/api/admin/users/{id}/balance", ``, http.StatusOK, true},
+		{"admin_repoll_order", http.MethodPost, "/api/admin/orders/12345678903/repoll", ``, http.StatusAccepted, false},
+		{"withdraw", http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624","sum":10}`, http.StatusOK, false},
+		{"get_withdrawals", http.MethodGet, "/api/user/withdrawals", ``, http.StatusOK, true},
+		{"admin_get_withdrawals", http.MethodGet, "/api/admin/users/{id}/withdrawals", ``, http.StatusOK, true},
+		{"admin_get_audit", http.MethodGet, "/api/admin/audit", ``, http.StatusOK, true},
+		{"get_sessions", http.MethodGet, "/api/user/sessions", ``, http.StatusOK, true},
+		{"revoke_unknown_session", http.MethodDelete, "/api/user/sessions/unknown", ``, http.StatusNotFound, false},
+		{"enroll_totp", http.MethodPost, "/api/user/2fa/enroll", ``, http.StatusOK, true},
+		{"confirm_totp", http.MethodPost, "/api/user/2fa/confirm", `{"code":"000000"}`, http.StatusUnprocessableEntity, false},
+		{"request_password_reset", http.MethodPost, "/api/user/password/reset-request", `{"login":"gopher"}`, http.StatusAccepted, false},
+		{"reset_password", http.MethodPost, "/api/user/password/reset", `{"token":"garbage","new_password":"NewPassword"}`, http.StatusBadRequest, false},
+		{"change_password", http.MethodPost, "/api/user/password", `{"current_password":"wrong","new_password":"NewPassword"}`, http.StatusForbidden, false},
+		{"logout", http.MethodPost, "/api/user/logout", ``, http.StatusOK, false},
+	}
+	var userID string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "admin_find_user" {
+				require.Nil(t, memStorage.SetUserRole(context.Background(), "gopher", storage.RoleAdmin))
+			}
+			path := tt.path
+			if userID != "" {
+				path = string(bytes.ReplaceAll([]byte(path), []byte("{id}"), []byte(userID)))
+			}
+			var body io.Reader
+			if tt.body != "" {
+				body = gzipped(t, tt.body)
+			}
+			request, err := http.NewRequest(tt.method, testServer.URL+path, body)
+			require.Nil(t, err)
+			if tt.body != "" {
+				request.Header.Set("Content-Encoding", "gzip")
+			}
+			request.Header.Set("Accept-Encoding", "gzip")
+			result, err := client.Do(request)
+			require.Nil(t, err)
+			defer result.Body.Close()
+			assert.Equal(t, tt.wantCode, result.StatusCode)
+			if !tt.wantJSON && tt.wantCode < http.StatusBadRequest {
+				return
+			}
+			require.Equal(t, "gzip", result.Header.Get("Content-Encoding"))
+			reader, err := gzip.NewReader(result.Body)
+			require.Nil(t, err)
+			var response interface{}
+			require.Nil(t, json.NewDecoder(reader).Decode(&response))
+			if tt.wantCode >= http.StatusBadRequest {
+				assert.Equal(t, problem.ContentType, result.Header.Get("Content-Type"))
+				details := response.(map[string]interface{})
+				assert.Equal(t, float64(tt.wantCode), details["status"])
+				assert.NotEmpty(t, details["code"])
+				assert.Equal(t, result.Header.Get("X-Request-Id"), details["request_id"])
+				return
+			}
+			if user, ok := response.(map[string]interface{}); ok && tt.name == "admin_find_user" {
+				userID, _ = user["id"].(string)
+			}
+		})
+	}
+	require.NotEmpty(t, userID)
+}
+
+// TestMetrics checks that /metrics is public and labels requests by route pattern.
+func TestMetrics(t *testing.T) {
+	memStorage := storage.NewInstrumentedStorage(storage.NewMemStorage(slog.Default()))
+	keys, err := keyring.Generate()
+	require.Nil(t, err)
+	testServer := httptest.NewServer(CreateServer(memStorage, CreatePoller(memStorage, slog.Default()), keys, slog.Default()).Handler)
+	defer testServer.Close()
+
+	result, err := http.Post(testServer.URL+"/api/user/register", "application/json", bytes.NewBufferString(`{"login":"gopher","password":"MyPassword"}`))
+	require.Nil(t, err)
+	result.Body.Close()
+	require.Equal(t, http.StatusOK, result.StatusCode)
+
+	result, err = http.Get(testServer.URL + "/metrics")
+	require.Nil(t, err)
+	defer result.Body.Close()
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	body, err := io.ReadAll(result.Body)
+	require.Nil(t, err)
+	assert.Contains(t, string(body), `gophermart_http_requests_total{method="POST",route="/api/user/register",status="200"}`)
+	assert.Contains(t, string(body), `gophermart_db_query_duration_seconds_count{method="Register"}`)
+	assert.Contains(t, string(body), "gophermart_registrations_total")
+}
+
+// TestHealth checks that probes are public and readiness reports every check.
+func TestHealth(t *testing.T) {
+	memStorage := storage.NewMemStorage(slog.Default())
+	keys, err := keyring.Generate()
+	require.Nil(t, err)
+	testServer := httptest.NewServer(CreateServer(memStorage, CreatePoller(memStorage, slog.Default()), keys, slog.Default()).Handler)
+	defer testServer.Close()
+
+	result, err := http.Get(testServer.URL + "/healthz")
+	require.Nil(t, err)
+	result.Body.Close()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+
+	result, err = http.Get(testServer.URL + "/readyz")
+	require.Nil(t, err)
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, result.StatusCode)
+	var report health.Report
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&report))
+	assert.Equal(t, health.StatusUnavailable, report.Status)
+	assert.Equal(t, health.StatusOK, report.Checks["database"].Status)
+	assert.Equal(t, health.StatusUnavailable, report.Checks["accrual_system"].Status)
+	assert.Equal(t, health.StatusUnavailable, report.Checks["accrual_poller"].Status)
+	assert.NotContains(t, report.Checks, "migrations")
+}
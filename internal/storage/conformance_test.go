@@ -0,0 +1,851 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/db"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/money"
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+func TestMemStorageConformance(t *testing.T) {
+	runConformanceSuite(t, NewMemStorage(slog.Default()))
+}
+
+func TestDBStorageConformance(t *testing.T) {
+	dbURI := os.Getenv("DATABASE_URI")
+	if dbURI == "" {
+		t.Skip("DATABASE_URI is not set, skip PostgreSQL storage tests")
+	}
+	require.Nil(t, db.RunMigrations(dbURI))
+	strg, err := GetStorage(dbURI, slog.Default())
+	require.Nil(t, err)
+	defer strg.Close()
+	expectedVersion, err := db.ExpectedVersion()
+	require.Nil(t, err)
+	version, dirty, err := strg.SchemaVersion(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, expectedVersion, version)
+	assert.False(t, dirty)
+	runConformanceSuite(t, strg)
+	t.Run("unbalanced_ledger_transaction", func(t *testing.T) { testUnbalancedLedgerTransaction(t, strg) })
+
+	zoned, err := GetStorage(withTimeZone(dbURI, "Asia/Yekaterinburg"), slog.Default())
+	require.Nil(t, err)
+	defer zoned.Close()
+	t.Run("non_utc_session_list_query", func(t *testing.T) { testListQuery(t, zoned) })
+	t.Run("non_utc_session_sessions", func(t *testing.T) { testSessions(t, zoned) })
+	t.Run("non_utc_session_balance_adjustments", func(t *testing.T) { testBalanceAdjustments(t, zoned) })
+}
+
+// withTimeZone sets the session time zone of connections opened with dbURI.
+func withTimeZone(dbURI string, timeZone string) string {
+	if parsed, err := url.Parse(dbURI); err == nil && (parsed.Scheme == "postgres" || parsed.Scheme == "postgresql") {
+		query := parsed.Query()
+		query.Set("timezone", timeZone)
+		parsed.RawQuery = query.Encode()
+		return parsed.String()
+	}
+	return dbURI + " timezone=" + timeZone
+}
+
+// runConformanceSuite checks the behaviour every Storage implementation must follow.
+// Logins and order numbers are random, so the suite can run against a non-empty database.
+func runConformanceSuite(t *testing.T, strg Storage) {
+	t.Run("ping", func(t *testing.T) { require.Nil(t, strg.Ping(ctx)) })
+	t.Run("register", func(t *testing.T) { testRegister(t, strg) })
+	t.Run("get_user_by_login", func(t *testing.T) { testGetUserByLogin(t, strg) })
+	t.Run("order_ownership", func(t *testing.T) { testOrderOwnership(t, strg) })
+	t.Run("concurrent_order_uploads", func(t *testing.T) { testConcurrentOrderUploads(t, strg) })
+	t.Run("orders_by_user", func(t *testing.T) { testOrdersByUser(t, strg) })
+	t.Run("list_query", func(t *testing.T) { testListQuery(t, strg) })
+	t.Run("update_order", func(t *testing.T) { testUpdateOrder(t, strg) })
+	t.Run("balance_and_withdrawals", func(t *testing.T) { testBalanceAndWithdrawals(t, strg) })
+	t.Run("orders_in_progress", func(t *testing.T) { testOrdersInProgress(t, strg) })
+	t.Run("accrual_jobs", func(t *testing.T) { testAccrualJobs(t, strg) })
+	t.Run("concurrent_withdrawals", func(t *testing.T) { testConcurrentWithdrawals(t, strg) })
+	t.Run("withdrawal_order_reuse", func(t *testing.T) { testWithdrawalOrderReuse(t, strg) })
+	t.Run("idempotency_keys", func(t *testing.T) { testIdempotencyKeys(t, strg) })
+	t.Run("sessions", func(t *testing.T) { testSessions(t, strg) })
+	t.Run("login_throttling", func(t *testing.T) { testLoginThrottling(t, strg) })
+	t.Run("password_reset", func(t *testing.T) { testPasswordReset(t, strg) })
+	t.Run("totp", func(t *testing.T) { testTOTP(t, strg) })
+	t.Run("roles", func(t *testing.T) { testRoles(t, strg) })
+	t.Run("requeue_accrual_job", func(t *testing.T) { testRequeueAccrualJob(t, strg) })
+	t.Run("repoll_final_order", func(t *testing.T) { testRepollFinalOrder(t, strg) })
+	t.Run("balance_adjustments", func(t *testing.T) { testBalanceAdjustments(t, strg) })
+	t.Run("double_entry_ledger", func(t *testing.T) { testDoubleEntryLedger(t, strg) })
+}
+
+func randomSuffix() string {
+	return fmt.Sprintf("%d%06d", time.Now().UnixNano(), rand.Intn(1000000))
+}
+
+func registerUser(t *testing.T, strg Storage) string {
+	userID, err := strg.Register(ctx, UserAuthData{Login: "user" + randomSuffix(), Password: "password"})
+	require.Nil(t, err)
+	return userID
+}
+
+func addOrder(t *testing.T, strg Storage, userID string) string {
+	orderNumber := randomSuffix()
+	require.Nil(t, strg.AddOrderForUser(ctx, orderNumber, userID))
+	return orderNumber
+}
+
+func accrueToUser(t *testing.T, strg Storage, userID string, amount money.Amount) {
+	orderNumber := addOrder(t, strg, userID)
+	require.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: orderNumber, Status: "PROCESSED", Accrual: amount}))
+	require.Nil(t, strg.CompleteAccrualJob(ctx, orderNumber))
+}
+
+func testRegister(t *testing.T, strg Storage) {
+	login := "user" + randomSuffix()
+	userID, err := strg.Register(ctx, UserAuthData{Login: login, Password: "password"})
+	assert.Nil(t, err)
+	assert.Len(t, userID, 36)
+
+	_, err = strg.Register(ctx, UserAuthData{Login: login, Password: "another"})
+	assert.ErrorIs(t, err, ErrLoginTaken)
+}
+
+func testGetUserByLogin(t *testing.T, strg Storage) {
+	login := "user" + randomSuffix()
+	userID, err := strg.Register(ctx, UserAuthData{Login: login, Password: "password-hash"})
+	require.Nil(t, err)
+
+	userData, err := strg.GetUserByLogin(ctx, UserAuthData{Login: login})
+	assert.Nil(t, err)
+	assert.Equal(t, userID, userData.UserID)
+	assert.Equal(t, login, userData.Login)
+	assert.Equal(t, "password-hash", userData.Password)
+
+	assert.Nil(t, strg.UpdatePasswordHash(ctx, userID, "new-password-hash"))
+	userData, err = strg.GetUserByLogin(ctx, UserAuthData{Login: login})
+	assert.Nil(t, err)
+	assert.Equal(t, "new-password-hash", userData.Password)
+	assert.ErrorIs(t, strg.UpdatePasswordHash(ctx, "00000000-0000-0000-0000-000000000000", "hash"), ErrUserNotFound)
+
+	_, err = strg.GetUserByLogin(ctx, UserAuthData{Login: "missing" + randomSuffix()})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func testOrderOwnership(t *testing.T, strg Storage) {
+	owner := registerUser(t, strg)
+	another := registerUser(t, strg)
+	orderNumber := addOrder(t, strg, owner)
+
+	assert.ErrorIs(t, strg.AddOrderForUser(ctx, orderNumber, owner), ErrOrderAlreadyUploaded)
+	assert.ErrorIs(t, strg.AddOrderForUser(ctx, orderNumber, another), ErrOrderOwnedByOther)
+}
+
+func testConcurrentOrderUploads(t *testing.T, strg Storage) {
+	users := []string{registerUser(t, strg), registerUser(t, strg)}
+	orderNumber := randomSuffix()
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			results <- strg.AddOrderForUser(ctx, orderNumber, userID)
+		}(users[i%2])
+	}
+	wg.Wait()
+	close(results)
+	added := 0
+	for err := range results {
+		if err == nil {
+			added++
+		} else if !errors.Is(err, ErrOrderAlreadyUploaded) {
+			assert.ErrorIs(t, err, ErrOrderOwnedByOther)
+		}
+	}
+	assert.Equal(t, 1, added)
+	orders := 0
+	for _, userID := range users {
+		userOrders, err := strg.GetOrdersByUser(ctx, userID, ListQuery{})
+		require.Nil(t, err)
+		orders += len(userOrders)
+	}
+	assert.Equal(t, 1, orders, "the order is added once")
+	_, found := claimJob(t, strg, orderNumber)
+	assert.True(t, found)
+	require.Nil(t, strg.CompleteAccrualJob(ctx, orderNumber))
+}
+
+func testOrdersByUser(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	orders, err := strg.GetOrdersByUser(ctx, userID, ListQuery{})
+	assert.Nil(t, err)
+	assert.Empty(t, orders)
+
+	numbers := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		numbers = append(numbers, addOrder(t, strg, userID))
+		time.Sleep(2 * time.Millisecond)
+	}
+	addOrder(t, strg, registerUser(t, strg))
+
+	orders, err = strg.GetOrdersByUser(ctx, userID, ListQuery{})
+	assert.Nil(t, err)
+	require.Len(t, orders, 3)
+	for i, order := range orders {
+		assert.Equal(t, numbers[i], order.Number)
+		assert.Equal(t, "NEW", order.Status)
+		assert.Equal(t, money.Amount(0), order.Accrual)
+		assert.False(t, order.UploadedAt.IsZero())
+		if i > 0 {
+			assert.False(t, order.UploadedAt.Before(orders[i-1].UploadedAt))
+		}
+	}
+}
+
+func testListQuery(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	accrueToUser(t, strg, userID, money.FromFloat(100))
+	numbers := make([]string, 0)
+	withdrawalOrders := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		numbers = append(numbers, addOrder(t, strg, userID))
+		withdrawalOrder := randomSuffix()
+		require.Nil(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: withdrawalOrder, Sum: money.FromFloat(1)}))
+		withdrawalOrders = append(withdrawalOrders, withdrawalOrder)
+		time.Sleep(2 * time.Millisecond)
+	}
+	require.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: numbers[1], Status: "PROCESSING"}))
+	require.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: numbers[3], Status: "INVALID"}))
+	all, err := strg.GetOrdersByUser(ctx, userID, ListQuery{})
+	require.Nil(t, err)
+	require.Len(t, all, 6)
+	all = all[1:]
+
+	pages := make([][]string, 0)
+	var after *Cursor
+	for {
+		orders, err := strg.GetOrdersByUser(ctx, userID, ListQuery{Limit: 2, After: after})
+		require.Nil(t, err)
+		if len(orders) == 0 {
+			break
+		}
+		page := make([]string, 0)
+		for _, order := range orders {
+			page = append(page, order.Number)
+		}
+		pages = append(pages, page)
+		last := orders[len(orders)-1]
+		cursor, err := ParseCursor(Cursor{Time: last.UploadedAt, Key: last.Number}.String())
+		require.Nil(t, err)
+		after = &cursor
+	}
+	require.Len(t, pages, 3, "the order of accrueToUser comes first")
+	assert.Equal(t, numbers[0], pages[0][1])
+	assert.Equal(t, numbers[1:3], pages[1])
+	assert.Equal(t, numbers[3:5], pages[2])
+
+	orders, err := strg.GetOrdersByUser(ctx, userID, ListQuery{Statuses: []string{"PROCESSING", "INVALID"}})
+	assert.Nil(t, err)
+	require.Len(t, orders, 2)
+	assert.Equal(t, numbers[1], orders[0].Number)
+	assert.Equal(t, numbers[3], orders[1].Number)
+
+	orders, err = strg.GetOrdersByUser(ctx, userID, ListQuery{From: all[1].UploadedAt, To: all[3].UploadedAt})
+	assert.Nil(t, err)
+	require.Len(t, orders, 2, "from is inclusive and to is exclusive")
+	assert.Equal(t, numbers[1], orders[0].Number)
+	assert.Equal(t, numbers[2], orders[1].Number)
+
+	east, west := time.FixedZone("UTC+5", 5*60*60), time.FixedZone("UTC-7", -7*60*60)
+	orders, err = strg.GetOrdersByUser(ctx, userID, ListQuery{From: all[1].UploadedAt.In(east), To: all[3].UploadedAt.In(west)})
+	assert.Nil(t, err)
+	require.Len(t, orders, 2, "bounds are instants whatever their time zone is")
+	assert.Equal(t, numbers[1], orders[0].Number)
+	assert.Equal(t, numbers[2], orders[1].Number)
+
+	withdrawals, err := strg.GetWithdrawalsForUser(ctx, userID, ListQuery{From: time.Now().Add(-time.Minute).In(east)})
+	assert.Nil(t, err)
+	assert.Len(t, withdrawals, 5)
+	withdrawals, err = strg.GetWithdrawalsForUser(ctx, userID, ListQuery{From: time.Now().Add(time.Minute).In(east)})
+	assert.Nil(t, err)
+	assert.Empty(t, withdrawals)
+
+	withdrawals, err = strg.GetWithdrawalsForUser(ctx, userID, ListQuery{Limit: 2})
+	assert.Nil(t, err)
+	require.Len(t, withdrawals, 2)
+	assert.Equal(t, withdrawalOrders[0], withdrawals[0].Order)
+	last := withdrawals[1]
+	withdrawals, err = strg.GetWithdrawalsForUser(ctx, userID, ListQuery{After: &Cursor{Time: last.ProcessedAt, Key: last.Order}, To: time.Now().Add(time.Hour)})
+	assert.Nil(t, err)
+	require.Len(t, withdrawals, 3)
+	assert.Equal(t, withdrawalOrders[2], withdrawals[0].Order)
+}
+
+func testUpdateOrder(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	orderNumber := addOrder(t, strg, userID)
+
+	assert.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: orderNumber, Status: "PROCESSING"}))
+	orders, _ := strg.GetOrdersByUser(ctx, userID, ListQuery{})
+	require.Len(t, orders, 1)
+	assert.Equal(t, "PROCESSING", orders[0].Status)
+
+	accrual := money.FromFloat(729.98)
+	assert.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: orderNumber, Status: "PROCESSED", Accrual: accrual}))
+	assert.ErrorIs(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: orderNumber, Status: "PROCESSED", Accrual: accrual}), ErrOrderFinal)
+	orders, _ = strg.GetOrdersByUser(ctx, userID, ListQuery{})
+	require.Len(t, orders, 1)
+	assert.Equal(t, "PROCESSED", orders[0].Status)
+	assert.Equal(t, accrual, orders[0].Accrual)
+	balance, err := strg.GetUserBalance(ctx, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, UserBalance{Orders: accrual, Withdrawn: 0}, balance)
+
+	invalidOrder := addOrder(t, strg, userID)
+	assert.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: invalidOrder, Status: "INVALID"}))
+	balance, _ = strg.GetUserBalance(ctx, userID)
+	assert.Equal(t, accrual, balance.Orders)
+
+	assert.ErrorIs(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: "missing" + randomSuffix(), Status: "PROCESSED", Accrual: accrual}), ErrOrderNotFound)
+}
+
+func testBalanceAndWithdrawals(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	balance, err := strg.GetUserBalance(ctx, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, UserBalance{0, 0}, balance)
+	withdrawals, err := strg.GetWithdrawalsForUser(ctx, userID, ListQuery{})
+	assert.Nil(t, err)
+	assert.Empty(t, withdrawals)
+
+	for i := 0; i < 3; i++ {
+		accrueToUser(t, strg, userID, money.FromFloat(0.1))
+	}
+	accrueToUser(t, strg, userID, money.FromFloat(500))
+
+	firstOrder, secondOrder := randomSuffix(), randomSuffix()
+	assert.ErrorIs(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: firstOrder, Sum: money.FromFloat(500.31)}), ErrInsufficientFunds)
+	assert.Nil(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: firstOrder, Sum: money.FromFloat(100.2)}))
+	time.Sleep(2 * time.Millisecond)
+	assert.Nil(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: secondOrder, Sum: money.FromFloat(400.1)}))
+
+	balance, err = strg.GetUserBalance(ctx, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, UserBalance{Orders: 0, Withdrawn: money.FromFloat(500.3)}, balance)
+	assert.ErrorIs(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: randomSuffix(), Sum: money.FromFloat(0.01)}), ErrInsufficientFunds)
+
+	withdrawals, err = strg.GetWithdrawalsForUser(ctx, userID, ListQuery{})
+	assert.Nil(t, err)
+	require.Len(t, withdrawals, 2)
+	assert.Equal(t, firstOrder, withdrawals[0].Order)
+	assert.Equal(t, money.FromFloat(100.2), withdrawals[0].Sum)
+	assert.Equal(t, secondOrder, withdrawals[1].Order)
+	assert.False(t, withdrawals[1].ProcessedAt.Before(withdrawals[0].ProcessedAt))
+}
+
+func testWithdrawalOrderReuse(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	another := registerUser(t, strg)
+	accrueToUser(t, strg, userID, money.FromFloat(100))
+	accrueToUser(t, strg, another, money.FromFloat(100))
+
+	orderNumber := randomSuffix()
+	require.Nil(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: orderNumber, Sum: money.FromFloat(10)}))
+	assert.ErrorIs(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: orderNumber, Sum: money.FromFloat(10)}), ErrWithdrawalOrderUsed)
+	assert.ErrorIs(t, strg.AddWithdrawalForUser(ctx, another, Withdrawal{Order: orderNumber, Sum: money.FromFloat(10)}), ErrWithdrawalOrderUsed)
+	assert.ErrorIs(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: orderNumber, Sum: money.FromFloat(1000)}), ErrWithdrawalOrderUsed, "reuse is reported before the balance check")
+
+	balance, err := strg.GetUserBalance(ctx, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, UserBalance{Orders: money.FromFloat(90), Withdrawn: money.FromFloat(10)}, balance)
+	balance, err = strg.GetUserBalance(ctx, another)
+	assert.Nil(t, err)
+	assert.Equal(t, UserBalance{Orders: money.FromFloat(100)}, balance)
+}
+
+func testIdempotencyKeys(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	another := registerUser(t, strg)
+	key := "key" + randomSuffix()
+	_, err := strg.GetIdempotencyKey(ctx, userID, key)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyNotFound)
+
+	require.Nil(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: key, RequestHash: "hash"}, time.Hour, time.Hour))
+	assert.ErrorIs(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: key, RequestHash: "hash"}, time.Hour, time.Hour), ErrIdempotencyKeyExists)
+	assert.Nil(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: another, Key: key, RequestHash: "another"}, time.Hour, time.Hour), "keys of users do not clash")
+	record, err := strg.GetIdempotencyKey(ctx, userID, key)
+	assert.Nil(t, err)
+	assert.Equal(t, IdempotencyRecord{UserID: userID, Key: key, RequestHash: "hash"}, record)
+
+	require.Nil(t, strg.SaveIdempotentResponse(ctx, IdempotencyRecord{UserID: userID, Key: key, StatusCode: 402, ContentType: "text/plain", ResponseBody: []byte("no funds")}))
+	record, err = strg.GetIdempotencyKey(ctx, userID, key)
+	assert.Nil(t, err)
+	assert.Equal(t, IdempotencyRecord{UserID: userID, Key: key, RequestHash: "hash", StatusCode: 402, ContentType: "text/plain", ResponseBody: []byte("no funds")}, record)
+	assert.ErrorIs(t, strg.SaveIdempotentResponse(ctx, IdempotencyRecord{UserID: userID, Key: "unknown" + randomSuffix(), StatusCode: 200}), ErrIdempotencyKeyNotFound)
+
+	require.Nil(t, strg.DeleteIdempotencyKey(ctx, userID, key))
+	_, err = strg.GetIdempotencyKey(ctx, userID, key)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyNotFound)
+	_, err = strg.GetIdempotencyKey(ctx, another, key)
+	assert.Nil(t, err)
+
+	leasedKey := "key" + randomSuffix()
+	require.Nil(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: leasedKey, RequestHash: "hash"}, time.Hour, -time.Second))
+	assert.ErrorIs(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: leasedKey, RequestHash: "another"}, time.Hour, time.Hour), ErrIdempotencyKeyExists, "another request can not take over")
+	require.Nil(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: leasedKey, RequestHash: "hash"}, time.Hour, time.Hour), "retry takes over after the lease")
+	assert.ErrorIs(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: leasedKey, RequestHash: "hash"}, time.Hour, time.Hour), ErrIdempotencyKeyExists, "lease is renewed")
+	require.Nil(t, strg.SaveIdempotentResponse(ctx, IdempotencyRecord{UserID: userID, Key: leasedKey, StatusCode: 200}))
+
+	savedKey := "key" + randomSuffix()
+	require.Nil(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: savedKey, RequestHash: "hash"}, time.Hour, -time.Second))
+	require.Nil(t, strg.SaveIdempotentResponse(ctx, IdempotencyRecord{UserID: userID, Key: savedKey, StatusCode: 200}))
+	assert.ErrorIs(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: savedKey, RequestHash: "hash"}, time.Hour, time.Hour), ErrIdempotencyKeyExists, "saved response is replayed, not taken over")
+
+	expiredKey := "key" + randomSuffix()
+	require.Nil(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: expiredKey, RequestHash: "old"}, -time.Second, time.Hour))
+	_, err = strg.GetIdempotencyKey(ctx, userID, expiredKey)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyNotFound)
+	assert.Nil(t, strg.CreateIdempotencyKey(ctx, IdempotencyRecord{UserID: userID, Key: expiredKey, RequestHash: "new"}, time.Hour, time.Hour), "expired key can be used again")
+	record, err = strg.GetIdempotencyKey(ctx, userID, expiredKey)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", record.RequestHash)
+}
+
+func testOrdersInProgress(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	newOrder := addOrder(t, strg, userID)
+	processingOrder := addOrder(t, strg, userID)
+	processedOrder := addOrder(t, strg, userID)
+	invalidOrder := addOrder(t, strg, userID)
+	require.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: processingOrder, Status: "PROCESSING"}))
+	require.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: processedOrder, Status: "PROCESSED", Accrual: 100}))
+	require.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: invalidOrder, Status: "INVALID"}))
+
+	orders, err := strg.GetOrdersInProgress(ctx)
+	assert.Nil(t, err)
+	statuses := make(map[string]string)
+	for _, order := range orders {
+		statuses[order.Number] = order.Status
+	}
+	assert.Equal(t, "NEW", statuses[newOrder])
+	assert.Equal(t, "PROCESSING", statuses[processingOrder])
+	assert.NotContains(t, statuses, processedOrder)
+	assert.NotContains(t, statuses, invalidOrder)
+}
+
+func claimJob(t *testing.T, strg Storage, orderNumber string) (AccrualJob, bool) {
+	jobs, err := strg.ClaimAccrualJobs(ctx, 1000, time.Minute)
+	require.Nil(t, err)
+	var result AccrualJob
+	found := false
+	for _, job := range jobs {
+		if job.OrderNumber == orderNumber {
+			result = job
+			found = true
+			continue
+		}
+		strg.RescheduleAccrualJob(ctx, job.OrderNumber, 0, job.LastError)
+	}
+	return result, found
+}
+
+func testAccrualJobs(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	orderNumber := addOrder(t, strg, userID)
+
+	job, found := claimJob(t, strg, orderNumber)
+	require.True(t, found)
+	assert.Equal(t, 1, job.Attempts)
+	_, found = claimJob(t, strg, orderNumber)
+	assert.False(t, found, "claimed job must be leased")
+
+	assert.Nil(t, strg.RescheduleAccrualJob(ctx, orderNumber, 0, "got status code 500"))
+	job, found = claimJob(t, strg, orderNumber)
+	require.True(t, found)
+	assert.Equal(t, 2, job.Attempts)
+	assert.Equal(t, "got status code 500", job.LastError)
+
+	assert.Nil(t, strg.RescheduleAccrualJob(ctx, orderNumber, time.Hour, ""))
+	_, found = claimJob(t, strg, orderNumber)
+	assert.False(t, found, "rescheduled job must wait for its next attempt")
+
+	assert.Nil(t, strg.AddAccrualJob(ctx, orderNumber))
+	_, found = claimJob(t, strg, orderNumber)
+	assert.False(t, found, "adding existing job must not reset it")
+
+	assert.Nil(t, strg.RescheduleAccrualJob(ctx, orderNumber, 0, ""))
+	job, found = claimJob(t, strg, orderNumber)
+	require.True(t, found)
+	assert.Equal(t, 1, job.Attempts, "successful poll must reset attempts")
+
+	assert.Nil(t, strg.CompleteAccrualJob(ctx, orderNumber))
+	assert.Nil(t, strg.RescheduleAccrualJob(ctx, orderNumber, 0, ""))
+	_, found = claimJob(t, strg, orderNumber)
+	assert.False(t, found, "completed job must be removed")
+}
+
+func testConcurrentWithdrawals(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	accrueToUser(t, strg, userID, money.FromFloat(100))
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: randomSuffix(), Sum: money.FromFloat(20)})
+		}()
+	}
+	wg.Wait()
+	close(results)
+	succeeded := 0
+	for err := range results {
+		if err == nil {
+			succeeded++
+		} else {
+			assert.ErrorIs(t, err, ErrInsufficientFunds)
+		}
+	}
+	assert.Equal(t, 5, succeeded)
+	balance, _ := strg.GetUserBalance(ctx, userID)
+	assert.Equal(t, UserBalance{Orders: 0, Withdrawn: money.FromFloat(100)}, balance)
+}
+
+func testSessions(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	another := registerUser(t, strg)
+
+	session, err := strg.CreateSession(ctx, Session{UserID: userID, UserAgent: "test-agent", IP: "192.0.2.1"}, time.Hour)
+	require.Nil(t, err)
+	assert.Len(t, session.ID, 36)
+	assert.Equal(t, userID, session.UserID)
+	assert.Equal(t, "test-agent", session.UserAgent)
+	assert.Equal(t, "192.0.2.1", session.IP)
+	assert.True(t, session.ExpiresAt.After(session.CreatedAt))
+	assert.WithinDuration(t, time.Now(), session.CreatedAt, time.Minute, "times are instants whatever the database time zone is")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), session.ExpiresAt, time.Minute)
+
+	touched, err := strg.TouchSession(ctx, session.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, session.ID, touched.ID)
+	assert.Equal(t, userID, touched.UserID)
+	assert.False(t, touched.LastSeen.Before(session.LastSeen))
+
+	expired, err := strg.CreateSession(ctx, Session{UserID: userID}, -time.Second)
+	require.Nil(t, err)
+	_, err = strg.TouchSession(ctx, expired.ID)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+
+	sessions, err := strg.GetSessionsForUser(ctx, userID)
+	assert.Nil(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, session.ID, sessions[0].ID)
+
+	assert.ErrorIs(t, strg.RevokeSession(ctx, another, session.ID), ErrSessionNotFound)
+	assert.ErrorIs(t, strg.RevokeSession(ctx, userID, "not-a-session-id"), ErrSessionNotFound)
+	assert.Nil(t, strg.RevokeSession(ctx, userID, session.ID))
+	assert.ErrorIs(t, strg.RevokeSession(ctx, userID, session.ID), ErrSessionNotFound)
+
+	_, err = strg.TouchSession(ctx, session.ID)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	sessions, err = strg.GetSessionsForUser(ctx, userID)
+	assert.Nil(t, err)
+	assert.Empty(t, sessions)
+}
+
+func testLoginThrottling(t *testing.T, strg Storage) {
+	login := "user" + randomSuffix()
+	ip := "ip" + randomSuffix()
+	anotherIP := "ip" + randomSuffix()
+
+	failures, err := strg.GetLoginFailures(ctx, login, ip, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, LoginFailures{}, failures)
+
+	require.Nil(t, strg.RecordLoginAttempt(ctx, login, ip, false))
+	require.Nil(t, strg.RecordLoginAttempt(ctx, login, anotherIP, false))
+	require.Nil(t, strg.RecordLoginAttempt(ctx, "another"+login, ip, false))
+	failures, err = strg.GetLoginFailures(ctx, login, ip, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, failures.ByLogin)
+	assert.Equal(t, 2, failures.ByIP)
+	assert.False(t, failures.LastFailure.IsZero())
+
+	require.Nil(t, strg.RecordLoginAttempt(ctx, login, ip, true))
+	failures, err = strg.GetLoginFailures(ctx, login, ip, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, failures.ByLogin, "success resets failures of the login")
+	assert.Equal(t, 2, failures.ByIP, "success does not reset failures of the ip")
+	assert.True(t, failures.LastFailure.IsZero())
+
+	time.Sleep(10 * time.Millisecond)
+	failures, err = strg.GetLoginFailures(ctx, "another"+login, ip, 5*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, LoginFailures{}, failures, "failures outside of the window are not counted")
+
+	_, err = strg.GetLoginLockout(ctx, login, ip)
+	assert.ErrorIs(t, err, ErrLockoutNotFound)
+	_, err = strg.AddLoginLockout(ctx, LoginLockout{Kind: LockoutByLogin, Key: login, Failures: 5}, -time.Second)
+	require.Nil(t, err)
+	_, err = strg.GetLoginLockout(ctx, login, ip)
+	assert.ErrorIs(t, err, ErrLockoutNotFound, "expired lockouts are ignored")
+
+	lockout, err := strg.AddLoginLockout(ctx, LoginLockout{Kind: LockoutByLogin, Key: login, Failures: 5}, time.Minute)
+	require.Nil(t, err)
+	assert.True(t, lockout.LockedUntil.After(lockout.CreatedAt))
+	_, err = strg.AddLoginLockout(ctx, LoginLockout{Kind: LockoutByIP, Key: ip, Failures: 50}, time.Hour)
+	require.Nil(t, err)
+
+	found, err := strg.GetLoginLockout(ctx, login, anotherIP)
+	assert.Nil(t, err)
+	assert.Equal(t, LockoutByLogin, found.Kind)
+	assert.Equal(t, login, found.Key)
+	assert.Equal(t, 5, found.Failures)
+
+	found, err = strg.GetLoginLockout(ctx, login, ip)
+	assert.Nil(t, err)
+	assert.Equal(t, LockoutByIP, found.Kind, "the lockout ending last is returned")
+
+	_, err = strg.GetLoginLockout(ctx, "another"+login, anotherIP)
+	assert.ErrorIs(t, err, ErrLockoutNotFound)
+}
+
+func testPasswordReset(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	userData, err := strg.GetUserByID(ctx, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, userID, userData.UserID)
+	assert.Equal(t, "password", userData.Password)
+	_, err = strg.GetUserByID(ctx, "00000000-0000-0000-0000-000000000000")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	tokenHash := "hash" + randomSuffix()
+	require.Nil(t, strg.CreatePasswordResetToken(ctx, userID, tokenHash, time.Hour))
+	tokenUserID, err := strg.UsePasswordResetToken(ctx, tokenHash)
+	assert.Nil(t, err)
+	assert.Equal(t, userID, tokenUserID)
+	_, err = strg.UsePasswordResetToken(ctx, tokenHash)
+	assert.ErrorIs(t, err, ErrResetTokenNotFound, "tokens are single use")
+
+	expiredHash := "hash" + randomSuffix()
+	require.Nil(t, strg.CreatePasswordResetToken(ctx, userID, expiredHash, -time.Second))
+	_, err = strg.UsePasswordResetToken(ctx, expiredHash)
+	assert.ErrorIs(t, err, ErrResetTokenNotFound)
+	_, err = strg.UsePasswordResetToken(ctx, "unknown"+randomSuffix())
+	assert.ErrorIs(t, err, ErrResetTokenNotFound)
+
+	first, err := strg.CreateSession(ctx, Session{UserID: userID}, time.Hour)
+	require.Nil(t, err)
+	second, err := strg.CreateSession(ctx, Session{UserID: userID}, time.Hour)
+	require.Nil(t, err)
+	another := registerUser(t, strg)
+	anotherSession, err := strg.CreateSession(ctx, Session{UserID: another}, time.Hour)
+	require.Nil(t, err)
+
+	require.Nil(t, strg.RevokeOtherSessions(ctx, userID, first.ID))
+	_, err = strg.TouchSession(ctx, first.ID)
+	assert.Nil(t, err)
+	_, err = strg.TouchSession(ctx, second.ID)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	_, err = strg.TouchSession(ctx, anotherSession.ID)
+	assert.Nil(t, err, "sessions of other users are kept")
+
+	require.Nil(t, strg.RevokeOtherSessions(ctx, userID, ""))
+	_, err = strg.TouchSession(ctx, first.ID)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+}
+
+func testTOTP(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	_, err := strg.GetTOTP(ctx, userID)
+	assert.ErrorIs(t, err, ErrTOTPNotFound)
+	assert.ErrorIs(t, strg.ConfirmTOTP(ctx, userID, 1, nil), ErrTOTPNotFound)
+
+	require.Nil(t, strg.SetTOTPSecret(ctx, userID, "FIRSTSECRET"))
+	require.Nil(t, strg.SetTOTPSecret(ctx, userID, "SECONDSECRET"), "not confirmed secret can be replaced")
+	userTOTP, err := strg.GetTOTP(ctx, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, TOTP{Secret: "SECONDSECRET"}, userTOTP)
+	assert.ErrorIs(t, strg.UseTOTPStep(ctx, userID, 100), ErrTOTPCodeUsed, "not confirmed secret can not be used")
+
+	require.Nil(t, strg.ConfirmTOTP(ctx, userID, 100, []string{"first-hash", "second-hash"}))
+	userTOTP, err = strg.GetTOTP(ctx, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, TOTP{Secret: "SECONDSECRET", Confirmed: true, LastUsedStep: 100}, userTOTP)
+	assert.ErrorIs(t, strg.SetTOTPSecret(ctx, userID, "THIRDSECRET"), ErrTOTPAlreadyEnabled)
+	assert.ErrorIs(t, strg.ConfirmTOTP(ctx, userID, 101, nil), ErrTOTPAlreadyEnabled)
+
+	assert.ErrorIs(t, strg.UseTOTPStep(ctx, userID, 100), ErrTOTPCodeUsed)
+	assert.ErrorIs(t, strg.UseTOTPStep(ctx, userID, 99), ErrTOTPCodeUsed)
+	assert.Nil(t, strg.UseTOTPStep(ctx, userID, 101))
+	assert.ErrorIs(t, strg.UseTOTPStep(ctx, userID, 101), ErrTOTPCodeUsed)
+
+	another := registerUser(t, strg)
+	assert.ErrorIs(t, strg.UseRecoveryCode(ctx, another, "first-hash"), ErrRecoveryCodeNotFound)
+	assert.Nil(t, strg.UseRecoveryCode(ctx, userID, "first-hash"))
+	assert.ErrorIs(t, strg.UseRecoveryCode(ctx, userID, "first-hash"), ErrRecoveryCodeNotFound)
+	assert.Nil(t, strg.UseRecoveryCode(ctx, userID, "second-hash"))
+	assert.ErrorIs(t, strg.UseRecoveryCode(ctx, userID, "unknown-hash"), ErrRecoveryCodeNotFound)
+}
+
+func testRoles(t *testing.T, strg Storage) {
+	login := "user" + randomSuffix()
+	userID, err := strg.Register(ctx, UserAuthData{Login: login, Password: "password"})
+	require.Nil(t, err)
+	userData, err := strg.GetUserByID(ctx, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, RoleUser, userData.Role)
+
+	require.Nil(t, strg.SetUserRole(ctx, login, RoleAdmin))
+	userData, err = strg.GetUserByLogin(ctx, UserAuthData{Login: login})
+	assert.Nil(t, err)
+	assert.Equal(t, RoleAdmin, userData.Role)
+	assert.ErrorIs(t, strg.SetUserRole(ctx, "unknown"+randomSuffix(), RoleAdmin), ErrUserNotFound)
+}
+
+func testRequeueAccrualJob(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	orderNumber := addOrder(t, strg, userID)
+	_, err := strg.RequeueAccrualJob(ctx, "unknown"+randomSuffix())
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+
+	assert.Nil(t, strg.RescheduleAccrualJob(ctx, orderNumber, time.Hour, "got status code 500"))
+	ownerID, err := strg.RequeueAccrualJob(ctx, orderNumber)
+	assert.Nil(t, err)
+	assert.Equal(t, userID, ownerID)
+	job, found := claimJob(t, strg, orderNumber)
+	require.True(t, found, "requeued job must not wait for its backoff")
+	assert.Equal(t, 1, job.Attempts)
+	assert.Empty(t, job.LastError)
+
+	assert.Nil(t, strg.CompleteAccrualJob(ctx, orderNumber))
+	_, err = strg.RequeueAccrualJob(ctx, orderNumber)
+	assert.Nil(t, err)
+	_, found = claimJob(t, strg, orderNumber)
+	assert.True(t, found, "completed job must be added again")
+}
+
+// testRepollFinalOrder checks that final orders are not requeued, and that
+// whatever the accrual system answers when a leftover job of a final order is
+// polled, the order keeps its status and the balance is credited once.
+func testRepollFinalOrder(t *testing.T, strg Storage) {
+	userID := registerUser(t, strg)
+	orderNumber := addOrder(t, strg, userID)
+	accrual := money.FromFloat(100)
+	require.Nil(t, strg.UpdateOrder(ctx, OrderFromBlackBox{Order: orderNumber, Status: "PROCESSED", Accrual: accrual}))
+	require.Nil(t, strg.CompleteAccrualJob(ctx, orderNumber))
+
+	_, err := strg.RequeueAccrualJob(ctx, orderNumber)
+	assert.ErrorIs(t, err, ErrOrderFinal)
+	_, found := claimJob(t, strg, orderNumber)
+	require.False(t, found, "final orders are not requeued")
+	require.Nil(t, strg.AddAccrualJob(ctx, orderNumber))
+	_, found = claimJob(t, strg, orderNumber)
+	require.True(t, found)
+	for _, update := range []OrderFromBlackBox{
+		{Order: orderNumber, Status: "PROCESSING"},
+		{Order: orderNumber, Status: "INVALID"},
+		{Order: orderNumber, Status: "PROCESSED", Accrual: money.FromFloat(250)},
+		{Order: orderNumber, Status: "PROCESSED", Accrual: accrual},
+	} {
+		assert.ErrorIs(t, strg.UpdateOrder(ctx, update), ErrOrderFinal, update.Status)
+	}
+	require.Nil(t, strg.CompleteAccrualJob(ctx, orderNumber))
+	_, found = claimJob(t, strg, orderNumber)
+	assert.False(t, found, "repolled job must complete")
+
+	orders, err := strg.GetOrdersByUser(ctx, userID, ListQuery{})
+	require.Nil(t, err)
+	require.Len(t, orders, 1)
+	assert.Equal(t, "PROCESSED", orders[0].Status)
+	assert.Equal(t, accrual, orders[0].Accrual)
+	balance, err := strg.GetUserBalance(ctx, userID)
+	require.Nil(t, err)
+	assert.Equal(t, UserBalance{Orders: accrual}, balance)
+}
+
+func testBalanceAdjustments(t *testing.T, strg Storage) {
+	adminID := registerUser(t, strg)
+	userID := registerUser(t, strg)
+	accrueToUser(t, strg, userID, money.FromFloat(100))
+
+	balance, err := strg.AdjustBalance(ctx, BalanceAdjustment{UserID: userID, ActorID: adminID, Amount: money.FromFloat(-30.5), Reason: "duplicate accrual"})
+	assert.Nil(t, err)
+	assert.Equal(t, UserBalance{Orders: money.FromFloat(69.5)}, balance)
+	_, err = strg.AdjustBalance(ctx, BalanceAdjustment{UserID: userID, ActorID: adminID, Amount: money.FromFloat(-70), Reason: "too much"})
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	balance, err = strg.AdjustBalance(ctx, BalanceAdjustment{UserID: userID, ActorID: adminID, Amount: money.FromFloat(10), Reason: "goodwill"})
+	assert.Nil(t, err)
+	assert.Equal(t, UserBalance{Orders: money.FromFloat(79.5)}, balance)
+	balance, err = strg.GetUserBalance(ctx, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, UserBalance{Orders: money.FromFloat(79.5)}, balance)
+
+	_, err = strg.AdjustBalance(ctx, BalanceAdjustment{UserID: "ad29ba3c-7eba-4223-9635-fc71e9c1fa28", ActorID: adminID, Amount: money.FromFloat(10), Reason: "unknown"})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	require.Nil(t, strg.AddAuditRecord(ctx, AuditRecord{ActorID: adminID, Action: "user.view", TargetUserID: userID, Details: "balance"}))
+	records, err := strg.GetAuditRecords(ctx, userID, 10)
+	assert.Nil(t, err)
+	require.Len(t, records, 3, "rejected adjustment must not be recorded")
+	assert.Equal(t, "user.view", records[0].Action)
+	assert.Equal(t, AuditBalanceAdjustment, records[1].Action)
+	assert.Equal(t, adminID, records[1].ActorID)
+	assert.Equal(t, userID, records[1].TargetUserID)
+	assert.Equal(t, "amount 10: goodwill", records[1].Details)
+	assert.WithinDuration(t, time.Now(), records[1].CreatedAt, time.Minute)
+	assert.Equal(t, "amount -30.5: duplicate accrual", records[2].Details)
+	assert.False(t, records[2].CreatedAt.IsZero())
+
+	records, err = strg.GetAuditRecords(ctx, userID, 1)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	records, err = strg.GetAuditRecords(ctx, "", 100)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, len(records), 3)
+}
+
+func testDoubleEntryLedger(t *testing.T, strg Storage) {
+	adminID := registerUser(t, strg)
+	userID := registerUser(t, strg)
+	accrueToUser(t, strg, userID, money.FromFloat(100.25))
+	require.Nil(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: randomSuffix(), Sum: money.FromFloat(30.1)}))
+	_, err := strg.AdjustBalance(ctx, BalanceAdjustment{UserID: userID, ActorID: adminID, Amount: money.FromFloat(-5), Reason: "correction"})
+	require.Nil(t, err)
+	_, err = strg.AdjustBalance(ctx, BalanceAdjustment{UserID: userID, ActorID: adminID, Amount: money.FromFloat(2.5), Reason: "goodwill"})
+	require.Nil(t, err)
+	assert.ErrorIs(t, strg.AddWithdrawalForUser(ctx, userID, Withdrawal{Order: randomSuffix(), Sum: money.FromFloat(1000)}), ErrInsufficientFunds)
+
+	assert.Nil(t, strg.VerifyLedger(ctx), "entries of every transaction sum to zero and balances match the entries")
+	balance, err := strg.GetUserBalance(ctx, userID)
+	require.Nil(t, err)
+	assert.Equal(t, UserBalance{Orders: money.FromFloat(67.65), Withdrawn: money.FromFloat(30.1)}, balance)
+}
+
+// testUnbalancedLedgerTransaction checks that PostgreSQL itself rejects ledger
+// entries that do not sum to zero, whatever code writes them.
+func testUnbalancedLedgerTransaction(t *testing.T, strg *DBStorage) {
+	userID := registerUser(t, strg)
+	tx, err := strg.db.BeginTx(ctx, nil)
+	require.Nil(t, err)
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO ledger_entry (transaction_id, account, user_id, kind, amount, reason) VALUES (gen_random_uuid(), 'user', $1, 'adjustment', 10, 'unbalanced')",
+		userID,
+	)
+	require.Nil(t, err)
+	assert.NotNil(t, tx.Commit())
+	assert.Nil(t, strg.VerifyLedger(ctx))
+}
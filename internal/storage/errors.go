@@ -0,0 +1,25 @@
+package storage
+
+import "errors"
+
+var (
+	ErrLoginTaken             = errors.New("login is already taken")
+	ErrUserNotFound           = errors.New("user not found")
+	ErrOrderAlreadyUploaded   = errors.New("order is already uploaded by this user")
+	ErrOrderOwnedByOther      = errors.New("order is already uploaded by another user")
+	ErrOrderNotFound          = errors.New("order not found")
+	ErrOrderFinal             = errors.New("order is already processed or invalid")
+	ErrInsufficientFunds      = errors.New("insufficient funds")
+	ErrSessionNotFound        = errors.New("session not found")
+	ErrLockoutNotFound        = errors.New("lockout not found")
+	ErrResetTokenNotFound     = errors.New("password reset token not found")
+	ErrTOTPNotFound           = errors.New("two-factor authentication is not enrolled")
+	ErrTOTPAlreadyEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTOTPCodeUsed           = errors.New("two-factor code is already used")
+	ErrRecoveryCodeNotFound   = errors.New("recovery code not found")
+	ErrWithdrawalOrderUsed    = errors.New("order is already paid with points")
+	ErrIdempotencyKeyExists   = errors.New("idempotency key is already used")
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+	ErrInvalidCursor          = errors.New("invalid cursor")
+	ErrLedgerUnbalanced       = errors.New("ledger is not balanced")
+)
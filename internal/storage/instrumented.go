@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/metrics"
+	"time"
+)
+
+// InstrumentedStorage measures the latency of every call to the wrapped Storage.
+type InstrumentedStorage struct {
+	storage Storage
+}
+
+func NewInstrumentedStorage(storage Storage) *InstrumentedStorage {
+	return &InstrumentedStorage{storage: storage}
+}
+
+func (s *InstrumentedStorage) Register(ctx context.Context, registerData UserAuthData) (string, error) {
+	defer metrics.ObserveDBQuery("Register", time.Now())
+	return s.storage.Register(ctx, registerData)
+}
+
+func (s *InstrumentedStorage) GetUserByLogin(ctx context.Context, authData UserAuthData) (UserAuthData, error) {
+	defer metrics.ObserveDBQuery("GetUserByLogin", time.Now())
+	return s.storage.GetUserByLogin(ctx, authData)
+}
+
+func (s *InstrumentedStorage) GetUserByID(ctx context.Context, userID string) (UserAuthData, error) {
+	defer metrics.ObserveDBQuery("GetUserByID", time.Now())
+	return s.storage.GetUserByID(ctx, userID)
+}
+
+func (s *InstrumentedStorage) GetOrdersByUser(ctx context.Context, userID string, query ListQuery) ([]Order, error) {
+	defer metrics.ObserveDBQuery("GetOrdersByUser", time.Now())
+	return s.storage.GetOrdersByUser(ctx, userID, query)
+}
+
+func (s *InstrumentedStorage) AddOrderForUser(ctx context.Context, externalOrderID string, userID string) error {
+	defer metrics.ObserveDBQuery("AddOrderForUser", time.Now())
+	return s.storage.AddOrderForUser(ctx, externalOrderID, userID)
+}
+
+func (s *InstrumentedStorage) GetUserBalance(ctx context.Context, userID string) (UserBalance, error) {
+	defer metrics.ObserveDBQuery("GetUserBalance", time.Now())
+	return s.storage.GetUserBalance(ctx, userID)
+}
+
+func (s *InstrumentedStorage) AddWithdrawalForUser(ctx context.Context, userID string, withdrawal Withdrawal) error {
+	defer metrics.ObserveDBQuery("AddWithdrawalForUser", time.Now())
+	return s.storage.AddWithdrawalForUser(ctx, userID, withdrawal)
+}
+
+func (s *InstrumentedStorage) GetWithdrawalsForUser(ctx context.Context, userID string, query ListQuery) ([]Withdrawal, error) {
+	defer metrics.ObserveDBQuery("GetWithdrawalsForUser", time.Now())
+	return s.storage.GetWithdrawalsForUser(ctx, userID, query)
+}
+
+func (s *InstrumentedStorage) GetOrdersInProgress(ctx context.Context) ([]Order, error) {
+	defer metrics.ObserveDBQuery("GetOrdersInProgress", time.Now())
+	return s.storage.GetOrdersInProgress(ctx)
+}
+
+func (s *InstrumentedStorage) UpdateOrder(ctx context.Context, order OrderFromBlackBox) error {
+	defer metrics.ObserveDBQuery("UpdateOrder", time.Now())
+	return s.storage.UpdateOrder(ctx, order)
+}
+
+func (s *InstrumentedStorage) UpdatePasswordHash(ctx context.Context, userID string, passwordHash string) error {
+	defer metrics.ObserveDBQuery("UpdatePasswordHash", time.Now())
+	return s.storage.UpdatePasswordHash(ctx, userID, passwordHash)
+}
+
+func (s *InstrumentedStorage) AddAccrualJob(ctx context.Context, orderNumber string) error {
+	defer metrics.ObserveDBQuery("AddAccrualJob", time.Now())
+	return s.storage.AddAccrualJob(ctx, orderNumber)
+}
+
+func (s *InstrumentedStorage) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]AccrualJob, error) {
+	defer metrics.ObserveDBQuery("ClaimAccrualJobs", time.Now())
+	return s.storage.ClaimAccrualJobs(ctx, limit, lease)
+}
+
+func (s *InstrumentedStorage) RescheduleAccrualJob(ctx context.Context, orderNumber string, delay time.Duration, lastError string) error {
+	defer metrics.ObserveDBQuery("RescheduleAccrualJob", time.Now())
+	return s.storage.RescheduleAccrualJob(ctx, orderNumber, delay, lastError)
+}
+
+func (s *InstrumentedStorage) CompleteAccrualJob(ctx context.Context, orderNumber string) error {
+	defer metrics.ObserveDBQuery("CompleteAccrualJob", time.Now())
+	return s.storage.CompleteAccrualJob(ctx, orderNumber)
+}
+
+func (s *InstrumentedStorage) CreateSession(ctx context.Context, session Session, ttl time.Duration) (Session, error) {
+	defer metrics.ObserveDBQuery("CreateSession", time.Now())
+	return s.storage.CreateSession(ctx, session, ttl)
+}
+
+func (s *InstrumentedStorage) TouchSession(ctx context.Context, sessionID string) (Session, error) {
+	defer metrics.ObserveDBQuery("TouchSession", time.Now())
+	return s.storage.TouchSession(ctx, sessionID)
+}
+
+func (s *InstrumentedStorage) GetSessionsForUser(ctx context.Context, userID string) ([]Session, error) {
+	defer metrics.ObserveDBQuery("GetSessionsForUser", time.Now())
+	return s.storage.GetSessionsForUser(ctx, userID)
+}
+
+func (s *InstrumentedStorage) RevokeSession(ctx context.Context, userID string, sessionID string) error {
+	defer metrics.ObserveDBQuery("RevokeSession", time.Now())
+	return s.storage.RevokeSession(ctx, userID, sessionID)
+}
+
+func (s *InstrumentedStorage) RevokeOtherSessions(ctx context.Context, userID string, keepSessionID string) error {
+	defer metrics.ObserveDBQuery("RevokeOtherSessions", time.Now())
+	return s.storage.RevokeOtherSessions(ctx, userID, keepSessionID)
+}
+
+func (s *InstrumentedStorage) CreatePasswordResetToken(ctx context.Context, userID string, tokenHash string, ttl time.Duration) error {
+	defer metrics.ObserveDBQuery("CreatePasswordResetToken", time.Now())
+	return s.storage.CreatePasswordResetToken(ctx, userID, tokenHash, ttl)
+}
+
+func (s *InstrumentedStorage) UsePasswordResetToken(ctx context.Context, tokenHash string) (string, error) {
+	defer metrics.ObserveDBQuery("UsePasswordResetToken", time.Now())
+	return s.storage.UsePasswordResetToken(ctx, tokenHash)
+}
+
+func (s *InstrumentedStorage) SetTOTPSecret(ctx context.Context, userID string, secret string) error {
+	defer metrics.ObserveDBQuery("SetTOTPSecret", time.Now())
+	return s.storage.SetTOTPSecret(ctx, userID, secret)
+}
+
+func (s *InstrumentedStorage) GetTOTP(ctx context.Context, userID string) (TOTP, error) {
+	defer metrics.ObserveDBQuery("GetTOTP", time.Now())
+	return s.storage.GetTOTP(ctx, userID)
+}
+
+func (s *InstrumentedStorage) ConfirmTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error {
+	defer metrics.ObserveDBQuery("ConfirmTOTP", time.Now())
+	return s.storage.ConfirmTOTP(ctx, userID, step, recoveryCodeHashes)
+}
+
+func (s *InstrumentedStorage) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	defer metrics.ObserveDBQuery("UseTOTPStep", time.Now())
+	return s.storage.UseTOTPStep(ctx, userID, step)
+}
+
+func (s *InstrumentedStorage) UseRecoveryCode(ctx context.Context, userID string, codeHash string) error {
+	defer metrics.ObserveDBQuery("UseRecoveryCode", time.Now())
+	return s.storage.UseRecoveryCode(ctx, userID, codeHash)
+}
+
+func (s *InstrumentedStorage) RecordLoginAttempt(ctx context.Context, login string, ip string, succeeded bool) error {
+	defer metrics.ObserveDBQuery("RecordLoginAttempt", time.Now())
+	return s.storage.RecordLoginAttempt(ctx, login, ip, succeeded)
+}
+
+func (s *InstrumentedStorage) GetLoginFailures(ctx context.Context, login string, ip string, window time.Duration) (LoginFailures, error) {
+	defer metrics.ObserveDBQuery("GetLoginFailures", time.Now())
+	return s.storage.GetLoginFailures(ctx, login, ip, window)
+}
+
+func (s *InstrumentedStorage) AddLoginLockout(ctx context.Context, lockout LoginLockout, duration time.Duration) (LoginLockout, error) {
+	defer metrics.ObserveDBQuery("AddLoginLockout", time.Now())
+	return s.storage.AddLoginLockout(ctx, lockout, duration)
+}
+
+func (s *InstrumentedStorage) GetLoginLockout(ctx context.Context, login string, ip string) (LoginLockout, error) {
+	defer metrics.ObserveDBQuery("GetLoginLockout", time.Now())
+	return s.storage.GetLoginLockout(ctx, login, ip)
+}
+
+func (s *InstrumentedStorage) SetUserRole(ctx context.Context, login string, role string) error {
+	defer metrics.ObserveDBQuery("SetUserRole", time.Now())
+	return s.storage.SetUserRole(ctx, login, role)
+}
+
+func (s *InstrumentedStorage) RequeueAccrualJob(ctx context.Context, orderNumber string) (string, error) {
+	defer metrics.ObserveDBQuery("RequeueAccrualJob", time.Now())
+	return s.storage.RequeueAccrualJob(ctx, orderNumber)
+}
+
+func (s *InstrumentedStorage) AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) (UserBalance, error) {
+	defer metrics.ObserveDBQuery("AdjustBalance", time.Now())
+	return s.storage.AdjustBalance(ctx, adjustment)
+}
+
+func (s *InstrumentedStorage) AddAuditRecord(ctx context.Context, record AuditRecord) error {
+	defer metrics.ObserveDBQuery("AddAuditRecord", time.Now())
+	return s.storage.AddAuditRecord(ctx, record)
+}
+
+func (s *InstrumentedStorage) GetAuditRecords(ctx context.Context, targetUserID string, limit int) ([]AuditRecord, error) {
+	defer metrics.ObserveDBQuery("GetAuditRecords", time.Now())
+	return s.storage.GetAuditRecords(ctx, targetUserID, limit)
+}
+
+func (s *InstrumentedStorage) CreateIdempotencyKey(ctx context.Context, record IdempotencyRecord, ttl time.Duration, lease time.Duration) error {
+	defer metrics.ObserveDBQuery("CreateIdempotencyKey", time.Now())
+	return s.storage.CreateIdempotencyKey(ctx, record, ttl, lease)
+}
+
+func (s *InstrumentedStorage) GetIdempotencyKey(ctx context.Context, userID string, key string) (IdempotencyRecord, error) {
+	defer metrics.ObserveDBQuery("GetIdempotencyKey", time.Now())
+	return s.storage.GetIdempotencyKey(ctx, userID, key)
+}
+
+func (s *InstrumentedStorage) SaveIdempotentResponse(ctx context.Context, record IdempotencyRecord) error {
+	defer metrics.ObserveDBQuery("SaveIdempotentResponse", time.Now())
+	return s.storage.SaveIdempotentResponse(ctx, record)
+}
+
+func (s *InstrumentedStorage) DeleteIdempotencyKey(ctx context.Context, userID string, key string) error {
+	defer metrics.ObserveDBQuery("DeleteIdempotencyKey", time.Now())
+	return s.storage.DeleteIdempotencyKey(ctx, userID, key)
+}
+
+func (s *InstrumentedStorage) Ping(ctx context.Context) error {
+	defer metrics.ObserveDBQuery("Ping", time.Now())
+	return s.storage.Ping(ctx)
+}
+
+func (s *InstrumentedStorage) SchemaVersion(ctx context.Context) (uint, bool, error) {
+	defer metrics.ObserveDBQuery("SchemaVersion", time.Now())
+	return s.storage.SchemaVersion(ctx)
+}
+
+func (s *InstrumentedStorage) VerifyLedger(ctx context.Context) error {
+	defer metrics.ObserveDBQuery("VerifyLedger", time.Now())
+	return s.storage.VerifyLedger(ctx)
+}
+
+func (s *InstrumentedStorage) Close() error {
+	return s.storage.Close()
+}
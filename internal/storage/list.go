@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListQuery selects a page of orders or withdrawals of a user. Items are sorted
+// by time oldest first and then by order number, so pages are stable.
+// Zero Limit means no limit, zero From and To mean no bound, To is exclusive.
+type ListQuery struct {
+	Limit    int
+	After    *Cursor
+	Statuses []string
+	From     time.Time
+	To       time.Time
+}
+
+// Cursor points at the last item of the previous page.
+type Cursor struct {
+	Time time.Time
+	Key  string
+}
+
+// String encodes the cursor into an opaque url safe value.
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.Time.UnixNano(), 10) + ":" + c.Key))
+}
+
+func ParseCursor(value string) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	nanos, key, found := strings.Cut(string(data), ":")
+	if !found || key == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+	unixNano, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{Time: time.Unix(0, unixNano).UTC(), Key: key}, nil
+}
+
+// sqlConditions returns the WHERE conditions and the LIMIT of the query for
+// columns of the item time, order number and status, args are appended to.
+// The time column is timestamptz, so bounds compare as instants in any time zone.
+func (q ListQuery) sqlConditions(timeColumn string, keyColumn string, statusColumn string, args []interface{}) (string, []interface{}) {
+	var conditions strings.Builder
+	if q.After != nil {
+		args = append(args, q.After.Time, q.After.Key)
+		fmt.Fprintf(&conditions, " AND (%s, %s) > ($%d, $%d)", timeColumn, keyColumn, len(args)-1, len(args))
+	}
+	if len(q.Statuses) > 0 {
+		placeholders := make([]string, 0, len(q.Statuses))
+		for _, status := range q.Statuses {
+			args = append(args, status)
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+		}
+		fmt.Fprintf(&conditions, " AND %s IN (%s)", statusColumn, strings.Join(placeholders, ", "))
+	}
+	if !q.From.IsZero() {
+		args = append(args, q.From)
+		fmt.Fprintf(&conditions, " AND %s >= $%d", timeColumn, len(args))
+	}
+	if !q.To.IsZero() {
+		args = append(args, q.To)
+		fmt.Fprintf(&conditions, " AND %s < $%d", timeColumn, len(args))
+	}
+	fmt.Fprintf(&conditions, " ORDER BY %s, %s", timeColumn, keyColumn)
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		fmt.Fprintf(&conditions, " LIMIT $%d", len(args))
+	}
+	return conditions.String(), args
+}
+
+// matches is the in-memory equivalent of sqlConditions without ordering and limit.
+func (q ListQuery) matches(itemTime time.Time, key string, status string) bool {
+	if q.After != nil && !itemTime.After(q.After.Time) && !(itemTime.Equal(q.After.Time) && key > q.After.Key) {
+		return false
+	}
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, wanted := range q.Statuses {
+			found = found || wanted == status
+		}
+		if !found {
+			return false
+		}
+	}
+	if !q.From.IsZero() && itemTime.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !itemTime.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// listLess orders items like sqlConditions does.
+func listLess(leftTime time.Time, leftKey string, rightTime time.Time, rightKey string) bool {
+	if !leftTime.Equal(rightTime) {
+		return leftTime.Before(rightTime)
+	}
+	return leftKey < rightKey
+}
+
+// limited returns how many of n sorted items fit into the page.
+func (q ListQuery) limited(n int) int {
+	if q.Limit > 0 && n > q.Limit {
+		return q.Limit
+	}
+	return n
+}
@@ -0,0 +1,767 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/money"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memOrder struct {
+	userID     string
+	number     string
+	status     string
+	accrual    money.Amount
+	uploadedAt time.Time
+}
+
+type memWithdrawal struct {
+	userID     string
+	withdrawal Withdrawal
+}
+
+type memLedgerEntry struct {
+	transaction int
+	account     string
+	userID      string
+	kind        string
+	amount      money.Amount
+	orderNumber string
+	reason      string
+	createdAt   time.Time
+}
+
+type memAccrualJob struct {
+	job           AccrualJob
+	nextAttemptAt time.Time
+	lockedUntil   time.Time
+}
+
+// MemStorage keeps all data in process memory and follows the same rules as DBStorage.
+// It is meant for local development and tests, all data is lost on restart.
+type MemStorage struct {
+	mu          sync.Mutex
+	logger      *slog.Logger
+	users       map[string]UserAuthData
+	userIDs     map[string]string
+	orders      map[string]*memOrder
+	ordersOrder []*memOrder
+	withdrawals []memWithdrawal
+	ledger      []memLedgerEntry
+	ledgerTxs   int
+	balances    map[string]*UserBalance
+	jobs        map[string]*memAccrualJob
+	sessions    map[string]*memSession
+	attempts    []memLoginAttempt
+	lockouts    []LoginLockout
+	resetTokens map[string]*memResetToken
+	totps       map[string]*memTOTP
+	audit       []AuditRecord
+	idempotency map[string]*memIdempotencyRecord
+}
+
+type memIdempotencyRecord struct {
+	record      IdempotencyRecord
+	expiresAt   time.Time
+	lockedUntil time.Time
+}
+
+type memTOTP struct {
+	totp          TOTP
+	recoveryCodes map[string]bool
+}
+
+type memResetToken struct {
+	userID    string
+	expiresAt time.Time
+	used      bool
+}
+
+type memLoginAttempt struct {
+	login       string
+	ip          string
+	succeeded   bool
+	attemptedAt time.Time
+}
+
+type memSession struct {
+	session   Session
+	revokedAt time.Time
+}
+
+func (s *memSession) isActive(now time.Time) bool {
+	return s.revokedAt.IsZero() && s.session.ExpiresAt.After(now)
+}
+
+func NewMemStorage(logger *slog.Logger) *MemStorage {
+	return &MemStorage{
+		logger:      logger,
+		users:       make(map[string]UserAuthData),
+		userIDs:     make(map[string]string),
+		orders:      make(map[string]*memOrder),
+		balances:    make(map[string]*UserBalance),
+		jobs:        make(map[string]*memAccrualJob),
+		sessions:    make(map[string]*memSession),
+		resetTokens: make(map[string]*memResetToken),
+		totps:       make(map[string]*memTOTP),
+		idempotency: make(map[string]*memIdempotencyRecord),
+	}
+}
+
+func newUUID() (string, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	data[6] = (data[6] & 0x0f) | 0x40
+	data[8] = (data[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", data[0:4], data[4:6], data[6:8], data[8:10], data[10:16]), nil
+}
+
+func (strg *MemStorage) Close() error {
+	return nil
+}
+
+func (strg *MemStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+// SchemaVersion always returns 0, MemStorage has no schema to migrate.
+func (strg *MemStorage) SchemaVersion(ctx context.Context) (uint, bool, error) {
+	return 0, false, nil
+}
+
+func (strg *MemStorage) Register(ctx context.Context, registerData UserAuthData) (string, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	if _, ok := strg.users[registerData.Login]; ok {
+		strg.logger.DebugContext(ctx, "Got existing user", "login", registerData.Login)
+		return "", ErrLoginTaken
+	}
+	userID, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	strg.users[registerData.Login] = UserAuthData{Login: registerData.Login, Password: registerData.Password, UserID: userID, Role: RoleUser}
+	strg.userIDs[userID] = registerData.Login
+	strg.balances[userID] = &UserBalance{}
+	strg.logger.InfoContext(ctx, "Registered user", "user_id", userID)
+	return userID, nil
+}
+
+func (strg *MemStorage) GetUserByLogin(ctx context.Context, authData UserAuthData) (UserAuthData, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	userData, ok := strg.users[authData.Login]
+	if !ok {
+		strg.logger.DebugContext(ctx, "Got unknown login", "login", authData.Login)
+		return UserAuthData{}, ErrUserNotFound
+	}
+	return userData, nil
+}
+
+func (strg *MemStorage) GetUserByID(ctx context.Context, userID string) (UserAuthData, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	login, ok := strg.userIDs[userID]
+	if !ok {
+		return UserAuthData{}, ErrUserNotFound
+	}
+	return strg.users[login], nil
+}
+
+func (strg *MemStorage) UpdatePasswordHash(ctx context.Context, userID string, passwordHash string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	login, ok := strg.userIDs[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	userData := strg.users[login]
+	userData.Password = passwordHash
+	strg.users[login] = userData
+	return nil
+}
+
+func (strg *MemStorage) AddOrderForUser(ctx context.Context, externalOrderID string, userID string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	if order, ok := strg.orders[externalOrderID]; ok {
+		if order.userID == userID {
+			strg.logger.DebugContext(ctx, "Got order uploaded by the same user", "user_id", userID, "order", externalOrderID)
+			return ErrOrderAlreadyUploaded
+		}
+		strg.logger.InfoContext(ctx, "Got order uploaded by another user", "user_id", userID, "owner_id", order.userID, "order", externalOrderID)
+		return ErrOrderOwnedByOther
+	}
+	if _, ok := strg.userIDs[userID]; !ok {
+		return fmt.Errorf("unknown user %s", userID)
+	}
+	order := &memOrder{userID: userID, number: externalOrderID, status: "NEW", uploadedAt: time.Now()}
+	strg.orders[externalOrderID] = order
+	strg.ordersOrder = append(strg.ordersOrder, order)
+	strg.addAccrualJob(externalOrderID)
+	strg.logger.InfoContext(ctx, "Added order", "user_id", userID, "order", externalOrderID)
+	return nil
+}
+
+func (strg *MemStorage) GetOrdersByUser(ctx context.Context, userID string, query ListQuery) ([]Order, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	orders := make([]Order, 0)
+	for _, order := range strg.ordersOrder {
+		if order.userID == userID && query.matches(order.uploadedAt, order.number, order.status) {
+			orders = append(orders, Order{Number: order.number, Status: order.status, Accrual: order.accrual, UploadedAt: order.uploadedAt})
+		}
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		return listLess(orders[i].UploadedAt, orders[i].Number, orders[j].UploadedAt, orders[j].Number)
+	})
+	return orders[:query.limited(len(orders))], nil
+}
+
+func (strg *MemStorage) GetUserBalance(ctx context.Context, userID string) (UserBalance, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	balance, ok := strg.balances[userID]
+	if !ok {
+		return UserBalance{0, 0}, nil
+	}
+	return *balance, nil
+}
+
+func (strg *MemStorage) AddWithdrawalForUser(ctx context.Context, userID string, withdrawal Withdrawal) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	if _, ok := strg.userIDs[userID]; !ok {
+		return fmt.Errorf("unknown user %s", userID)
+	}
+	for _, existing := range strg.withdrawals {
+		if existing.withdrawal.Order == withdrawal.Order {
+			strg.logger.InfoContext(ctx, "Got already paid order", "user_id", userID, "order", withdrawal.Order)
+			return ErrWithdrawalOrderUsed
+		}
+	}
+	balance := strg.balance(userID)
+	if balance.Orders < withdrawal.Sum {
+		strg.logger.InfoContext(ctx, "Got insufficient funds for withdrawal", "user_id", userID, "balance", balance.Orders, "sum", withdrawal.Sum)
+		return ErrInsufficientFunds
+	}
+	withdrawal.ProcessedAt = time.Now()
+	strg.withdrawals = append(strg.withdrawals, memWithdrawal{userID: userID, withdrawal: withdrawal})
+	strg.postLedgerTransaction(memLedgerEntry{userID: userID, kind: "withdrawal", amount: -withdrawal.Sum, orderNumber: withdrawal.Order, createdAt: withdrawal.ProcessedAt})
+	balance.Orders -= withdrawal.Sum
+	balance.Withdrawn += withdrawal.Sum
+	return nil
+}
+
+func (strg *MemStorage) GetWithdrawalsForUser(ctx context.Context, userID string, query ListQuery) ([]Withdrawal, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	withdrawals := make([]Withdrawal, 0)
+	for _, withdrawal := range strg.withdrawals {
+		if withdrawal.userID == userID && query.matches(withdrawal.withdrawal.ProcessedAt, withdrawal.withdrawal.Order, "") {
+			withdrawals = append(withdrawals, withdrawal.withdrawal)
+		}
+	}
+	sort.SliceStable(withdrawals, func(i, j int) bool {
+		return listLess(withdrawals[i].ProcessedAt, withdrawals[i].Order, withdrawals[j].ProcessedAt, withdrawals[j].Order)
+	})
+	return withdrawals[:query.limited(len(withdrawals))], nil
+}
+
+func (strg *MemStorage) GetOrdersInProgress(ctx context.Context) ([]Order, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	orders := make([]Order, 0)
+	for _, order := range strg.ordersOrder {
+		if order.status != "INVALID" && order.status != "PROCESSED" {
+			orders = append(orders, Order{Number: order.number, Status: order.status, Accrual: order.accrual})
+		}
+	}
+	return orders, nil
+}
+
+func (strg *MemStorage) UpdateOrder(ctx context.Context, order OrderFromBlackBox) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	storedOrder, ok := strg.orders[order.Order]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if isFinalOrderStatus(storedOrder.status) {
+		return ErrOrderFinal
+	}
+	storedOrder.status = order.Status
+	storedOrder.accrual = order.Accrual
+	if order.Status == "PROCESSED" && order.Accrual > 0 {
+		strg.postLedgerTransaction(memLedgerEntry{userID: storedOrder.userID, kind: "accrual", amount: order.Accrual, orderNumber: order.Order, createdAt: time.Now()})
+		strg.balance(storedOrder.userID).Orders += order.Accrual
+	}
+	return nil
+}
+
+// postLedgerTransaction appends the entry of the user and the opposite entry
+// of the system account of its kind as one ledger transaction.
+func (strg *MemStorage) postLedgerTransaction(entry memLedgerEntry) {
+	strg.ledgerTxs++
+	entry.transaction = strg.ledgerTxs
+	entry.account = "user"
+	counter := entry
+	counter.account = ledgerSystemAccounts[entry.kind]
+	counter.userID = ""
+	counter.amount = -entry.amount
+	strg.ledger = append(strg.ledger, entry, counter)
+}
+
+func (strg *MemStorage) VerifyLedger(ctx context.Context) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	transactions := make(map[int]money.Amount)
+	users := make(map[string]money.Amount)
+	for _, entry := range strg.ledger {
+		transactions[entry.transaction] += entry.amount
+		if entry.account == "user" {
+			users[entry.userID] += entry.amount
+		}
+	}
+	for transaction, sum := range transactions {
+		if sum != 0 {
+			return fmt.Errorf("%w: transaction %d sums to %s", ErrLedgerUnbalanced, transaction, sum)
+		}
+	}
+	for userID, balance := range strg.balances {
+		if balance.Orders != users[userID] {
+			return fmt.Errorf("%w: balance of user %s differs from its entries", ErrLedgerUnbalanced, userID)
+		}
+	}
+	return nil
+}
+
+func (strg *MemStorage) balance(userID string) *UserBalance {
+	balance, ok := strg.balances[userID]
+	if !ok {
+		balance = &UserBalance{}
+		strg.balances[userID] = balance
+	}
+	return balance
+}
+
+func (strg *MemStorage) AddAccrualJob(ctx context.Context, orderNumber string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	strg.addAccrualJob(orderNumber)
+	return nil
+}
+
+func (strg *MemStorage) addAccrualJob(orderNumber string) {
+	if _, ok := strg.jobs[orderNumber]; ok {
+		return
+	}
+	strg.jobs[orderNumber] = &memAccrualJob{job: AccrualJob{OrderNumber: orderNumber}, nextAttemptAt: time.Now()}
+}
+
+func (strg *MemStorage) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]AccrualJob, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	now := time.Now()
+	ready := make([]*memAccrualJob, 0)
+	for _, job := range strg.jobs {
+		if !job.nextAttemptAt.After(now) && !job.lockedUntil.After(now) {
+			ready = append(ready, job)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].nextAttemptAt.Before(ready[j].nextAttemptAt)
+	})
+	if len(ready) > limit {
+		ready = ready[:limit]
+	}
+	jobs := make([]AccrualJob, 0, len(ready))
+	for _, job := range ready {
+		job.job.Attempts++
+		job.lockedUntil = now.Add(lease)
+		jobs = append(jobs, job.job)
+	}
+	return jobs, nil
+}
+
+func (strg *MemStorage) RescheduleAccrualJob(ctx context.Context, orderNumber string, delay time.Duration, lastError string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	job, ok := strg.jobs[orderNumber]
+	if !ok {
+		return nil
+	}
+	job.nextAttemptAt = time.Now().Add(delay)
+	job.lockedUntil = time.Time{}
+	job.job.LastError = lastError
+	if lastError == "" {
+		job.job.Attempts = 0
+	}
+	return nil
+}
+
+func (strg *MemStorage) CompleteAccrualJob(ctx context.Context, orderNumber string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	delete(strg.jobs, orderNumber)
+	return nil
+}
+
+func (strg *MemStorage) CreateSession(ctx context.Context, session Session, ttl time.Duration) (Session, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	if _, ok := strg.userIDs[session.UserID]; !ok {
+		return Session{}, fmt.Errorf("unknown user %s", session.UserID)
+	}
+	sessionID, err := newUUID()
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now()
+	session.ID = sessionID
+	session.CreatedAt = now
+	session.LastSeen = now
+	session.ExpiresAt = now.Add(ttl)
+	strg.sessions[sessionID] = &memSession{session: session}
+	return session, nil
+}
+
+func (strg *MemStorage) TouchSession(ctx context.Context, sessionID string) (Session, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	now := time.Now()
+	session, ok := strg.sessions[sessionID]
+	if !ok || !session.isActive(now) {
+		return Session{}, ErrSessionNotFound
+	}
+	session.session.LastSeen = now
+	return session.session, nil
+}
+
+func (strg *MemStorage) GetSessionsForUser(ctx context.Context, userID string) ([]Session, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	now := time.Now()
+	sessions := make([]Session, 0)
+	for _, session := range strg.sessions {
+		if session.session.UserID == userID && session.isActive(now) {
+			sessions = append(sessions, session.session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+func (strg *MemStorage) RevokeSession(ctx context.Context, userID string, sessionID string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	now := time.Now()
+	session, ok := strg.sessions[sessionID]
+	if !ok || session.session.UserID != userID || !session.isActive(now) {
+		return ErrSessionNotFound
+	}
+	session.revokedAt = now
+	return nil
+}
+
+func (strg *MemStorage) RevokeOtherSessions(ctx context.Context, userID string, keepSessionID string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	now := time.Now()
+	for sessionID, session := range strg.sessions {
+		if session.session.UserID == userID && sessionID != keepSessionID && session.isActive(now) {
+			session.revokedAt = now
+		}
+	}
+	return nil
+}
+
+func (strg *MemStorage) CreatePasswordResetToken(ctx context.Context, userID string, tokenHash string, ttl time.Duration) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	if _, ok := strg.userIDs[userID]; !ok {
+		return fmt.Errorf("unknown user %s", userID)
+	}
+	if _, ok := strg.resetTokens[tokenHash]; ok {
+		return fmt.Errorf("duplicate password reset token")
+	}
+	strg.resetTokens[tokenHash] = &memResetToken{userID: userID, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (strg *MemStorage) UsePasswordResetToken(ctx context.Context, tokenHash string) (string, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	token, ok := strg.resetTokens[tokenHash]
+	if !ok || token.used || !token.expiresAt.After(time.Now()) {
+		return "", ErrResetTokenNotFound
+	}
+	token.used = true
+	return token.userID, nil
+}
+
+func (strg *MemStorage) SetTOTPSecret(ctx context.Context, userID string, secret string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	if _, ok := strg.userIDs[userID]; !ok {
+		return fmt.Errorf("unknown user %s", userID)
+	}
+	if userTOTP, ok := strg.totps[userID]; ok && userTOTP.totp.Confirmed {
+		return ErrTOTPAlreadyEnabled
+	}
+	strg.totps[userID] = &memTOTP{totp: TOTP{Secret: secret}}
+	return nil
+}
+
+func (strg *MemStorage) GetTOTP(ctx context.Context, userID string) (TOTP, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	userTOTP, ok := strg.totps[userID]
+	if !ok {
+		return TOTP{}, ErrTOTPNotFound
+	}
+	return userTOTP.totp, nil
+}
+
+func (strg *MemStorage) ConfirmTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	userTOTP, ok := strg.totps[userID]
+	if !ok {
+		return ErrTOTPNotFound
+	}
+	if userTOTP.totp.Confirmed {
+		return ErrTOTPAlreadyEnabled
+	}
+	userTOTP.totp.Confirmed = true
+	userTOTP.totp.LastUsedStep = step
+	userTOTP.recoveryCodes = make(map[string]bool, len(recoveryCodeHashes))
+	for _, codeHash := range recoveryCodeHashes {
+		userTOTP.recoveryCodes[codeHash] = true
+	}
+	return nil
+}
+
+func (strg *MemStorage) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	userTOTP, ok := strg.totps[userID]
+	if !ok || !userTOTP.totp.Confirmed || userTOTP.totp.LastUsedStep >= step {
+		return ErrTOTPCodeUsed
+	}
+	userTOTP.totp.LastUsedStep = step
+	return nil
+}
+
+func (strg *MemStorage) UseRecoveryCode(ctx context.Context, userID string, codeHash string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	userTOTP, ok := strg.totps[userID]
+	if !ok || !userTOTP.recoveryCodes[codeHash] {
+		return ErrRecoveryCodeNotFound
+	}
+	delete(userTOTP.recoveryCodes, codeHash)
+	return nil
+}
+
+func (strg *MemStorage) RecordLoginAttempt(ctx context.Context, login string, ip string, succeeded bool) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	strg.attempts = append(strg.attempts, memLoginAttempt{login: login, ip: ip, succeeded: succeeded, attemptedAt: time.Now()})
+	return nil
+}
+
+func (strg *MemStorage) GetLoginFailures(ctx context.Context, login string, ip string, window time.Duration) (LoginFailures, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	since := time.Now().Add(-window)
+	var failures LoginFailures
+	for _, attempt := range strg.attempts {
+		if !attempt.attemptedAt.After(since) {
+			continue
+		}
+		if attempt.login == login {
+			if attempt.succeeded {
+				failures.ByLogin = 0
+				failures.LastFailure = time.Time{}
+			} else {
+				failures.ByLogin++
+				failures.LastFailure = attempt.attemptedAt
+			}
+		}
+		if attempt.ip == ip && !attempt.succeeded {
+			failures.ByIP++
+		}
+	}
+	return failures, nil
+}
+
+func (strg *MemStorage) AddLoginLockout(ctx context.Context, lockout LoginLockout, duration time.Duration) (LoginLockout, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	lockout.CreatedAt = time.Now()
+	lockout.LockedUntil = lockout.CreatedAt.Add(duration)
+	strg.lockouts = append(strg.lockouts, lockout)
+	return lockout, nil
+}
+
+func (strg *MemStorage) GetLoginLockout(ctx context.Context, login string, ip string) (LoginLockout, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	now := time.Now()
+	var found LoginLockout
+	for _, lockout := range strg.lockouts {
+		matches := (lockout.Kind == LockoutByLogin && lockout.Key == login) || (lockout.Kind == LockoutByIP && lockout.Key == ip)
+		if matches && lockout.LockedUntil.After(now) && lockout.LockedUntil.After(found.LockedUntil) {
+			found = lockout
+		}
+	}
+	if found.LockedUntil.IsZero() {
+		return LoginLockout{}, ErrLockoutNotFound
+	}
+	return found, nil
+}
+
+func (strg *MemStorage) SetUserRole(ctx context.Context, login string, role string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	userData, ok := strg.users[login]
+	if !ok {
+		return ErrUserNotFound
+	}
+	userData.Role = role
+	strg.users[login] = userData
+	return nil
+}
+
+func (strg *MemStorage) RequeueAccrualJob(ctx context.Context, orderNumber string) (string, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	order, ok := strg.orders[orderNumber]
+	if !ok {
+		return "", ErrOrderNotFound
+	}
+	if isFinalOrderStatus(order.status) {
+		return "", ErrOrderFinal
+	}
+	job, ok := strg.jobs[orderNumber]
+	if !ok {
+		strg.addAccrualJob(orderNumber)
+		return order.userID, nil
+	}
+	job.job.Attempts = 0
+	job.job.LastError = ""
+	job.nextAttemptAt = time.Now()
+	return order.userID, nil
+}
+
+func (strg *MemStorage) AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) (UserBalance, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	if _, ok := strg.userIDs[adjustment.UserID]; !ok {
+		return UserBalance{}, ErrUserNotFound
+	}
+	balance := strg.balance(adjustment.UserID)
+	if balance.Orders+adjustment.Amount < 0 {
+		strg.logger.InfoContext(ctx, "Got adjustment bigger than balance", "user_id", adjustment.UserID, "amount", adjustment.Amount, "balance", balance.Orders)
+		return UserBalance{}, ErrInsufficientFunds
+	}
+	now := time.Now()
+	strg.postLedgerTransaction(memLedgerEntry{userID: adjustment.UserID, kind: "adjustment", amount: adjustment.Amount, reason: adjustment.Reason, createdAt: now})
+	balance.Orders += adjustment.Amount
+	strg.addAuditRecord(AuditRecord{
+		ActorID:      adjustment.ActorID,
+		Action:       AuditBalanceAdjustment,
+		TargetUserID: adjustment.UserID,
+		Details:      fmt.Sprintf("amount %s: %s", adjustment.Amount, adjustment.Reason),
+		CreatedAt:    now,
+	})
+	return *balance, nil
+}
+
+func (strg *MemStorage) AddAuditRecord(ctx context.Context, record AuditRecord) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	record.CreatedAt = time.Now()
+	strg.addAuditRecord(record)
+	return nil
+}
+
+func (strg *MemStorage) addAuditRecord(record AuditRecord) {
+	record.ID = int64(len(strg.audit) + 1)
+	strg.audit = append(strg.audit, record)
+}
+
+func (strg *MemStorage) GetAuditRecords(ctx context.Context, targetUserID string, limit int) ([]AuditRecord, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	records := make([]AuditRecord, 0)
+	for i := len(strg.audit) - 1; i >= 0 && len(records) < limit; i-- {
+		if targetUserID == "" || strg.audit[i].TargetUserID == targetUserID {
+			records = append(records, strg.audit[i])
+		}
+	}
+	return records, nil
+}
+
+func idempotencyMapKey(userID string, key string) string {
+	return userID + "\x00" + key
+}
+
+func (strg *MemStorage) CreateIdempotencyKey(ctx context.Context, record IdempotencyRecord, ttl time.Duration, lease time.Duration) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	now := time.Now()
+	mapKey := idempotencyMapKey(record.UserID, record.Key)
+	if existing, ok := strg.idempotency[mapKey]; ok && existing.expiresAt.After(now) {
+		if existing.record.StatusCode != 0 || existing.record.RequestHash != record.RequestHash || existing.lockedUntil.After(now) {
+			return ErrIdempotencyKeyExists
+		}
+		existing.lockedUntil = now.Add(lease)
+		return nil
+	}
+	strg.idempotency[mapKey] = &memIdempotencyRecord{
+		record:      IdempotencyRecord{UserID: record.UserID, Key: record.Key, RequestHash: record.RequestHash},
+		expiresAt:   now.Add(ttl),
+		lockedUntil: now.Add(lease),
+	}
+	return nil
+}
+
+func (strg *MemStorage) GetIdempotencyKey(ctx context.Context, userID string, key string) (IdempotencyRecord, error) {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	existing, ok := strg.idempotency[idempotencyMapKey(userID, key)]
+	if !ok || !existing.expiresAt.After(time.Now()) {
+		return IdempotencyRecord{}, ErrIdempotencyKeyNotFound
+	}
+	return existing.record, nil
+}
+
+func (strg *MemStorage) SaveIdempotentResponse(ctx context.Context, record IdempotencyRecord) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	existing, ok := strg.idempotency[idempotencyMapKey(record.UserID, record.Key)]
+	if !ok {
+		return ErrIdempotencyKeyNotFound
+	}
+	existing.record.StatusCode = record.StatusCode
+	existing.record.ContentType = record.ContentType
+	existing.record.ResponseBody = append([]byte(nil), record.ResponseBody...)
+	return nil
+}
+
+func (strg *MemStorage) DeleteIdempotencyKey(ctx context.Context, userID string, key string) error {
+	strg.mu.Lock()
+	defer strg.mu.Unlock()
+	delete(strg.idempotency, idempotencyMapKey(userID, key))
+	return nil
+}
@@ -1,155 +1,374 @@
 package storage
 
 import (
-	"crypto/sha256"
+	"context"
 	"database/sql"
-	"encoding/hex"
-	"log"
-	"net/http"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/money"
+	"log/slog"
 	"time"
 )
 
+// UserAuthData carries credentials from requests, in Storage methods Password
+// holds the password hash instead of the password itself.
 type UserAuthData struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 	UserID   string `json:"userID,omitempty"`
+	Role     string `json:"-"`
 }
 
+const RoleUser = "user"
+const RoleAdmin = "admin"
+
 type Order struct {
-	Number     string    `json:"number"`
-	Status     string    `json:"status"`
-	Accrual    float64   `json:"accrual,omitempty"`
-	UploadedAt time.Time `json:"uploaded_at"`
+	Number     string       `json:"number"`
+	Status     string       `json:"status"`
+	Accrual    money.Amount `json:"accrual,omitempty"`
+	UploadedAt time.Time    `json:"uploaded_at"`
 }
 
 type OrderFromDB struct {
 	Number     string
 	Status     string
-	Accrual    sql.NullFloat64
+	Accrual    money.Amount
 	UploadedAt time.Time
 }
 
 type OrderFromBlackBox struct {
-	Order   string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual,omitempty"`
+	Order   string       `json:"order"`
+	Status  string       `json:"status"`
+	Accrual money.Amount `json:"accrual,omitempty"`
 }
 
 type UserBalance struct {
-	Orders    float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Orders    money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
+}
+
+// AccrualJob is an order waiting for its accrual to be polled.
+// Attempts counts claims of the job since its last successful poll.
+type AccrualJob struct {
+	OrderNumber string
+	Attempts    int
+	LastError   string
+}
+
+// Session is a login of a user, it stays active until it expires or is revoked.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+}
+
+// LoginFailures are failed login attempts in a sliding window. Failures of a
+// login are counted since its last successful login, failures of an ip are not.
+type LoginFailures struct {
+	ByLogin     int
+	ByIP        int
+	LastFailure time.Time
+}
+
+const LockoutByLogin = "login"
+const LockoutByIP = "ip"
+
+// LoginLockout forbids logins by Key until LockedUntil, lockouts are kept as an audit record.
+type LoginLockout struct {
+	Kind        string
+	Key         string
+	Failures    int
+	CreatedAt   time.Time
+	LockedUntil time.Time
+}
+
+// TOTP is a two-factor secret of a user, it is required on login only after
+// the enrollment is confirmed. LastUsedStep keeps codes from being used twice.
+type TOTP struct {
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+}
+
+// BalanceAdjustment is a manual change of a user balance made by an admin,
+// a negative Amount takes points off the balance.
+type BalanceAdjustment struct {
+	UserID  string
+	ActorID string
+	Amount  money.Amount
+	Reason  string
+}
+
+// AuditRecord is an action of an admin, TargetUserID is empty for actions not related to a user.
+type AuditRecord struct {
+	ID           int64     `json:"id"`
+	ActorID      string    `json:"actor_id"`
+	Action       string    `json:"action"`
+	TargetUserID string    `json:"target_user_id,omitempty"`
+	Details      string    `json:"details"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const AuditUserLookup = "user.lookup"
+const AuditOrdersView = "orders.view"
+const AuditWithdrawalsView = "withdrawals.view"
+const AuditBalanceView = "balance.view"
+const AuditOrderRepoll = "order.repoll"
+const AuditBalanceAdjustment = "balance.adjust"
+
+// IdempotencyRecord is a request made with an Idempotency-Key header, StatusCode
+// is zero until the response is saved. Keys of different users do not clash.
+type IdempotencyRecord struct {
+	UserID       string
+	Key          string
+	RequestHash  string
+	StatusCode   int
+	ContentType  string
+	ResponseBody []byte
 }
 
 type Withdrawal struct {
-	Order       string    `json:"order"`
-	Sum         float64   `json:"sum"`
-	ProcessedAt time.Time `json:"processed_at,omitempty"`
+	Order       string       `json:"order"`
+	Sum         money.Amount `json:"sum"`
+	ProcessedAt time.Time    `json:"processed_at,omitempty"`
 }
 
-func GetStorage(dbDSN string) Storage {
+func GetStorage(dbDSN string, logger *slog.Logger) (*DBStorage, error) {
 	db, err := sql.Open("pgx", dbDSN)
 	if err != nil {
-		log.Printf("Got error while starting db %s", err.Error())
-		return nil
+		return nil, fmt.Errorf("could not open database: %w", err)
 	}
-	return &DBStorage{db}
+	return &DBStorage{db: db, logger: logger}, nil
 }
 
+// Storage methods return the sentinel errors from errors.go for expected
+// business outcomes, any other error means the storage itself failed.
 type Storage interface {
-	Register(registerData UserAuthData) (string, int)
-	GetUserByLogin(authData UserAuthData) (UserAuthData, int)
-	GetOrdersByUser(userID string) ([]Order, int)
-	AddOrderForUser(externalOrderID string, userID string) int
-	GetUserBalance(userID string) (UserBalance, int)
-	AddWithdrawalForUser(userID string, withdrawal Withdrawal) int
-	GetWithdrawalsForUser(userID string) ([]Withdrawal, int)
-	GetOrdersInProgress() ([]Order, int)
-	UpdateOrder(order OrderFromBlackBox) int
+	Register(ctx context.Context, registerData UserAuthData) (string, error)
+	GetUserByLogin(ctx context.Context, authData UserAuthData) (UserAuthData, error)
+	GetUserByID(ctx context.Context, userID string) (UserAuthData, error)
+	GetOrdersByUser(ctx context.Context, userID string, query ListQuery) ([]Order, error)
+	AddOrderForUser(ctx context.Context, externalOrderID string, userID string) error
+	GetUserBalance(ctx context.Context, userID string) (UserBalance, error)
+	AddWithdrawalForUser(ctx context.Context, userID string, withdrawal Withdrawal) error
+	GetWithdrawalsForUser(ctx context.Context, userID string, query ListQuery) ([]Withdrawal, error)
+	GetOrdersInProgress(ctx context.Context) ([]Order, error)
+	UpdateOrder(ctx context.Context, order OrderFromBlackBox) error
+	UpdatePasswordHash(ctx context.Context, userID string, passwordHash string) error
+	AddAccrualJob(ctx context.Context, orderNumber string) error
+	ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]AccrualJob, error)
+	RescheduleAccrualJob(ctx context.Context, orderNumber string, delay time.Duration, lastError string) error
+	CompleteAccrualJob(ctx context.Context, orderNumber string) error
+	CreateSession(ctx context.Context, session Session, ttl time.Duration) (Session, error)
+	TouchSession(ctx context.Context, sessionID string) (Session, error)
+	GetSessionsForUser(ctx context.Context, userID string) ([]Session, error)
+	RevokeSession(ctx context.Context, userID string, sessionID string) error
+	RevokeOtherSessions(ctx context.Context, userID string, keepSessionID string) error
+	CreatePasswordResetToken(ctx context.Context, userID string, tokenHash string, ttl time.Duration) error
+	UsePasswordResetToken(ctx context.Context, tokenHash string) (string, error)
+	SetTOTPSecret(ctx context.Context, userID string, secret string) error
+	GetTOTP(ctx context.Context, userID string) (TOTP, error)
+	ConfirmTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	UseRecoveryCode(ctx context.Context, userID string, codeHash string) error
+	RecordLoginAttempt(ctx context.Context, login string, ip string, succeeded bool) error
+	GetLoginFailures(ctx context.Context, login string, ip string, window time.Duration) (LoginFailures, error)
+	AddLoginLockout(ctx context.Context, lockout LoginLockout, duration time.Duration) (LoginLockout, error)
+	GetLoginLockout(ctx context.Context, login string, ip string) (LoginLockout, error)
+	SetUserRole(ctx context.Context, login string, role string) error
+	RequeueAccrualJob(ctx context.Context, orderNumber string) (string, error)
+	AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) (UserBalance, error)
+	AddAuditRecord(ctx context.Context, record AuditRecord) error
+	GetAuditRecords(ctx context.Context, targetUserID string, limit int) ([]AuditRecord, error)
+	CreateIdempotencyKey(ctx context.Context, record IdempotencyRecord, ttl time.Duration, lease time.Duration) error
+	GetIdempotencyKey(ctx context.Context, userID string, key string) (IdempotencyRecord, error)
+	SaveIdempotentResponse(ctx context.Context, record IdempotencyRecord) error
+	DeleteIdempotencyKey(ctx context.Context, userID string, key string) error
+	Ping(ctx context.Context) error
+	SchemaVersion(ctx context.Context) (uint, bool, error)
+	VerifyLedger(ctx context.Context) error
+	Close() error
 }
 
 type DBStorage struct {
-	db *sql.DB
+	db     *sql.DB
+	logger *slog.Logger
 }
 
-func (strg *DBStorage) Register(registerData UserAuthData) (string, int) {
-	row := strg.db.QueryRow("SELECT id FROM \"user\" WHERE \"login\" = $1", registerData.Login)
-	var userID sql.NullString
+const uniqueViolationCode = "23505"
+const invalidTextRepresentationCode = "22P02"
+const foreignKeyViolationCode = "23503"
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode
+}
+
+// isInvalidTextRepresentation reports whether the value could not be cast to the column type, e.g. a malformed uuid.
+func isInvalidTextRepresentation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == invalidTextRepresentationCode
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == foreignKeyViolationCode
+}
+
+func (strg *DBStorage) Close() error {
+	return strg.db.Close()
+}
+
+func (strg *DBStorage) Ping(ctx context.Context) error {
+	return strg.db.PingContext(ctx)
+}
+
+// SchemaVersion returns the applied migration version and whether the last
+// migration failed half way, as recorded by golang-migrate.
+func (strg *DBStorage) SchemaVersion(ctx context.Context) (uint, bool, error) {
+	var version int64
+	var dirty bool
+	err := strg.db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return uint(version), dirty, nil
+}
+
+func (strg *DBStorage) Register(ctx context.Context, registerData UserAuthData) (string, error) {
+	row := strg.db.QueryRowContext(ctx, "SELECT id FROM \"user\" WHERE \"login\" = $1", registerData.Login)
+	var userID string
 	err := row.Scan(&userID)
-	if err != nil && userID.Valid {
-		log.Printf("Got error %s", err.Error())
-		return "", http.StatusInternalServerError
-	}
-	if userID.Valid {
-		log.Printf("Got existing user with login %s", registerData.Login)
-		return "", http.StatusFailedDependency
-	}
-	h := sha256.New()
-	h.Write([]byte(registerData.Password))
-	passwordHash := hex.EncodeToString(h.Sum(nil))
-	log.Printf("Got password hash %s", passwordHash)
-	row = strg.db.QueryRow("INSERT INTO \"user\" (\"login\", password_hash) VALUES ($1, $2) RETURNING id", registerData.Login, passwordHash)
+	if err == nil {
+		strg.logger.DebugContext(ctx, "Got existing user", "login", registerData.Login)
+		return "", ErrLoginTaken
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("could not check login: %w", err)
+	}
+	tx, err := strg.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	row = tx.QueryRowContext(ctx, "INSERT INTO \"user\" (\"login\", password_hash) VALUES ($1, $2) RETURNING id", registerData.Login, registerData.Password)
 	if err := row.Scan(&userID); err != nil {
-		log.Printf("Error %s", err.Error())
-		return "", http.StatusInternalServerError
-	} else {
-		log.Printf("Got userID %v", userID)
-		if userID.Valid {
-			userIDValue := userID.String
-			log.Printf("Got new userID %s", userIDValue)
-			return userIDValue, http.StatusOK
+		if isUniqueViolation(err) {
+			return "", ErrLoginTaken
 		}
+		return "", fmt.Errorf("could not add user: %w", err)
 	}
-	return "", http.StatusInternalServerError
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_balance (user_id) VALUES ($1)", userID); err != nil {
+		return "", fmt.Errorf("could not create balance for user %s: %w", userID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	strg.logger.InfoContext(ctx, "Registered user", "user_id", userID)
+	return userID, nil
 }
 
-func (strg *DBStorage) GetUserByLogin(authData UserAuthData) (UserAuthData, int) {
-	row := strg.db.QueryRow("SELECT id, login, password_hash FROM \"user\" WHERE login = $1", authData.Login)
+func (strg *DBStorage) GetUserByLogin(ctx context.Context, authData UserAuthData) (UserAuthData, error) {
+	row := strg.db.QueryRowContext(ctx, "SELECT id, login, password_hash, role FROM \"user\" WHERE login = $1", authData.Login)
 	var userData UserAuthData
-	err := row.Scan(&userData.UserID, &userData.Login, &userData.Password)
+	err := row.Scan(&userData.UserID, &userData.Login, &userData.Password, &userData.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		strg.logger.DebugContext(ctx, "Got unknown login", "login", authData.Login)
+		return UserAuthData{}, ErrUserNotFound
+	}
 	if err != nil {
-		log.Printf("Could not get user data for login %s", authData.Login)
-		return userData, http.StatusUnauthorized
+		return UserAuthData{}, fmt.Errorf("could not get user data: %w", err)
 	}
-	return userData, http.StatusOK
+	return userData, nil
 }
 
-func (strg *DBStorage) AddOrderForUser(externalOrderID string, userID string) int {
-	row := strg.db.QueryRow("SELECT user_id FROM \"order\" WHERE external_id = $1", externalOrderID)
-	var orderUserID sql.NullString
-	err := row.Scan(&orderUserID)
-	if err != nil && orderUserID.Valid {
-		log.Printf("Got error while querying %s", err.Error())
-		return http.StatusInternalServerError
+func (strg *DBStorage) GetUserByID(ctx context.Context, userID string) (UserAuthData, error) {
+	row := strg.db.QueryRowContext(ctx, "SELECT id, login, password_hash, role FROM \"user\" WHERE id = $1", userID)
+	var userData UserAuthData
+	err := row.Scan(&userData.UserID, &userData.Login, &userData.Password, &userData.Role)
+	if errors.Is(err, sql.ErrNoRows) || isInvalidTextRepresentation(err) {
+		return UserAuthData{}, ErrUserNotFound
 	}
-	if orderUserID.Valid {
-		if orderUserID.String == userID {
-			log.Printf("Got same userID %s for orderID %s", userID, externalOrderID)
-			return http.StatusOK
-		} else {
-			log.Printf("Got another userID %s (instead of %s) for orderID %s", orderUserID.String, userID, externalOrderID)
-			return http.StatusConflict
-		}
+	if err != nil {
+		return UserAuthData{}, fmt.Errorf("could not get user data: %w", err)
+	}
+	return userData, nil
+}
+
+func (strg *DBStorage) UpdatePasswordHash(ctx context.Context, userID string, passwordHash string) error {
+	result, err := strg.db.ExecContext(ctx, "UPDATE \"user\" SET password_hash = $2 WHERE id = $1", userID, passwordHash)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// AddOrderForUser relies on the unique order number, so of concurrent uploads
+// of the same number only one adds the order and the others get its owner.
+func (strg *DBStorage) AddOrderForUser(ctx context.Context, externalOrderID string, userID string) error {
+	tx, err := strg.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	log.Printf("Order with id %v not found in DB, should add it", externalOrderID)
-	row = strg.db.QueryRow(
-		"INSERT INTO \"order\" (user_id, status, external_id) VALUES ($1, $2, $3) RETURNING id",
+	defer tx.Rollback()
+	row := tx.QueryRowContext(ctx,
+		"INSERT INTO \"order\" (user_id, status, external_id) VALUES ($1, $2, $3) ON CONFLICT (external_id) DO NOTHING RETURNING id",
 		userID, "NEW", externalOrderID,
 	)
 	var orderID string
 	err = row.Scan(&orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return strg.existingOrderError(ctx, tx, externalOrderID, userID)
+	}
 	if err != nil {
-		log.Printf("Smth went wrong while adding new order: %s", err.Error())
-		return http.StatusInternalServerError
+		return fmt.Errorf("could not add order: %w", err)
 	}
-	log.Printf("New order with id %s added", orderID)
-	return http.StatusAccepted
+	_, err = tx.ExecContext(ctx, "INSERT INTO accrual_job (order_external_id) VALUES ($1) ON CONFLICT DO NOTHING", externalOrderID)
+	if err != nil {
+		return fmt.Errorf("could not add accrual job for order %s: %w", externalOrderID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	strg.logger.InfoContext(ctx, "Added order", "user_id", userID, "order", externalOrderID)
+	return nil
+}
+
+// existingOrderError tells whether the already added order belongs to the user or to another one.
+func (strg *DBStorage) existingOrderError(ctx context.Context, tx *sql.Tx, externalOrderID string, userID string) error {
+	row := tx.QueryRowContext(ctx, "SELECT user_id FROM \"order\" WHERE external_id = $1", externalOrderID)
+	var orderUserID string
+	if err := row.Scan(&orderUserID); err != nil {
+		return fmt.Errorf("could not check order: %w", err)
+	}
+	if orderUserID == userID {
+		strg.logger.DebugContext(ctx, "Got order uploaded by the same user", "user_id", userID, "order", externalOrderID)
+		return ErrOrderAlreadyUploaded
+	}
+	strg.logger.InfoContext(ctx, "Got order uploaded by another user", "user_id", userID, "owner_id", orderUserID, "order", externalOrderID)
+	return ErrOrderOwnedByOther
 }
 
-func (strg *DBStorage) GetOrdersByUser(userID string) ([]Order, int) {
-	rows, err := strg.db.Query("SELECT external_id, status, amount, registered_at FROM \"order\" WHERE user_id = $1", userID)
+func (strg *DBStorage) GetOrdersByUser(ctx context.Context, userID string, query ListQuery) ([]Order, error) {
+	conditions, args := query.sqlConditions("registered_at", "external_id", "status", []interface{}{userID})
+	rows, err := strg.db.QueryContext(ctx, "SELECT external_id, status, amount, registered_at FROM \"order\" WHERE user_id = $1"+conditions, args...)
 	if err != nil {
-		log.Printf("Got error: %s", err.Error())
-		return nil, http.StatusInternalServerError
+		return nil, err
 	}
 	defer rows.Close()
 	orders := make([]Order, 0)
@@ -157,86 +376,94 @@ func (strg *DBStorage) GetOrdersByUser(userID string) ([]Order, int) {
 		var orderFromDBVal OrderFromDB
 		err := rows.Scan(&orderFromDBVal.Number, &orderFromDBVal.Status, &orderFromDBVal.Accrual, &orderFromDBVal.UploadedAt)
 		if err != nil {
-			log.Printf("Got error: %s", err.Error())
-			return nil, http.StatusInternalServerError
-		}
-		order := Order{Number: orderFromDBVal.Number, Status: orderFromDBVal.Status, UploadedAt: orderFromDBVal.UploadedAt}
-		if orderFromDBVal.Accrual.Valid {
-			order.Accrual = orderFromDBVal.Accrual.Float64
+			return nil, err
 		}
+		order := Order{Number: orderFromDBVal.Number, Status: orderFromDBVal.Status, Accrual: orderFromDBVal.Accrual, UploadedAt: orderFromDBVal.UploadedAt}
 		orders = append(orders, order)
 	}
 	if err := rows.Err(); err != nil {
-		log.Printf("Got error: %s", err.Error())
-		return nil, http.StatusInternalServerError
+		return nil, err
 	}
-	return orders, http.StatusOK
+	return orders, nil
 }
 
-func (strg *DBStorage) GetUserBalance(userID string) (UserBalance, int) {
-	log.Printf("Got userID %s", userID)
-	sumOrdersRow := strg.db.QueryRow("SELECT sum(amount) FROM \"order\" WHERE user_id = $1", userID)
-	sumWithdrawalsRow := strg.db.QueryRow("SELECT sum(amount) FROM withdrawal WHERE user_id = $1", userID)
-	var sumOrders sql.NullFloat64
-	var sumWithdrawals sql.NullFloat64
-	err := sumOrdersRow.Scan(&sumOrders)
-	if err != nil && sumOrders.Valid {
-		log.Printf("Could not get sumOrders: %s", err.Error())
-		return UserBalance{0, 0}, http.StatusInternalServerError
-	}
+func (strg *DBStorage) GetUserBalance(ctx context.Context, userID string) (UserBalance, error) {
+	row := strg.db.QueryRowContext(ctx, "SELECT current, withdrawn FROM user_balance WHERE user_id = $1", userID)
 	var resultBalance UserBalance
-	if !sumOrders.Valid {
-		log.Printf("Got empty resultBalance")
-		resultBalance.Orders = 0
-	} else {
-		resultBalance.Orders = sumOrders.Float64
+	err := row.Scan(&resultBalance.Orders, &resultBalance.Withdrawn)
+	if errors.Is(err, sql.ErrNoRows) {
+		strg.logger.DebugContext(ctx, "Got no balance row", "user_id", userID)
+		return UserBalance{0, 0}, nil
 	}
-	err = sumWithdrawalsRow.Scan(&sumWithdrawals)
-
-	if err != nil && sumWithdrawals.Valid {
-		log.Printf("Could not get sumWithdrawals: %s", err.Error())
-		return UserBalance{0, 0}, http.StatusInternalServerError
-	}
-	if !sumWithdrawals.Valid {
-		log.Printf("Got empty resultBalance")
-		resultBalance.Withdrawn = 0
-	} else {
-		resultBalance.Withdrawn = sumWithdrawals.Float64
+	if err != nil {
+		return UserBalance{0, 0}, fmt.Errorf("could not get balance: %w", err)
 	}
-	resultBalance.Orders -= resultBalance.Withdrawn
-	log.Printf("Got balance %v", resultBalance)
-	return resultBalance, http.StatusOK
+	return resultBalance, nil
 }
 
-func (strg *DBStorage) AddWithdrawalForUser(userID string, withdrawal Withdrawal) int {
-	userBalance, errCode := strg.GetUserBalance(userID)
-	if errCode != http.StatusOK {
-		log.Printf("Got error while getting status %v", errCode)
-		return errCode
+// AddWithdrawalForUser locks the user balance row, so concurrent withdrawals
+// are checked against the balance one by one and can not overdraw it.
+// An order can be paid with points only once, whoever pays for it.
+func (strg *DBStorage) AddWithdrawalForUser(ctx context.Context, userID string, withdrawal Withdrawal) error {
+	tx, err := strg.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_balance (user_id) VALUES ($1) ON CONFLICT DO NOTHING", userID); err != nil {
+		return fmt.Errorf("could not create balance: %w", err)
+	}
+	var current money.Amount
+	row := tx.QueryRowContext(ctx, "SELECT current FROM user_balance WHERE user_id = $1 FOR UPDATE", userID)
+	if err := row.Scan(&current); err != nil {
+		return fmt.Errorf("could not get balance: %w", err)
 	}
-	if userBalance.Orders < withdrawal.Sum {
-		log.Printf("Got less bonus points %v than expected %v", userBalance.Orders, withdrawal.Sum)
-		return http.StatusPaymentRequired
+	var used bool
+	row = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM withdrawal WHERE external_id = $1)", withdrawal.Order)
+	if err := row.Scan(&used); err != nil {
+		return fmt.Errorf("could not check withdrawal order: %w", err)
+	}
+	if used {
+		strg.logger.InfoContext(ctx, "Got already paid order", "user_id", userID, "order", withdrawal.Order)
+		return ErrWithdrawalOrderUsed
+	}
+	if current < withdrawal.Sum {
+		strg.logger.InfoContext(ctx, "Got insufficient funds for withdrawal", "user_id", userID, "balance", current, "sum", withdrawal.Sum)
+		return ErrInsufficientFunds
 	}
 	var withdrawalID string
-	row := strg.db.QueryRow(
+	row = tx.QueryRowContext(ctx,
 		"INSERT INTO withdrawal (user_id, amount, external_id) VALUES ($1, $2, $3) RETURNING id",
 		userID, withdrawal.Sum, withdrawal.Order,
 	)
-	err := row.Scan(&withdrawalID)
+	if err := row.Scan(&withdrawalID); err != nil {
+		if isUniqueViolation(err) {
+			return ErrWithdrawalOrderUsed
+		}
+		return fmt.Errorf("could not add withdrawal: %w", err)
+	}
+	if err := postLedgerTransaction(ctx, tx, userID, "withdrawal", -withdrawal.Sum, withdrawal.Order, ""); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE user_balance SET current = current - $2, withdrawn = withdrawn + $2 WHERE user_id = $1",
+		userID, withdrawal.Sum,
+	)
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
-		return http.StatusInternalServerError
+		return fmt.Errorf("could not update balance: %w", err)
 	}
-	log.Printf("Got new withdrawal %s", withdrawalID)
-	return http.StatusOK
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	strg.logger.InfoContext(ctx, "Added withdrawal", "user_id", userID, "withdrawal_id", withdrawalID, "order", withdrawal.Order)
+	return nil
 }
 
-func (strg *DBStorage) GetWithdrawalsForUser(userID string) ([]Withdrawal, int) {
-	rows, err := strg.db.Query("SELECT external_id, amount, registered_at FROM withdrawal WHERE user_id = $1", userID)
+func (strg *DBStorage) GetWithdrawalsForUser(ctx context.Context, userID string, query ListQuery) ([]Withdrawal, error) {
+	conditions, args := query.sqlConditions("registered_at", "external_id", "", []interface{}{userID})
+	rows, err := strg.db.QueryContext(ctx, "SELECT external_id, amount, registered_at FROM withdrawal WHERE user_id = $1"+conditions, args...)
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
-		return make([]Withdrawal, 0), http.StatusInternalServerError
+		return nil, err
 	}
 	defer rows.Close()
 	withdrawals := make([]Withdrawal, 0)
@@ -244,24 +471,20 @@ func (strg *DBStorage) GetWithdrawalsForUser(userID string) ([]Withdrawal, int)
 		var withdrawal Withdrawal
 		err = rows.Scan(&withdrawal.Order, &withdrawal.Sum, &withdrawal.ProcessedAt)
 		if err != nil {
-			log.Printf("Got error %s", err.Error())
-			return make([]Withdrawal, 0), http.StatusInternalServerError
+			return nil, err
 		}
 		withdrawals = append(withdrawals, withdrawal)
 	}
 	if err := rows.Err(); err != nil {
-		log.Printf("Got error: %s", err.Error())
-		return nil, http.StatusInternalServerError
+		return nil, err
 	}
-	return withdrawals, http.StatusOK
+	return withdrawals, nil
 }
 
-func (strg *DBStorage) GetOrdersInProgress() ([]Order, int) {
-	rows, err := strg.db.Query("SELECT external_id, status, amount from \"order\" where status not in ('INVALID', 'PROCESSED')")
-
+func (strg *DBStorage) GetOrdersInProgress(ctx context.Context) ([]Order, error) {
+	rows, err := strg.db.QueryContext(ctx, "SELECT external_id, status, amount from \"order\" where status not in ('INVALID', 'PROCESSED')")
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
-		return make([]Order, 0), http.StatusInternalServerError
+		return nil, err
 	}
 	defer rows.Close()
 	orders := make([]Order, 0)
@@ -269,45 +492,672 @@ func (strg *DBStorage) GetOrdersInProgress() ([]Order, int) {
 		var orderFromDBVal OrderFromDB
 		err = rows.Scan(&orderFromDBVal.Number, &orderFromDBVal.Status, &orderFromDBVal.Accrual)
 		if err != nil {
-			log.Printf("Got error %s", err.Error())
-			return make([]Order, 0), http.StatusInternalServerError
-		}
-		order := Order{Number: orderFromDBVal.Number, Status: orderFromDBVal.Status}
-		if orderFromDBVal.Accrual.Valid {
-			order.Accrual = orderFromDBVal.Accrual.Float64
+			return nil, err
 		}
+		order := Order{Number: orderFromDBVal.Number, Status: orderFromDBVal.Status, Accrual: orderFromDBVal.Accrual}
 		orders = append(orders, order)
 	}
 	if err := rows.Err(); err != nil {
-		log.Printf("Got error: %s", err.Error())
-		return nil, http.StatusInternalServerError
+		return nil, err
+	}
+	return orders, nil
+}
+
+// UpdateOrder credits the accrual to the user balance when the order becomes
+// PROCESSED, the order row lock guarantees it is credited only once. PROCESSED
+// and INVALID orders are final, updating them returns ErrOrderFinal.
+func (strg *DBStorage) UpdateOrder(ctx context.Context, order OrderFromBlackBox) error {
+	tx, err := strg.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var userID string
+	var previousStatus string
+	row := tx.QueryRowContext(ctx, "SELECT user_id, status FROM \"order\" WHERE external_id = $1 FOR UPDATE", order.Order)
+	if err := row.Scan(&userID, &previousStatus); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		return fmt.Errorf("could not get order %s: %w", order.Order, err)
+	}
+	if isFinalOrderStatus(previousStatus) {
+		return ErrOrderFinal
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE \"order\" SET status = $1, amount = $2 where external_id = $3", order.Status, order.Accrual, order.Order); err != nil {
+		return fmt.Errorf("could not update order %s: %w", order.Order, err)
+	}
+	if order.Status == "PROCESSED" && order.Accrual > 0 {
+		err := postLedgerTransaction(ctx, tx, userID, "accrual", order.Accrual, order.Order, "")
+		if errors.Is(err, errLedgerEntryExists) {
+			// The accrual is already in the ledger, so it is in the balance too.
+			return tx.Commit()
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO user_balance (user_id, current) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET current = user_balance.current + EXCLUDED.current`,
+			userID, order.Accrual,
+		)
+		if err != nil {
+			return fmt.Errorf("could not update balance: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ledgerSystemAccounts maps the kind of a ledger transaction to the system
+// account balancing the entry of the user.
+var ledgerSystemAccounts = map[string]string{
+	"accrual":    "accrual_source",
+	"withdrawal": "withdrawal_sink",
+	"adjustment": "admin_adjustment",
+}
+
+// errLedgerEntryExists is returned by postLedgerTransaction when the entry of
+// the user conflicts with an existing one, so nothing was posted.
+var errLedgerEntryExists = errors.New("ledger entry already exists")
+
+// postLedgerTransaction posts amount to the user account and the opposite
+// amount to the system account of kind as one ledger transaction.
+func postLedgerTransaction(ctx context.Context, tx *sql.Tx, userID string, kind string, amount money.Amount, orderNumber string, reason string) error {
+	result, err := tx.ExecContext(ctx,
+		`WITH entry AS (
+			INSERT INTO ledger_entry (transaction_id, account, user_id, kind, amount, order_external_id, reason)
+			VALUES (gen_random_uuid(), 'user', $1, $2, $3, $4, $5) ON CONFLICT DO NOTHING
+			RETURNING transaction_id, kind, amount, order_external_id, reason
+		)
+		INSERT INTO ledger_entry (transaction_id, account, kind, amount, order_external_id, reason)
+		SELECT transaction_id, $6, kind, -amount, order_external_id, reason FROM entry`,
+		userID, kind, amount, sql.NullString{String: orderNumber, Valid: orderNumber != ""},
+		sql.NullString{String: reason, Valid: kind == "adjustment"}, ledgerSystemAccounts[kind],
+	)
+	if err != nil {
+		return fmt.Errorf("could not add ledger entries: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errLedgerEntryExists
+	}
+	return nil
+}
+
+// VerifyLedger checks that the entries of every ledger transaction sum to zero
+// and that every user balance equals the sum of the entries of the user.
+func (strg *DBStorage) VerifyLedger(ctx context.Context) error {
+	var unbalanced int
+	row := strg.db.QueryRowContext(ctx,
+		"SELECT count(*) FROM (SELECT transaction_id FROM ledger_entry GROUP BY transaction_id HAVING sum(amount) <> 0) unbalanced",
+	)
+	if err := row.Scan(&unbalanced); err != nil {
+		return fmt.Errorf("could not check ledger transactions: %w", err)
+	}
+	if unbalanced > 0 {
+		return fmt.Errorf("%w: %d transactions do not sum to zero", ErrLedgerUnbalanced, unbalanced)
+	}
+	var mismatched int
+	row = strg.db.QueryRowContext(ctx,
+		`SELECT count(*) FROM user_balance b
+		WHERE b.current <> COALESCE((SELECT sum(l.amount) FROM ledger_entry l WHERE l.account = 'user' AND l.user_id = b.user_id), 0)`,
+	)
+	if err := row.Scan(&mismatched); err != nil {
+		return fmt.Errorf("could not check user balances: %w", err)
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("%w: %d user balances differ from their entries", ErrLedgerUnbalanced, mismatched)
+	}
+	return nil
+}
+
+func isFinalOrderStatus(status string) bool {
+	return status == "PROCESSED" || status == "INVALID"
+}
+
+func (strg *DBStorage) AddAccrualJob(ctx context.Context, orderNumber string) error {
+	_, err := strg.db.ExecContext(ctx, "INSERT INTO accrual_job (order_external_id) VALUES ($1) ON CONFLICT DO NOTHING", orderNumber)
+	return err
+}
+
+func (strg *DBStorage) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]AccrualJob, error) {
+	rows, err := strg.db.QueryContext(ctx,
+		`UPDATE accrual_job SET attempts = attempts + 1, locked_until = now() + make_interval(secs => $2)
+		WHERE order_external_id IN (
+			SELECT order_external_id FROM accrual_job
+			WHERE next_attempt_at <= now() AND (locked_until IS NULL OR locked_until <= now())
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING order_external_id, attempts, last_error`,
+		limit, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := make([]AccrualJob, 0)
+	for rows.Next() {
+		var job AccrualJob
+		var lastError sql.NullString
+		err = rows.Scan(&job.OrderNumber, &job.Attempts, &lastError)
+		if err != nil {
+			return nil, err
+		}
+		job.LastError = lastError.String
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	log.Printf("Got orders %v", orders)
-	return orders, http.StatusOK
+	return jobs, nil
+}
+
+func (strg *DBStorage) RescheduleAccrualJob(ctx context.Context, orderNumber string, delay time.Duration, lastError string) error {
+	var lastErrorValue sql.NullString
+	if lastError != "" {
+		lastErrorValue = sql.NullString{String: lastError, Valid: true}
+	}
+	_, err := strg.db.ExecContext(ctx,
+		`UPDATE accrual_job
+		SET next_attempt_at = now() + make_interval(secs => $2), locked_until = NULL, last_error = $3,
+			attempts = CASE WHEN $3::text IS NULL THEN 0 ELSE attempts END
+		WHERE order_external_id = $1`,
+		orderNumber, delay.Seconds(), lastErrorValue,
+	)
+	return err
 }
 
-func (strg *DBStorage) UpdateOrder(order OrderFromBlackBox) int {
-	tx, err := strg.db.Begin()
+func (strg *DBStorage) CompleteAccrualJob(ctx context.Context, orderNumber string) error {
+	_, err := strg.db.ExecContext(ctx, "DELETE FROM accrual_job WHERE order_external_id = $1", orderNumber)
+	return err
+}
+
+const sessionColumns = "id, user_id, created_at, expires_at, last_seen, user_agent, ip"
+
+func scanSession(row interface{ Scan(dest ...any) error }) (Session, error) {
+	var session Session
+	err := row.Scan(&session.ID, &session.UserID, &session.CreatedAt, &session.ExpiresAt, &session.LastSeen, &session.UserAgent, &session.IP)
+	return session, err
+}
+
+func (strg *DBStorage) CreateSession(ctx context.Context, session Session, ttl time.Duration) (Session, error) {
+	row := strg.db.QueryRowContext(ctx,
+		"INSERT INTO session (user_id, expires_at, user_agent, ip) VALUES ($1, now() + make_interval(secs => $2), $3, $4) RETURNING "+sessionColumns,
+		session.UserID, ttl.Seconds(), session.UserAgent, session.IP,
+	)
+	createdSession, err := scanSession(row)
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
-		return http.StatusInternalServerError
+		return Session{}, fmt.Errorf("could not create session: %w", err)
+	}
+	return createdSession, nil
+}
+
+// TouchSession returns the session if it is still active and updates its last_seen.
+func (strg *DBStorage) TouchSession(ctx context.Context, sessionID string) (Session, error) {
+	row := strg.db.QueryRowContext(ctx,
+		"UPDATE session SET last_seen = now() WHERE id = $1 AND revoked_at IS NULL AND expires_at > now() RETURNING "+sessionColumns,
+		sessionID,
+	)
+	session, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) || isInvalidTextRepresentation(err) {
+		return Session{}, ErrSessionNotFound
 	}
-	URLstmt, err := tx.Prepare("UPDATE \"order\" SET status = $1, amount = $2 where external_id = $3")
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
-		return http.StatusInternalServerError
+		return Session{}, fmt.Errorf("could not get session: %w", err)
 	}
-	defer URLstmt.Close()
-	if _, err := URLstmt.Exec(order.Status, order.Accrual, order.Order); err != nil {
-		if err = tx.Rollback(); err != nil {
-			log.Fatalf("Insert to url, need rollback, %v", err)
-			return http.StatusInternalServerError
+	return session, nil
+}
+
+func (strg *DBStorage) GetSessionsForUser(ctx context.Context, userID string) ([]Session, error) {
+	rows, err := strg.db.QueryContext(ctx,
+		"SELECT "+sessionColumns+" FROM session WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now() ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
 		}
-		return http.StatusInternalServerError
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (strg *DBStorage) RevokeSession(ctx context.Context, userID string, sessionID string) error {
+	result, err := strg.db.ExecContext(ctx,
+		"UPDATE session SET revoked_at = now() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > now()",
+		sessionID, userID,
+	)
+	if isInvalidTextRepresentation(err) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions revokes all active sessions of the user except keepSessionID, empty keepSessionID revokes all of them.
+func (strg *DBStorage) RevokeOtherSessions(ctx context.Context, userID string, keepSessionID string) error {
+	_, err := strg.db.ExecContext(ctx,
+		"UPDATE session SET revoked_at = now() WHERE user_id = $1 AND id::text <> $2 AND revoked_at IS NULL AND expires_at > now()",
+		userID, keepSessionID,
+	)
+	return err
+}
+
+func (strg *DBStorage) CreatePasswordResetToken(ctx context.Context, userID string, tokenHash string, ttl time.Duration) error {
+	_, err := strg.db.ExecContext(ctx,
+		"INSERT INTO password_reset_token (token_hash, user_id, expires_at) VALUES ($1, $2, now() + make_interval(secs => $3))",
+		tokenHash, userID, ttl.Seconds(),
+	)
+	return err
+}
+
+// UsePasswordResetToken marks an unused and not expired token as used and returns its user id.
+func (strg *DBStorage) UsePasswordResetToken(ctx context.Context, tokenHash string) (string, error) {
+	row := strg.db.QueryRowContext(ctx,
+		"UPDATE password_reset_token SET used_at = now() WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now() RETURNING user_id",
+		tokenHash,
+	)
+	var userID string
+	err := row.Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrResetTokenNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not use password reset token: %w", err)
+	}
+	return userID, nil
+}
+
+// SetTOTPSecret starts a new enrollment, it replaces a not confirmed secret but never a confirmed one.
+func (strg *DBStorage) SetTOTPSecret(ctx context.Context, userID string, secret string) error {
+	result, err := strg.db.ExecContext(ctx,
+		"INSERT INTO user_totp (user_id, secret) VALUES ($1, $2) "+
+			"ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = now() WHERE user_totp.confirmed_at IS NULL",
+		userID, secret,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+func (strg *DBStorage) GetTOTP(ctx context.Context, userID string) (TOTP, error) {
+	row := strg.db.QueryRowContext(ctx,
+		"SELECT secret, confirmed_at IS NOT NULL, last_used_step FROM user_totp WHERE user_id = $1",
+		userID,
+	)
+	var userTOTP TOTP
+	err := row.Scan(&userTOTP.Secret, &userTOTP.Confirmed, &userTOTP.LastUsedStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTP{}, ErrTOTPNotFound
+	}
+	if err != nil {
+		return TOTP{}, fmt.Errorf("could not get totp: %w", err)
+	}
+	return userTOTP, nil
+}
+
+// ConfirmTOTP enables two-factor authentication and replaces recovery codes of the user.
+func (strg *DBStorage) ConfirmTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error {
+	tx, err := strg.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx,
+		"UPDATE user_totp SET confirmed_at = now(), last_used_step = $2 WHERE user_id = $1 AND confirmed_at IS NULL",
+		userID, step,
+	)
+	if err != nil {
+		return fmt.Errorf("could not confirm totp: %w", err)
+	}
+	confirmed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if confirmed == 0 {
+		if _, err := strg.GetTOTP(ctx, userID); err != nil {
+			return err
+		}
+		return ErrTOTPAlreadyEnabled
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM totp_recovery_code WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("could not delete recovery codes: %w", err)
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO totp_recovery_code (user_id, code_hash) VALUES ($1, $2)", userID, codeHash); err != nil {
+			return fmt.Errorf("could not add recovery code: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep marks the time step as used, codes of this and earlier steps are rejected afterwards.
+func (strg *DBStorage) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	result, err := strg.db.ExecContext(ctx,
+		"UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_used_step < $2",
+		userID, step,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+func (strg *DBStorage) UseRecoveryCode(ctx context.Context, userID string, codeHash string) error {
+	result, err := strg.db.ExecContext(ctx,
+		"UPDATE totp_recovery_code SET used_at = now() WHERE id = (SELECT id FROM totp_recovery_code WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL LIMIT 1)",
+		userID, codeHash,
+	)
+	if err != nil {
+		return err
+	}
+	used, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if used == 0 {
+		return ErrRecoveryCodeNotFound
+	}
+	return nil
+}
+
+func (strg *DBStorage) RecordLoginAttempt(ctx context.Context, login string, ip string, succeeded bool) error {
+	_, err := strg.db.ExecContext(ctx,
+		"INSERT INTO login_attempt (login, ip, succeeded) VALUES ($1, $2, $3)",
+		login, ip, succeeded,
+	)
+	return err
+}
+
+func (strg *DBStorage) GetLoginFailures(ctx context.Context, login string, ip string, window time.Duration) (LoginFailures, error) {
+	row := strg.db.QueryRowContext(ctx, `
+		WITH login_failure AS (
+			SELECT attempted_at FROM login_attempt
+			WHERE login = $1 AND NOT succeeded AND attempted_at > now() - make_interval(secs => $3)
+			AND attempted_at > (SELECT coalesce(max(attempted_at), '-infinity') FROM login_attempt WHERE login = $1 AND succeeded)
+		)
+		SELECT
+			(SELECT count(*) FROM login_failure),
+			(SELECT count(*) FROM login_attempt WHERE ip = $2 AND NOT succeeded AND attempted_at > now() - make_interval(secs => $3)),
+			(SELECT max(attempted_at) FROM login_failure)`,
+		login, ip, window.Seconds(),
+	)
+	var failures LoginFailures
+	var lastFailure sql.NullTime
+	if err := row.Scan(&failures.ByLogin, &failures.ByIP, &lastFailure); err != nil {
+		return LoginFailures{}, fmt.Errorf("could not count login failures: %w", err)
+	}
+	failures.LastFailure = lastFailure.Time
+	return failures, nil
+}
+
+func (strg *DBStorage) AddLoginLockout(ctx context.Context, lockout LoginLockout, duration time.Duration) (LoginLockout, error) {
+	row := strg.db.QueryRowContext(ctx,
+		"INSERT INTO login_lockout (kind, key, failures, locked_until) VALUES ($1, $2, $3, now() + make_interval(secs => $4)) RETURNING created_at, locked_until",
+		lockout.Kind, lockout.Key, lockout.Failures, duration.Seconds(),
+	)
+	if err := row.Scan(&lockout.CreatedAt, &lockout.LockedUntil); err != nil {
+		return LoginLockout{}, fmt.Errorf("could not add login lockout: %w", err)
+	}
+	return lockout, nil
+}
+
+// GetLoginLockout returns the active lockout of the login or the ip which ends last.
+func (strg *DBStorage) GetLoginLockout(ctx context.Context, login string, ip string) (LoginLockout, error) {
+	row := strg.db.QueryRowContext(ctx,
+		"SELECT kind, key, failures, created_at, locked_until FROM login_lockout "+
+			"WHERE ((kind = $1 AND key = $2) OR (kind = $3 AND key = $4)) AND locked_until > now() "+
+			"ORDER BY locked_until DESC LIMIT 1",
+		LockoutByLogin, login, LockoutByIP, ip,
+	)
+	var lockout LoginLockout
+	err := row.Scan(&lockout.Kind, &lockout.Key, &lockout.Failures, &lockout.CreatedAt, &lockout.LockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginLockout{}, ErrLockoutNotFound
+	}
+	if err != nil {
+		return LoginLockout{}, fmt.Errorf("could not get login lockout: %w", err)
+	}
+	return lockout, nil
+}
+
+func (strg *DBStorage) SetUserRole(ctx context.Context, login string, role string) error {
+	result, err := strg.db.ExecContext(ctx, "UPDATE \"user\" SET role = $2 WHERE login = $1", login, role)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// RequeueAccrualJob makes the order due for polling right away and returns the
+// id of its owner. PROCESSED and INVALID orders can not change any more, so
+// requeueing them returns ErrOrderFinal.
+func (strg *DBStorage) RequeueAccrualJob(ctx context.Context, orderNumber string) (string, error) {
+	row := strg.db.QueryRowContext(ctx, "SELECT user_id, status FROM \"order\" WHERE external_id = $1", orderNumber)
+	var userID string
+	var status string
+	err := row.Scan(&userID, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrOrderNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get order %s: %w", orderNumber, err)
+	}
+	if isFinalOrderStatus(status) {
+		return "", ErrOrderFinal
+	}
+	_, err = strg.db.ExecContext(ctx,
+		`INSERT INTO accrual_job (order_external_id) VALUES ($1)
+		ON CONFLICT (order_external_id) DO UPDATE SET attempts = 0, next_attempt_at = now(), last_error = NULL`,
+		orderNumber,
+	)
+	if err != nil {
+		return "", fmt.Errorf("could not requeue accrual job for order %s: %w", orderNumber, err)
+	}
+	return userID, nil
+}
+
+// AdjustBalance changes the balance under the same row lock as AddWithdrawalForUser,
+// the ledger entries and the audit record are written in the same transaction.
+func (strg *DBStorage) AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) (UserBalance, error) {
+	tx, err := strg.db.BeginTx(ctx, nil)
+	if err != nil {
+		return UserBalance{}, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_balance (user_id) VALUES ($1) ON CONFLICT DO NOTHING", adjustment.UserID); err != nil {
+		if isInvalidTextRepresentation(err) || isForeignKeyViolation(err) {
+			return UserBalance{}, ErrUserNotFound
+		}
+		return UserBalance{}, fmt.Errorf("could not create balance: %w", err)
+	}
+	var balance UserBalance
+	row := tx.QueryRowContext(ctx, "SELECT current, withdrawn FROM user_balance WHERE user_id = $1 FOR UPDATE", adjustment.UserID)
+	if err := row.Scan(&balance.Orders, &balance.Withdrawn); err != nil {
+		return UserBalance{}, fmt.Errorf("could not get balance: %w", err)
+	}
+	if balance.Orders+adjustment.Amount < 0 {
+		strg.logger.InfoContext(ctx, "Got adjustment bigger than balance", "user_id", adjustment.UserID, "amount", adjustment.Amount, "balance", balance.Orders)
+		return UserBalance{}, ErrInsufficientFunds
+	}
+	if err := postLedgerTransaction(ctx, tx, adjustment.UserID, "adjustment", adjustment.Amount, "", adjustment.Reason); err != nil {
+		return UserBalance{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE user_balance SET current = current + $2 WHERE user_id = $1", adjustment.UserID, adjustment.Amount); err != nil {
+		return UserBalance{}, fmt.Errorf("could not update balance: %w", err)
+	}
+	if err := addAuditRecord(ctx, tx, AuditRecord{
+		ActorID:      adjustment.ActorID,
+		Action:       AuditBalanceAdjustment,
+		TargetUserID: adjustment.UserID,
+		Details:      fmt.Sprintf("amount %s: %s", adjustment.Amount, adjustment.Reason),
+	}); err != nil {
+		return UserBalance{}, err
 	}
 	if err := tx.Commit(); err != nil {
-		log.Fatalf("Unable to commit: %v", err)
-		return http.StatusInternalServerError
+		return UserBalance{}, err
 	}
-	return http.StatusOK
+	balance.Orders += adjustment.Amount
+	return balance, nil
+}
+
+func addAuditRecord(ctx context.Context, db interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}, record AuditRecord) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO audit_log (actor_id, action, target_user_id, details) VALUES ($1, $2, $3, $4)",
+		record.ActorID, record.Action, sql.NullString{String: record.TargetUserID, Valid: record.TargetUserID != ""}, record.Details,
+	)
+	if err != nil {
+		return fmt.Errorf("could not add audit record: %w", err)
+	}
+	return nil
+}
+
+func (strg *DBStorage) AddAuditRecord(ctx context.Context, record AuditRecord) error {
+	return addAuditRecord(ctx, strg.db, record)
+}
+
+// GetAuditRecords returns the newest records first, an empty targetUserID means records of all users.
+func (strg *DBStorage) GetAuditRecords(ctx context.Context, targetUserID string, limit int) ([]AuditRecord, error) {
+	rows, err := strg.db.QueryContext(ctx,
+		"SELECT id, actor_id, action, target_user_id, details, created_at FROM audit_log "+
+			"WHERE $1 = '' OR target_user_id::text = $1 ORDER BY id DESC LIMIT $2",
+		targetUserID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]AuditRecord, 0)
+	for rows.Next() {
+		var record AuditRecord
+		var recordTargetUserID sql.NullString
+		if err := rows.Scan(&record.ID, &record.ActorID, &record.Action, &recordTargetUserID, &record.Details, &record.CreatedAt); err != nil {
+			return nil, err
+		}
+		record.TargetUserID = recordTargetUserID.String
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// CreateIdempotencyKey reserves the key for a request being processed for lease,
+// an expired key is reserved anew. A reservation for the same request without a
+// saved response is taken over once its lease ends, e.g. after a crash.
+func (strg *DBStorage) CreateIdempotencyKey(ctx context.Context, record IdempotencyRecord, ttl time.Duration, lease time.Duration) error {
+	_, err := strg.db.ExecContext(ctx, "DELETE FROM idempotency_key WHERE user_id = $1 AND key = $2 AND expires_at <= now()", record.UserID, record.Key)
+	if err != nil {
+		return fmt.Errorf("could not delete expired idempotency key: %w", err)
+	}
+	result, err := strg.db.ExecContext(ctx,
+		`INSERT INTO idempotency_key (user_id, key, request_hash, expires_at, locked_until)
+		VALUES ($1, $2, $3, now() + make_interval(secs => $4), now() + make_interval(secs => $5))
+		ON CONFLICT (user_id, key) DO UPDATE SET locked_until = EXCLUDED.locked_until
+		WHERE idempotency_key.status_code IS NULL AND idempotency_key.request_hash = EXCLUDED.request_hash
+			AND (idempotency_key.locked_until IS NULL OR idempotency_key.locked_until <= now())`,
+		record.UserID, record.Key, record.RequestHash, ttl.Seconds(), lease.Seconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not add idempotency key: %w", err)
+	}
+	reserved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if reserved == 0 {
+		return ErrIdempotencyKeyExists
+	}
+	return nil
+}
+
+func (strg *DBStorage) GetIdempotencyKey(ctx context.Context, userID string, key string) (IdempotencyRecord, error) {
+	row := strg.db.QueryRowContext(ctx,
+		"SELECT request_hash, status_code, content_type, response_body FROM idempotency_key WHERE user_id = $1 AND key = $2 AND expires_at > now()",
+		userID, key,
+	)
+	record := IdempotencyRecord{UserID: userID, Key: key}
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+	err := row.Scan(&record.RequestHash, &statusCode, &contentType, &record.ResponseBody)
+	if errors.Is(err, sql.ErrNoRows) {
+		return IdempotencyRecord{}, ErrIdempotencyKeyNotFound
+	}
+	if err != nil {
+		return IdempotencyRecord{}, fmt.Errorf("could not get idempotency key: %w", err)
+	}
+	record.StatusCode = int(statusCode.Int64)
+	record.ContentType = contentType.String
+	return record, nil
+}
+
+func (strg *DBStorage) SaveIdempotentResponse(ctx context.Context, record IdempotencyRecord) error {
+	result, err := strg.db.ExecContext(ctx,
+		"UPDATE idempotency_key SET status_code = $3, content_type = $4, response_body = $5 WHERE user_id = $1 AND key = $2",
+		record.UserID, record.Key, record.StatusCode, record.ContentType, record.ResponseBody,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrIdempotencyKeyNotFound
+	}
+	return nil
+}
+
+func (strg *DBStorage) DeleteIdempotencyKey(ctx context.Context, userID string, key string) error {
+	_, err := strg.db.ExecContext(ctx, "DELETE FROM idempotency_key WHERE user_id = $1 AND key = $2", userID, key)
+	return err
 }
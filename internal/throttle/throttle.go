@@ -0,0 +1,136 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
+	"log/slog"
+	"time"
+)
+
+// Config of login throttling. Failures are counted in a sliding Window, every
+// failure of a login doubles the pause before its next attempt starting from
+// BaseDelay up to MaxDelay, and MaxLoginFailures failures of a login or
+// MaxIPFailures failures from an ip lock them out for Lockout. Scope separates
+// the counters of throttlers sharing the storage, it is empty for logins.
+type Config struct {
+	Window           time.Duration
+	MaxLoginFailures int
+	MaxIPFailures    int
+	Lockout          time.Duration
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	Scope            string
+}
+
+var DefaultConfig = Config{
+	Window:           15 * time.Minute,
+	MaxLoginFailures: 5,
+	MaxIPFailures:    50,
+	Lockout:          15 * time.Minute,
+	BaseDelay:        time.Second,
+	MaxDelay:         30 * time.Second,
+}
+
+// PasswordResetConfig limits password reset requests, every request counts as a failure.
+var PasswordResetConfig = Config{
+	Window:           time.Hour,
+	MaxLoginFailures: 5,
+	MaxIPFailures:    20,
+	Lockout:          time.Hour,
+	BaseDelay:        time.Minute,
+	MaxDelay:         15 * time.Minute,
+	Scope:            "reset",
+}
+
+// Throttler keeps its state in the storage, so limits are shared by all instances.
+type Throttler struct {
+	storage storage.Storage
+	config  Config
+	logger  *slog.Logger
+}
+
+func NewThrottler(storageForThrottler storage.Storage, config Config, logger *slog.Logger) *Throttler {
+	return &Throttler{storage: storageForThrottler, config: config, logger: logger}
+}
+
+// Check returns how long the client has to wait before the next login attempt, zero means it may try now.
+func (t *Throttler) Check(ctx context.Context, login string, ip string) (time.Duration, error) {
+	login, ip = t.scoped(login), t.scoped(ip)
+	now := time.Now()
+	lockout, err := t.storage.GetLoginLockout(ctx, login, ip)
+	if err == nil {
+		return lockout.LockedUntil.Sub(now), nil
+	}
+	if !errors.Is(err, storage.ErrLockoutNotFound) {
+		return 0, err
+	}
+	failures, err := t.storage.GetLoginFailures(ctx, login, ip, t.config.Window)
+	if err != nil {
+		return 0, err
+	}
+	if failures.ByLogin == 0 {
+		return 0, nil
+	}
+	retryAfter := failures.LastFailure.Add(t.delay(failures.ByLogin)).Sub(now)
+	if retryAfter < 0 {
+		return 0, nil
+	}
+	return retryAfter, nil
+}
+
+// Failed records a failed attempt and locks the login or the ip out when they reach their limit.
+func (t *Throttler) Failed(ctx context.Context, login string, ip string) error {
+	login, ip = t.scoped(login), t.scoped(ip)
+	if err := t.storage.RecordLoginAttempt(ctx, login, ip, false); err != nil {
+		return err
+	}
+	failures, err := t.storage.GetLoginFailures(ctx, login, ip, t.config.Window)
+	if err != nil {
+		return err
+	}
+	if t.config.MaxLoginFailures > 0 && failures.ByLogin >= t.config.MaxLoginFailures {
+		if err := t.lockOut(ctx, storage.LockoutByLogin, login, failures.ByLogin); err != nil {
+			return err
+		}
+	}
+	if t.config.MaxIPFailures > 0 && failures.ByIP >= t.config.MaxIPFailures {
+		if err := t.lockOut(ctx, storage.LockoutByIP, ip, failures.ByIP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Succeeded records a successful attempt, it resets failures of the login but not of the ip.
+func (t *Throttler) Succeeded(ctx context.Context, login string, ip string) error {
+	return t.storage.RecordLoginAttempt(ctx, t.scoped(login), t.scoped(ip), true)
+}
+
+func (t *Throttler) scoped(value string) string {
+	if t.config.Scope == "" {
+		return value
+	}
+	return t.config.Scope + ":" + value
+}
+
+func (t *Throttler) lockOut(ctx context.Context, kind string, key string, failures int) error {
+	lockout, err := t.storage.AddLoginLockout(ctx, storage.LoginLockout{Kind: kind, Key: key, Failures: failures}, t.config.Lockout)
+	if err != nil {
+		return err
+	}
+	t.logger.WarnContext(ctx, "Locked out after too many attempts", "scope", t.config.Scope, "kind", kind, "key", key, "failures", failures, "locked_until", lockout.LockedUntil.Format(time.RFC3339))
+	return nil
+}
+
+// delay returns BaseDelay doubled for every failure after the first one, capped by MaxDelay.
+func (t *Throttler) delay(failures int) time.Duration {
+	delay := t.config.BaseDelay
+	for i := 1; i < failures && delay < t.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.config.MaxDelay {
+		delay = t.config.MaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,116 @@
+package throttle
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/storage"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+var testConfig = Config{
+	Window:           time.Minute,
+	MaxLoginFailures: 3,
+	MaxIPFailures:    5,
+	Lockout:          time.Hour,
+	BaseDelay:        time.Second,
+	MaxDelay:         4 * time.Second,
+}
+
+func TestDelay(t *testing.T) {
+	throttler := NewThrottler(storage.NewMemStorage(slog.Default()), testConfig, slog.Default())
+	for failures, delay := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second} {
+		assert.Equal(t, delay, throttler.delay(failures), failures)
+	}
+}
+
+func TestProgressiveDelay(t *testing.T) {
+	throttler := NewThrottler(storage.NewMemStorage(slog.Default()), testConfig, slog.Default())
+	retryAfter, err := throttler.Check(ctx, "login", "192.0.2.1")
+	require.Nil(t, err)
+	assert.Zero(t, retryAfter)
+
+	require.Nil(t, throttler.Failed(ctx, "login", "192.0.2.1"))
+	retryAfter, err = throttler.Check(ctx, "login", "192.0.2.1")
+	require.Nil(t, err)
+	assert.InDelta(t, time.Second, retryAfter, float64(100*time.Millisecond))
+
+	require.Nil(t, throttler.Failed(ctx, "login", "192.0.2.1"))
+	retryAfter, err = throttler.Check(ctx, "login", "192.0.2.1")
+	require.Nil(t, err)
+	assert.InDelta(t, 2*time.Second, retryAfter, float64(100*time.Millisecond))
+
+	retryAfter, err = throttler.Check(ctx, "another", "192.0.2.1")
+	require.Nil(t, err)
+	assert.Zero(t, retryAfter, "delays are per login")
+}
+
+func TestLockoutByLogin(t *testing.T) {
+	strg := storage.NewMemStorage(slog.Default())
+	throttler := NewThrottler(strg, testConfig, slog.Default())
+	for i := 0; i < testConfig.MaxLoginFailures; i++ {
+		require.Nil(t, throttler.Failed(ctx, "login", "192.0.2.1"))
+	}
+	lockout, err := strg.GetLoginLockout(ctx, "login", "198.51.100.1")
+	require.Nil(t, err)
+	assert.Equal(t, storage.LockoutByLogin, lockout.Kind)
+	assert.Equal(t, testConfig.MaxLoginFailures, lockout.Failures)
+
+	retryAfter, err := throttler.Check(ctx, "login", "198.51.100.1")
+	require.Nil(t, err)
+	assert.InDelta(t, time.Hour, retryAfter, float64(time.Second), "lockout applies from any ip")
+}
+
+func TestSuccessResetsLoginFailures(t *testing.T) {
+	strg := storage.NewMemStorage(slog.Default())
+	throttler := NewThrottler(strg, testConfig, slog.Default())
+	for i := 0; i < testConfig.MaxLoginFailures-1; i++ {
+		require.Nil(t, throttler.Failed(ctx, "login", "192.0.2.1"))
+	}
+	require.Nil(t, throttler.Succeeded(ctx, "login", "192.0.2.1"))
+	retryAfter, err := throttler.Check(ctx, "login", "192.0.2.1")
+	require.Nil(t, err)
+	assert.Zero(t, retryAfter)
+
+	require.Nil(t, throttler.Failed(ctx, "login", "192.0.2.1"))
+	_, err = strg.GetLoginLockout(ctx, "login", "192.0.2.1")
+	assert.ErrorIs(t, err, storage.ErrLockoutNotFound)
+}
+
+func TestLockoutByIP(t *testing.T) {
+	strg := storage.NewMemStorage(slog.Default())
+	throttler := NewThrottler(strg, testConfig, slog.Default())
+	for i := 0; i < testConfig.MaxIPFailures; i++ {
+		require.Nil(t, throttler.Failed(ctx, "login"+string(rune('a'+i)), "192.0.2.1"))
+	}
+	lockout, err := strg.GetLoginLockout(ctx, "fresh-login", "192.0.2.1")
+	require.Nil(t, err)
+	assert.Equal(t, storage.LockoutByIP, lockout.Kind)
+	assert.Equal(t, "192.0.2.1", lockout.Key)
+
+	retryAfter, err := throttler.Check(ctx, "fresh-login", "198.51.100.1")
+	require.Nil(t, err)
+	assert.Zero(t, retryAfter, "other ips are not locked out")
+}
+
+func TestScopesDoNotShareCounters(t *testing.T) {
+	memStorage := storage.NewMemStorage(slog.Default())
+	loginThrottler := NewThrottler(memStorage, testConfig, slog.Default())
+	resetConfig := testConfig
+	resetConfig.Scope = "reset"
+	resetThrottler := NewThrottler(memStorage, resetConfig, slog.Default())
+	for i := 0; i < testConfig.MaxLoginFailures; i++ {
+		require.Nil(t, resetThrottler.Failed(ctx, "login", "192.0.2.1"))
+	}
+	retryAfter, err := resetThrottler.Check(ctx, "login", "192.0.2.1")
+	require.Nil(t, err)
+	assert.InDelta(t, time.Hour, retryAfter, float64(time.Second))
+
+	retryAfter, err = loginThrottler.Check(ctx, "login", "192.0.2.1")
+	require.Nil(t, err)
+	assert.Zero(t, retryAfter)
+}
@@ -0,0 +1,115 @@
+package tokens
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/keyring"
+	"time"
+)
+
+const Issuer = "gophermart"
+
+// AccessAudience and RefreshAudience keep refresh tokens from being accepted as access tokens and vice versa.
+const AccessAudience = "gophermart-api"
+const RefreshAudience = "gophermart-refresh"
+
+// MFAAudience is for pre-auth tokens proving the password was checked, they
+// are exchanged for a session together with a two-factor code.
+const MFAAudience = "gophermart-mfa"
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are JWT claims of both access and refresh tokens, Subject is the user id.
+type Claims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid"`
+}
+
+// TokenPair is returned to clients that authenticate with bearer tokens.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Manager issues and validates HS256 tokens signed by the keyring, the key id is put into the kid header.
+type Manager struct {
+	keys      *keyring.Keyring
+	accessTTL time.Duration
+}
+
+func NewManager(keys *keyring.Keyring, accessTTL time.Duration) *Manager {
+	return &Manager{keys: keys, accessTTL: accessTTL}
+}
+
+// Issue returns an access token living accessTTL and a refresh token living until the session expires.
+func (m *Manager) Issue(userID string, sessionID string, sessionExpiresAt time.Time) (TokenPair, error) {
+	now := time.Now()
+	accessExpiresAt := now.Add(m.accessTTL)
+	if accessExpiresAt.After(sessionExpiresAt) {
+		accessExpiresAt = sessionExpiresAt
+	}
+	accessToken, err := m.sign(userID, sessionID, AccessAudience, now, accessExpiresAt)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refreshToken, err := m.sign(userID, sessionID, RefreshAudience, now, sessionExpiresAt)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessExpiresAt.Sub(now).Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// IssueMFA returns a pre-auth token of the user living ttl.
+func (m *Manager) IssueMFA(userID string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return m.sign(userID, "", MFAAudience, now, now.Add(ttl))
+}
+
+func (m *Manager) sign(userID string, sessionID string, audience string, issuedAt time.Time, expiresAt time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Subject:   userID,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		SessionID: sessionID,
+	})
+	key := m.keys.Active()
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Secret)
+}
+
+// Parse validates signature, issuer, expiry and audience of the token and returns its claims.
+func (m *Manager) Parse(tokenString string, audience string) (Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		secret, ok := m.keys.Secret(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+	if claims.Subject == "" || (audience != MFAAudience && claims.SessionID == "") {
+		return Claims{}, fmt.Errorf("%w: no subject or session", ErrInvalidToken)
+	}
+	return claims, nil
+}
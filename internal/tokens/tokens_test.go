@@ -0,0 +1,137 @@
+package tokens
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tank4gun/go-musthave-diploma-tpl/internal/keyring"
+	"testing"
+	"time"
+)
+
+const userID = "ad29ba3c-7eba-4223-9635-fc71e9c1fa28"
+const sessionID = "0c7d4a4e-3f0a-4a4b-8c71-39f3f2d1a7b5"
+
+func TestIssueAndParse(t *testing.T) {
+	keys, err := keyring.Parse("new:0123456789abcdef0123")
+	require.Nil(t, err)
+	manager := NewManager(keys, 15*time.Minute)
+	pair, err := manager.Issue(userID, sessionID, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	assert.Equal(t, "Bearer", pair.TokenType)
+	assert.InDelta(t, 15*60, pair.ExpiresIn, 1)
+
+	claims, err := manager.Parse(pair.AccessToken, AccessAudience)
+	assert.Nil(t, err)
+	assert.Equal(t, userID, claims.Subject)
+	assert.Equal(t, sessionID, claims.SessionID)
+
+	claims, err = manager.Parse(pair.RefreshToken, RefreshAudience)
+	assert.Nil(t, err)
+	assert.Equal(t, sessionID, claims.SessionID)
+
+	_, err = manager.Parse(pair.RefreshToken, AccessAudience)
+	assert.ErrorIs(t, err, ErrInvalidToken, "refresh token must not be accepted as access token")
+	_, err = manager.Parse(pair.AccessToken, RefreshAudience)
+	assert.ErrorIs(t, err, ErrInvalidToken, "access token must not be accepted as refresh token")
+}
+
+func TestAccessTokenDoesNotOutliveSession(t *testing.T) {
+	keys, err := keyring.Parse("new:0123456789abcdef0123")
+	require.Nil(t, err)
+	pair, err := NewManager(keys, time.Hour).Issue(userID, sessionID, time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	assert.InDelta(t, 60, pair.ExpiresIn, 1)
+}
+
+func TestParseAfterKeyRotation(t *testing.T) {
+	oldKeys, err := keyring.Parse("old:fedcba9876543210fedc")
+	require.Nil(t, err)
+	pair, err := NewManager(oldKeys, time.Minute).Issue(userID, sessionID, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+
+	rotatedKeys, err := keyring.Parse("new:0123456789abcdef0123,old:fedcba9876543210fedc")
+	require.Nil(t, err)
+	_, err = NewManager(rotatedKeys, time.Minute).Parse(pair.AccessToken, AccessAudience)
+	assert.Nil(t, err)
+
+	newKeys, err := keyring.Parse("new:0123456789abcdef0123")
+	require.Nil(t, err)
+	_, err = NewManager(newKeys, time.Minute).Parse(pair.AccessToken, AccessAudience)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestParseInvalid(t *testing.T) {
+	keys, err := keyring.Parse("new:0123456789abcdef0123")
+	require.Nil(t, err)
+	manager := NewManager(keys, time.Minute)
+	secret := []byte("0123456789abcdef0123")
+	signed := func(method jwt.SigningMethod, key interface{}, claims Claims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = "new"
+		tokenString, err := token.SignedString(key)
+		require.Nil(t, err)
+		return tokenString
+	}
+	validClaims := func() Claims {
+		return Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    Issuer,
+				Subject:   userID,
+				Audience:  jwt.ClaimStrings{AccessAudience},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			SessionID: sessionID,
+		}
+	}
+	expired := validClaims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	noExpiry := validClaims()
+	noExpiry.ExpiresAt = nil
+	wrongIssuer := validClaims()
+	wrongIssuer.Issuer = "someone"
+	noSession := validClaims()
+	noSession.SessionID = ""
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"garbage", "not.a.token"},
+		{"expired", signed(jwt.SigningMethodHS256, secret, expired)},
+		{"no_expiry", signed(jwt.SigningMethodHS256, secret, noExpiry)},
+		{"wrong_issuer", signed(jwt.SigningMethodHS256, secret, wrongIssuer)},
+		{"no_session", signed(jwt.SigningMethodHS256, secret, noSession)},
+		{"wrong_secret", signed(jwt.SigningMethodHS256, []byte("another secret value"), validClaims())},
+		{"alg_none", signed(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, validClaims())},
+		{"alg_hs512", signed(jwt.SigningMethodHS512, secret, validClaims())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := manager.Parse(tt.token, AccessAudience)
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+	_, err = manager.Parse(signed(jwt.SigningMethodHS256, secret, validClaims()), AccessAudience)
+	assert.Nil(t, err)
+}
+
+func TestIssueMFA(t *testing.T) {
+	keys, err := keyring.Parse("new:0123456789abcdef0123")
+	require.Nil(t, err)
+	manager := NewManager(keys, 15*time.Minute)
+	token, err := manager.IssueMFA(userID, time.Minute)
+	require.Nil(t, err)
+	claims, err := manager.Parse(token, MFAAudience)
+	assert.Nil(t, err)
+	assert.Equal(t, userID, claims.Subject)
+	assert.Empty(t, claims.SessionID)
+
+	_, err = manager.Parse(token, AccessAudience)
+	assert.ErrorIs(t, err, ErrInvalidToken, "pre-auth token must not be accepted as access token")
+
+	expired, err := manager.IssueMFA(userID, -time.Minute)
+	require.Nil(t, err)
+	_, err = manager.Parse(expired, MFAAudience)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
@@ -2,18 +2,52 @@ package varprs
 
 import (
 	"flag"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"time"
 )
 
 var ServerAddr string
 var DBURI string
+var StorageType string
 var AccrualSysAddr string
+var AccrualWorkers int
+var AccrualQueueSize int
+var SessionTTL = 24 * time.Hour
+var AccessTokenTTL = 15 * time.Minute
+var CookieKeys string
+var PasswordResetTTL = time.Hour
+var NotifyOutbox string
+var LoginWindow = 15 * time.Minute
+var LoginMaxFailures = 5
+var LoginMaxIPFailures = 50
+var LoginLockout = 15 * time.Minute
+var CookieKeysFile string
+var AdminLogins string
+var LogLevel string
+var LogFormat string
 
 func Init() {
 	flag.StringVar(&ServerAddr, "a", "", "GopherMart server address")
 	flag.StringVar(&DBURI, "d", "", "GopherMart database address")
+	flag.StringVar(&StorageType, "s", "", "Storage type: postgres or memory, memory storage loses all data on restart and must be chosen explicitly")
 	flag.StringVar(&AccrualSysAddr, "r", "", "Accrual system address")
+	flag.IntVar(&AccrualWorkers, "w", 4, "Number of accrual system polling workers")
+	flag.IntVar(&AccrualQueueSize, "q", 16, "Size of accrual polling queue")
+	flag.DurationVar(&SessionTTL, "t", SessionTTL, "User session lifetime")
+	flag.DurationVar(&AccessTokenTTL, "e", AccessTokenTTL, "Bearer access token lifetime")
+	flag.StringVar(&CookieKeys, "k", "", "Cookie signing keys as id:secret separated by commas, the first key is active")
+	flag.StringVar(&CookieKeysFile, "f", "", "File with cookie signing keys as id:secret lines, the first key is active")
+	flag.DurationVar(&LoginWindow, "login-window", LoginWindow, "Sliding window for counting failed logins")
+	flag.IntVar(&LoginMaxFailures, "login-max-failures", LoginMaxFailures, "Failed logins of one login before its lockout, 0 disables the lockout")
+	flag.IntVar(&LoginMaxIPFailures, "login-max-ip-failures", LoginMaxIPFailures, "Failed logins from one ip before its lockout, 0 disables the lockout")
+	flag.DurationVar(&LoginLockout, "login-lockout", LoginLockout, "Lockout duration after too many failed logins")
+	flag.DurationVar(&PasswordResetTTL, "password-reset-ttl", PasswordResetTTL, "Password reset token lifetime")
+	flag.StringVar(&NotifyOutbox, "notify-outbox", "", "File to write user notifications to, they are logged when it is not set")
+	flag.StringVar(&AdminLogins, "admins", "", "Logins of registered users to grant the admin role to on start, separated by commas")
+	flag.StringVar(&LogLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&LogFormat, "log-format", "text", "Log format: text or json")
 	flag.Parse()
 
 	ServerAddrEnv := os.Getenv("RUN_ADDRESS")
@@ -26,10 +60,127 @@ func Init() {
 		DBURI = DBURIEnv
 	}
 
+	StorageTypeEnv := os.Getenv("STORAGE_TYPE")
+	if StorageTypeEnv != "" {
+		StorageType = StorageTypeEnv
+	}
+	if StorageType == "" {
+		StorageType = "postgres"
+	}
+
 	AccrualSysAddrEnv := os.Getenv("ACCRUAL_SYSTEM_ADDRESS")
 	if AccrualSysAddrEnv != "" {
 		AccrualSysAddr = AccrualSysAddrEnv
 	}
 
-	log.Printf("Got ServerAddr %s, DBURI %s, AccrualSysAddr %s to run GopherMart", ServerAddr, DBURI, AccrualSysAddr)
+	AccrualWorkersEnv := os.Getenv("ACCRUAL_WORKERS")
+	if AccrualWorkersEnv != "" {
+		if workers, err := strconv.Atoi(AccrualWorkersEnv); err == nil {
+			AccrualWorkers = workers
+		} else {
+			slog.Warn("Got bad ACCRUAL_WORKERS", "value", AccrualWorkersEnv, "error", err)
+		}
+	}
+
+	AccrualQueueSizeEnv := os.Getenv("ACCRUAL_QUEUE_SIZE")
+	if AccrualQueueSizeEnv != "" {
+		if queueSize, err := strconv.Atoi(AccrualQueueSizeEnv); err == nil {
+			AccrualQueueSize = queueSize
+		} else {
+			slog.Warn("Got bad ACCRUAL_QUEUE_SIZE", "value", AccrualQueueSizeEnv, "error", err)
+		}
+	}
+
+	SessionTTLEnv := os.Getenv("SESSION_TTL")
+	if SessionTTLEnv != "" {
+		if sessionTTL, err := time.ParseDuration(SessionTTLEnv); err == nil {
+			SessionTTL = sessionTTL
+		} else {
+			slog.Warn("Got bad SESSION_TTL", "value", SessionTTLEnv, "error", err)
+		}
+	}
+
+	AccessTokenTTLEnv := os.Getenv("ACCESS_TOKEN_TTL")
+	if AccessTokenTTLEnv != "" {
+		if accessTokenTTL, err := time.ParseDuration(AccessTokenTTLEnv); err == nil {
+			AccessTokenTTL = accessTokenTTL
+		} else {
+			slog.Warn("Got bad ACCESS_TOKEN_TTL", "value", AccessTokenTTLEnv, "error", err)
+		}
+	}
+
+	LoginWindowEnv := os.Getenv("LOGIN_WINDOW")
+	if LoginWindowEnv != "" {
+		if loginWindow, err := time.ParseDuration(LoginWindowEnv); err == nil {
+			LoginWindow = loginWindow
+		} else {
+			slog.Warn("Got bad LOGIN_WINDOW", "value", LoginWindowEnv, "error", err)
+		}
+	}
+
+	LoginMaxFailuresEnv := os.Getenv("LOGIN_MAX_FAILURES")
+	if LoginMaxFailuresEnv != "" {
+		if maxFailures, err := strconv.Atoi(LoginMaxFailuresEnv); err == nil {
+			LoginMaxFailures = maxFailures
+		} else {
+			slog.Warn("Got bad LOGIN_MAX_FAILURES", "value", LoginMaxFailuresEnv, "error", err)
+		}
+	}
+
+	LoginMaxIPFailuresEnv := os.Getenv("LOGIN_MAX_IP_FAILURES")
+	if LoginMaxIPFailuresEnv != "" {
+		if maxFailures, err := strconv.Atoi(LoginMaxIPFailuresEnv); err == nil {
+			LoginMaxIPFailures = maxFailures
+		} else {
+			slog.Warn("Got bad LOGIN_MAX_IP_FAILURES", "value", LoginMaxIPFailuresEnv, "error", err)
+		}
+	}
+
+	LoginLockoutEnv := os.Getenv("LOGIN_LOCKOUT")
+	if LoginLockoutEnv != "" {
+		if loginLockout, err := time.ParseDuration(LoginLockoutEnv); err == nil {
+			LoginLockout = loginLockout
+		} else {
+			slog.Warn("Got bad LOGIN_LOCKOUT", "value", LoginLockoutEnv, "error", err)
+		}
+	}
+
+	PasswordResetTTLEnv := os.Getenv("PASSWORD_RESET_TTL")
+	if PasswordResetTTLEnv != "" {
+		if passwordResetTTL, err := time.ParseDuration(PasswordResetTTLEnv); err == nil {
+			PasswordResetTTL = passwordResetTTL
+		} else {
+			slog.Warn("Got bad PASSWORD_RESET_TTL", "value", PasswordResetTTLEnv, "error", err)
+		}
+	}
+
+	NotifyOutboxEnv := os.Getenv("NOTIFY_OUTBOX")
+	if NotifyOutboxEnv != "" {
+		NotifyOutbox = NotifyOutboxEnv
+	}
+
+	CookieKeysEnv := os.Getenv("COOKIE_KEYS")
+	if CookieKeysEnv != "" {
+		CookieKeys = CookieKeysEnv
+	}
+
+	CookieKeysFileEnv := os.Getenv("COOKIE_KEYS_FILE")
+	if CookieKeysFileEnv != "" {
+		CookieKeysFile = CookieKeysFileEnv
+	}
+
+	AdminLoginsEnv := os.Getenv("ADMIN_LOGINS")
+	if AdminLoginsEnv != "" {
+		AdminLogins = AdminLoginsEnv
+	}
+
+	LogLevelEnv := os.Getenv("LOG_LEVEL")
+	if LogLevelEnv != "" {
+		LogLevel = LogLevelEnv
+	}
+
+	LogFormatEnv := os.Getenv("LOG_FORMAT")
+	if LogFormatEnv != "" {
+		LogFormat = LogFormatEnv
+	}
 }